@@ -0,0 +1,38 @@
+// Package main provides a cli to maintain a key/value database without
+// starting a node, for instance to verify it before and after a migration.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"go.dedis.ch/dela/cli"
+	"go.dedis.ch/dela/cli/ucli"
+	"go.dedis.ch/purb-db/store/kv/command"
+)
+
+var builder cli.Builder = ucli.NewBuilder("purbkv", nil)
+var printer io.Writer = os.Stderr
+
+func main() {
+	err := run(os.Args, command.Initializer{})
+	if err != nil {
+		fmt.Fprintf(printer, "%+v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, inits ...cli.Initializer) error {
+	for _, init := range inits {
+		init.SetCommands(builder)
+	}
+
+	app := builder.Build()
+	err := app.Run(args)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/dela/cli"
+)
+
+func TestRun(t *testing.T) {
+	b := &fakeBuilder{}
+	builder = b
+	init := &fakeInit{}
+
+	err := run([]string{"purbkv"}, init)
+	require.NoError(t, err)
+
+	require.True(t, b.called)
+	require.True(t, init.called)
+}
+
+func TestRun_Error(t *testing.T) {
+	builder = &fakeBuilder{err: errors.New("fake")}
+
+	err := run([]string{"purbkv"})
+	require.EqualError(t, err, "fake")
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+type fakeBuilder struct {
+	cli.Builder
+	err    error
+	called bool
+}
+
+func (f *fakeBuilder) Build() cli.Application {
+	f.called = true
+	return &fakeApp{err: f.err}
+}
+
+type fakeApp struct {
+	err error
+}
+
+func (f fakeApp) Run(arguments []string) error {
+	return f.err
+}
+
+type fakeInit struct {
+	called bool
+}
+
+func (f *fakeInit) SetCommands(cli.Provider) {
+	f.called = true
+}
@@ -0,0 +1,152 @@
+package purbkv
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultBatchSize is the number of calls above which a batch is committed
+	// without waiting for its delay.
+	defaultBatchSize = 1000
+	// defaultBatchDelay is how long a batch waits for other calls.
+	defaultBatchDelay = 10 * time.Millisecond
+)
+
+// errTrySolo is returned to the call that failed a batch, which then runs in
+// its own update.
+var errTrySolo = xerrors.New("batch function returned an error and should be re-run solo")
+
+// batcher groups the calls to Batch of concurrent goroutines in batches, which
+// are each committed by a single update.
+type batcher struct {
+	sync.Mutex
+
+	maxSize  int
+	maxDelay time.Duration
+	update   func(fn func(WritableTx) error) error
+	// current is the batch that takes the new calls
+	current *batch
+}
+
+// batch is a group of calls that are committed together.
+type batch struct {
+	batcher *batcher
+	timer   *time.Timer
+	start   sync.Once
+	calls   []batchCall
+}
+
+type batchCall struct {
+	fn  func(WritableTx) error
+	err chan<- error
+}
+
+func newBatcher(maxSize int, maxDelay time.Duration,
+	update func(fn func(WritableTx) error) error) *batcher {
+
+	return &batcher{
+		maxSize:  maxSize,
+		maxDelay: maxDelay,
+		update:   update,
+	}
+}
+
+// Batch implements purbkv.Batcher. It executes the writable transaction in
+// the same update as the ones of the concurrent calls, which is committed when
+// the batch is full or after a short delay. When a function fails, the update
+// is discarded and run again without it, and the function then runs in its own
+// update so that its error is returned to its caller only. A function may
+// therefore be called more than once, and it must only have an effect through
+// the transaction.
+func (p *purbDB) Batch(fn func(WritableTx) error) error {
+	errCh := make(chan error, 1)
+
+	p.batches.add(batchCall{fn: fn, err: errCh})
+
+	err := <-errCh
+	if err == errTrySolo {
+		err = p.Update(fn)
+	}
+
+	return err
+}
+
+func (b *batcher) add(call batchCall) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.current == nil || len(b.current.calls) >= b.maxSize {
+		b.current = &batch{batcher: b}
+		b.current.timer = time.AfterFunc(b.maxDelay, b.current.trigger)
+	}
+
+	b.current.calls = append(b.current.calls, call)
+
+	// a full batch is committed right away
+	if len(b.current.calls) >= b.maxSize {
+		go b.current.trigger()
+	}
+}
+
+// trigger runs the batch once, when it is full or when its delay expires.
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+func (b *batch) run() {
+	b.batcher.Lock()
+	b.timer.Stop()
+
+	// the next calls go to a new batch
+	if b.batcher.current == b {
+		b.batcher.current = nil
+	}
+
+	b.batcher.Unlock()
+
+	for len(b.calls) > 0 {
+		failed := -1
+
+		err := b.batcher.update(func(tx WritableTx) error {
+			for i, call := range b.calls {
+				err := safelyCall(call.fn, tx)
+				if err != nil {
+					failed = i
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if failed < 0 {
+			for _, call := range b.calls {
+				call.err <- err
+			}
+
+			return
+		}
+
+		// the update is discarded, and the others are run again without the
+		// function that failed
+		b.calls[failed].err <- errTrySolo
+		b.calls = slices.Delete(b.calls, failed, failed+1)
+	}
+}
+
+// safelyCall returns a panic of the function as an error, so that it does not
+// stop the other calls of the batch.
+func safelyCall(fn func(WritableTx) error, tx WritableTx) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = xerrors.Errorf("batch function panicked: %v", r)
+		}
+	}()
+
+	return fn(tx)
+}
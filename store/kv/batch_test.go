@@ -0,0 +1,158 @@
+package purbkv
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestBatch_Coalesce(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &failingStore{BlobStore: NewMemoryStore()}
+
+	db, err := NewDB(dir, true, WithBlobStore(store), WithBatchLimits(1000, time.Hour))
+	require.NoError(t, err)
+	defer db.Close()
+
+	p := db.(*purbDB)
+	store.puts.Store(0)
+
+	const count = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			errs <- db.(Batcher).Batch(func(txn WritableTx) error {
+				b, err := txn.GetBucketOrCreate([]byte("bucket"))
+				if err != nil {
+					return err
+				}
+
+				return b.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+			})
+		}(i)
+	}
+
+	// the batch waits for its delay until all the calls are added
+	require.Eventually(t, func() bool {
+		p.batches.Lock()
+		defer p.batches.Unlock()
+
+		return p.batches.current != nil && len(p.batches.current.calls) == count
+	}, 10*time.Second, time.Millisecond)
+
+	p.batches.Lock()
+	current := p.batches.current
+	p.batches.Unlock()
+
+	current.trigger()
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// the calls are written at once
+	require.Equal(t, int64(1), store.puts.Load())
+
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%03d", i)
+	}
+
+	requirePairs(t, db, "bucket", keys)
+}
+
+func TestBatch_Failure(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithBatchLimits(3, time.Hour))
+	require.NoError(t, err)
+	defer db.Close()
+
+	errFailure := xerrors.New("oops")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	calls := make([]int, 3)
+
+	for i := range errs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			errs[i] = db.(Batcher).Batch(func(txn WritableTx) error {
+				calls[i]++
+
+				b, err := txn.GetBucketOrCreate([]byte("bucket"))
+				if err != nil {
+					return err
+				}
+
+				err = b.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+				if err != nil {
+					return err
+				}
+
+				if i == 1 {
+					return errFailure
+				}
+
+				return nil
+			})
+		}(i)
+	}
+
+	// the batch is committed as soon as it is full
+	wg.Wait()
+
+	// only the function that failed gets its error
+	require.NoError(t, errs[0])
+	require.ErrorIs(t, errs[1], errFailure)
+	require.NoError(t, errs[2])
+
+	// it runs a second time on its own
+	require.Equal(t, 2, calls[1])
+
+	requirePairs(t, db, "bucket", []string{"key000", "key002"})
+}
+
+func TestBatch_Closed(t *testing.T) {
+	db, err := NewMemoryDB(false, WithBatchLimits(10, time.Millisecond))
+	require.NoError(t, err)
+
+	require.NoError(t, db.Close())
+
+	err = db.(Batcher).Batch(func(txn WritableTx) error {
+		return nil
+	})
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestBatch_Panic(t *testing.T) {
+	tx := &dpTx{}
+
+	err := safelyCall(func(WritableTx) error {
+		panic("oops")
+	}, tx)
+	require.EqualError(t, err, "batch function panicked: oops")
+}
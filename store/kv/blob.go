@@ -7,20 +7,164 @@ import (
 	"go.dedis.ch/libpurb/libpurb"
 	"golang.org/x/xerrors"
 	"path/filepath"
+	"sync"
 
 	"go.dedis.ch/kyber/v3/util/random"
 )
 
 const numberOfRecipients = 1
 
-// NewBlob creates a new blob
-func NewBlob(path string) *libpurb.Purb {
+// Blob encodes and decodes the database as a PURB, after padding the payload
+// according to the padding policy.
+type Blob struct {
+	recipients []libpurb.Recipient
+	simplified bool
+	padding    Padding
+}
+
+// blobTemplate contains the parameters of a blob.
+type blobTemplate struct {
+	simplified bool
+	padding    Padding
+	strict     bool
+	ephemeral  bool
+	fsys       FileSystem
+}
+
+// BlobOption is the type of option to set some fields of a blob.
+type BlobOption func(*blobTemplate)
+
+// WithSimplifiedEntryPoints is an option to place the entry points linearly
+// after the cornerstone instead of using a hash table. A blob should be decoded
+// with the mode it was encoded with.
+func WithSimplifiedEntryPoints() BlobOption {
+	return func(tmpl *blobTemplate) {
+		tmpl.simplified = true
+	}
+}
+
+// WithPadding is an option to set the padding policy applied to the payload
+// before it is encrypted. The default is Padmé.
+func WithPadding(padding Padding) BlobOption {
+	return func(tmpl *blobTemplate) {
+		tmpl.padding = padding
+	}
+}
+
+// withLooseKeys is an option to accept a key file that is accessible by other
+// users.
+func withLooseKeys() BlobOption {
+	return func(tmpl *blobTemplate) {
+		tmpl.strict = false
+	}
+}
+
+// withFileSystem is an option to set the file system of the key file.
+func withFileSystem(fsys FileSystem) BlobOption {
+	return func(tmpl *blobTemplate) {
+		tmpl.fsys = fsys
+	}
+}
+
+// withEphemeralKeys is an option to generate fresh keys that are never written
+// to disk, for a database that only lives in memory.
+func withEphemeralKeys() BlobOption {
+	return func(tmpl *blobTemplate) {
+		tmpl.ephemeral = true
+	}
+}
+
+// NewBlob creates a new blob using the keys stored in the given directory,
+// or fresh ones if there are none yet.
+func NewBlob(path string, opts ...BlobOption) (*Blob, error) {
+	tmpl := blobTemplate{
+		padding: PadmePadding(),
+		strict:  true,
+		fsys:    osFS{},
+	}
+
+	for _, opt := range opts {
+		opt(&tmpl)
+	}
+
+	var recipients []libpurb.Recipient
+	var err error
+
+	if tmpl.ephemeral {
+		recipients = newRecipients(newKeyPairs())
+	} else {
+		recipients, err = createRecipients(tmpl.fsys, path, tmpl.strict)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create recipients: %v", err)
+	}
+
+	b := &Blob{
+		recipients: recipients,
+		simplified: tmpl.simplified,
+		padding:    tmpl.padding,
+	}
+
+	return b, nil
+}
+
+// Encode pads the data and encodes it into a PURB. The payload of the database
+// is self-delimiting, so the padding is ignored when it is decoded.
+func (b *Blob) Encode(data []byte) ([]byte, error) {
+	padded := data
+
+	size, err := b.padding.PaddedLength(len(data))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to pad: %w", err)
+	}
+
+	if size > len(data) {
+		padded = make([]byte, size)
+		copy(padded, data)
+		defer wipe(padded)
+	}
+
+	return Encode(b.newPurb(), padded)
+}
+
+// Decode decodes a PURB and returns the padded payload.
+func (b *Blob) Decode(blob []byte) ([]byte, error) {
+	return Decode(b.newPurb(), blob)
+}
+
+// Headroom returns the number of bytes a payload of the given size can still
+// grow before the blob grows.
+func (b *Blob) Headroom(n int) (int, error) {
+	size, err := b.padding.PaddedLength(n)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to pad: %w", err)
+	}
+
+	return size - n, nil
+}
+
+// Wipe clears the private keys of the blob, which cannot decode anymore.
+func (b *Blob) Wipe() {
+	for _, r := range b.recipients {
+		wipeScalar(r.PrivateKey)
+	}
+}
+
+// newPurb returns a fresh PURB for every operation, as a PURB keeps the state
+// of its last encoding. The public keys are copied because the encoding
+// overwrites them with the shared secret.
+func (b *Blob) newPurb() *libpurb.Purb {
 	p := libpurb.NewPurb(
 		getSuiteInfo(),
-		false,
+		b.simplified,
 		random.New(),
 	)
-	p.Recipients = createRecipients(path)
+
+	p.Recipients = make([]libpurb.Recipient, len(b.recipients))
+	for i, r := range b.recipients {
+		r.PublicKey = r.PublicKey.Clone()
+		p.Recipients[i] = r
+	}
 
 	return p
 }
@@ -47,12 +191,18 @@ func Decode(purb *libpurb.Purb, blob []byte) ([]byte, error) {
 // ---------------------------------------------------------------------------
 // helper functions
 
+// suiteName is the name of the suite of the PURBs, which is computed once as
+// creating the curve is expensive compared to the encoding of a small blob.
+var suiteName = sync.OnceValue(func() string {
+	return curve25519.NewBlakeSHA256Curve25519(true).String()
+})
+
 // see example in libpurb
 func getSuiteInfo() libpurb.SuiteInfoMap {
 	info := make(libpurb.SuiteInfoMap)
 	cornerstoneLength := 32             // defined by Curve 25519
 	entryPointLength := 16 + 4 + 4 + 16 // 16-byte symmetric key + 2 * 4-byte offset positions + 16-byte authentication tag
-	info[curve25519.NewBlakeSHA256Curve25519(true).String()] = &libpurb.SuiteInfo{
+	info[suiteName()] = &libpurb.SuiteInfo{
 		AllowedPositions: []int{
 			12 + 0*cornerstoneLength,
 			12 + 1*cornerstoneLength,
@@ -65,29 +215,54 @@ func getSuiteInfo() libpurb.SuiteInfoMap {
 }
 
 // see example in libpurb
-func createRecipients(path string) []libpurb.Recipient {
-	r := make([]libpurb.Recipient, 0)
-	suite := []libpurb.Suite{curve25519.NewBlakeSHA256Curve25519(true)}
-
-	keysPath := filepath.Join(path, "purb.keys")
+func createRecipients(fsys FileSystem, path string, strict bool) ([]libpurb.Recipient, error) {
+	keysPath := filepath.Join(path, keysFileName)
 	loader := NewKeysLoader(keysPath)
-	keypair := make([]key.Pair, numberOfRecipients)
-	err := loader.Load(&keypair)
-	if err != nil {
-		// cannot load keys, create new ones
-		for i := range keypair {
-			keypair[i] = *key.NewKeyPair(suite[0])
-		}
-		err := loader.Save(&keypair)
+	loader.strict = strict
+	loader.fsys = fsys
+
+	if loader.Exists() {
+		// never replace existing keys, the database would be lost
+		keypair := make([]key.Pair, numberOfRecipients)
+
+		err := loader.Load(&keypair)
 		if err != nil {
-			panic(err)
+			return nil, xerrors.Errorf("failed to load keys: %v", err)
 		}
+
+		return newRecipients(keypair), nil
+	}
+
+	keypair := newKeyPairs()
+
+	err := loader.Save(&keypair)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to save keys: %v", err)
 	}
 
-	for i := 0; i < numberOfRecipients; i++ {
+	return newRecipients(keypair), nil
+}
+
+// newKeyPairs generates fresh keys for the recipients.
+func newKeyPairs() []key.Pair {
+	suite := curve25519.NewBlakeSHA256Curve25519(true)
+
+	keypair := make([]key.Pair, numberOfRecipients)
+	for i := range keypair {
+		keypair[i] = *key.NewKeyPair(suite)
+	}
+
+	return keypair
+}
+
+func newRecipients(keypair []key.Pair) []libpurb.Recipient {
+	r := make([]libpurb.Recipient, 0, len(keypair))
+	suite := curve25519.NewBlakeSHA256Curve25519(true)
+
+	for i := range keypair {
 		r = append(r, libpurb.Recipient{
-			SuiteName:  suite[0].String(),
-			Suite:      suite[0],
+			SuiteName:  suite.String(),
+			Suite:      suite,
 			PublicKey:  keypair[i].Public,
 			PrivateKey: keypair[i].Private,
 		})
@@ -0,0 +1,219 @@
+package purbkv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const blobTestDir = "purb-blob"
+
+func TestBlob_EncodeDecode(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), blobTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, opts := range [][]BlobOption{
+		nil,
+		{WithSimplifiedEntryPoints()},
+		{WithPadding(BucketPadding(512))},
+		{WithSimplifiedEntryPoints(), WithPadding(PowerOfTwoPadding())},
+	} {
+		b, err := NewBlob(dir, opts...)
+		require.NoError(t, err)
+
+		blob, err := b.Encode([]byte("ping"))
+		require.NoError(t, err)
+
+		data, err := b.Decode(blob)
+		require.NoError(t, err)
+		require.Equal(t, []byte("ping"), data[:4])
+	}
+}
+
+func TestBlob_EncodeTwice(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), blobTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBlob(dir)
+	require.NoError(t, err)
+
+	_, err = b.Encode([]byte("ping"))
+	require.NoError(t, err)
+
+	blob, err := b.Encode([]byte("pong"))
+	require.NoError(t, err)
+
+	data, err := b.Decode(blob)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), data)
+}
+
+func TestBlob_PadmeSizes(t *testing.T) {
+	small, large := encodedSizes(t)
+
+	// Padmé only hides the lowest bits of the size
+	require.Less(t, small, large)
+}
+
+func TestBlob_BucketSizes(t *testing.T) {
+	small, large := encodedSizes(t, WithPadding(BucketPadding(4096)))
+
+	require.Equal(t, small, large)
+	require.Greater(t, small, 4096)
+}
+
+func TestBlob_PowerOfTwoSizes(t *testing.T) {
+	small, large := encodedSizes(t, WithPadding(PowerOfTwoPadding()))
+
+	require.Equal(t, small, large)
+	require.Greater(t, small, 2048)
+}
+
+func TestBlob_DBWithPadding(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), blobTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opt := WithBlobOptions(WithPadding(BucketPadding(1 << 16)))
+
+	db, err := NewDB(dir, true, opt)
+	require.NoError(t, err)
+
+	err = db.Update(func(txn WritableTx) error {
+		b, err := txn.GetBucketOrCreate([]byte("bucket"))
+		require.NoError(t, err)
+
+		return b.Set([]byte("ping"), []byte("pong"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	require.Greater(t, fileSize(t, dir), int64(1<<16))
+
+	db, err = NewDB(dir, true, opt)
+	require.NoError(t, err)
+
+	err = db.View(func(txn ReadableTx) error {
+		value, err := txn.GetBucket([]byte("bucket")).Get([]byte("ping"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("pong"), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBlob_DBWithFixedSize(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), blobTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithBlobOptions(WithPadding(FixedSizePadding(4096, 0))))
+	require.NoError(t, err)
+
+	headroom, err := db.(SizeReporter).Headroom()
+	require.NoError(t, err)
+	require.Greater(t, headroom, 4000)
+
+	setValue(t, db, []byte("A"), make([]byte, 10))
+	size := fileSize(t, dir)
+
+	setValue(t, db, []byte("B"), make([]byte, 1000))
+	require.Equal(t, size, fileSize(t, dir))
+
+	next, err := db.(SizeReporter).Headroom()
+	require.NoError(t, err)
+	require.Less(t, next, headroom-1000)
+
+	err = db.Update(func(txn WritableTx) error {
+		b, err := txn.GetBucketOrCreate([]byte("bucket"))
+		require.NoError(t, err)
+
+		return b.Set([]byte("C"), make([]byte, 4096))
+	})
+	require.ErrorIs(t, err, ErrSizeExceeded)
+	require.Equal(t, size, fileSize(t, dir))
+
+	// the failed update must not be visible
+	err = db.View(func(txn ReadableTx) error {
+		_, err := txn.GetBucket([]byte("bucket")).Get([]byte("C"))
+		require.Error(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBlob_DBWithStepwiseSize(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), blobTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithBlobOptions(WithPadding(FixedSizePadding(4096, 8192))))
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("A"), make([]byte, 10))
+	size := fileSize(t, dir)
+
+	setValue(t, db, []byte("B"), make([]byte, 5000))
+	grown := fileSize(t, dir)
+	require.Greater(t, grown, size+8000)
+
+	setValue(t, db, []byte("C"), make([]byte, 5000))
+	require.Equal(t, grown, fileSize(t, dir))
+}
+
+func TestBlob_HeadroomWithoutPurb(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), blobTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+
+	_, err = db.(SizeReporter).Headroom()
+	require.EqualError(t, err, "size hiding requires PURB")
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// encodedSizes returns the size of the blobs for a payload of 1100 bytes and
+// one of 2000 bytes.
+func encodedSizes(t *testing.T, opts ...BlobOption) (int, int) {
+	dir, err := os.MkdirTemp(os.TempDir(), blobTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBlob(dir, opts...)
+	require.NoError(t, err)
+
+	small, err := b.Encode(make([]byte, 1100))
+	require.NoError(t, err)
+
+	large, err := b.Encode(make([]byte, 2000))
+	require.NoError(t, err)
+
+	return len(small), len(large)
+}
+
+func setValue(t *testing.T, db DB, key, value []byte) {
+	err := db.Update(func(txn WritableTx) error {
+		b, err := txn.GetBucketOrCreate([]byte("bucket"))
+		require.NoError(t, err)
+
+		return b.Set(key, value)
+	})
+	require.NoError(t, err)
+}
+
+func fileSize(t *testing.T, dir string) int64 {
+	info, err := os.Stat(filepath.Join(dir, purbFileName))
+	require.NoError(t, err)
+
+	return info.Size()
+}
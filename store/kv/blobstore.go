@@ -0,0 +1,125 @@
+package purbkv
+
+import (
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// fileStore keeps the objects as files of a local directory.
+//
+// - implements purbkv.BlobStore
+type fileStore struct {
+	fsys FileSystem
+	dir  string
+}
+
+// NewFileStore returns a store that keeps the objects as files of the
+// directory, which is the default of a database.
+func NewFileStore(dir string) BlobStore {
+	return newFileStore(osFS{}, dir)
+}
+
+func newFileStore(fsys FileSystem, dir string) fileStore {
+	return fileStore{fsys: fsys, dir: dir}
+}
+
+// Get implements purbkv.BlobStore. It reads the file of the object.
+func (s fileStore) Get(name string) ([]byte, error) {
+	data, err := s.fsys.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read file: %w", err)
+	}
+
+	return data, nil
+}
+
+// Put implements purbkv.BlobStore. It writes the file of the object to a
+// temporary file that replaces it once it is complete.
+func (s fileStore) Put(name string, data []byte) error {
+	return writeFileAtomic(s.fsys, filepath.Join(s.dir, name), data)
+}
+
+// Exists implements purbkv.BlobStore. It returns true if the file of the
+// object exists.
+func (s fileStore) Exists(name string) (bool, error) {
+	return fileExists(s.fsys, filepath.Join(s.dir, name))
+}
+
+// Delete implements purbkv.BlobStore. It overwrites the file of the object with
+// zeros and removes it, as it may be in plaintext.
+func (s fileStore) Delete(name string) error {
+	path := filepath.Join(s.dir, name)
+
+	exists, err := fileExists(s.fsys, path)
+	if err != nil {
+		return xerrors.Errorf("failed to stat file: %v", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	return shredFile(s.fsys, path)
+}
+
+// memoryStore keeps the objects in memory.
+//
+// - implements purbkv.BlobStore
+type memoryStore struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+// NewMemoryStore returns a store that keeps the objects in memory. Unlike
+// NewMemoryDB, a database can be closed and opened again on the same store.
+func NewMemoryStore() BlobStore {
+	return &memoryStore{objects: make(map[string][]byte)}
+}
+
+// Get implements purbkv.BlobStore. It returns a copy of the object.
+func (s *memoryStore) Get(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	data, found := s.objects[name]
+	if !found {
+		return nil, xerrors.Errorf("object %q: %w", name, fs.ErrNotExist)
+	}
+
+	return slices.Clone(data), nil
+}
+
+// Put implements purbkv.BlobStore. It stores a copy of the data.
+func (s *memoryStore) Put(name string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	wipe(s.objects[name])
+	s.objects[name] = slices.Clone(data)
+
+	return nil
+}
+
+// Exists implements purbkv.BlobStore. It returns true if the object exists.
+func (s *memoryStore) Exists(name string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	_, found := s.objects[name]
+
+	return found, nil
+}
+
+// Delete implements purbkv.BlobStore. It wipes the object and removes it.
+func (s *memoryStore) Delete(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	wipe(s.objects[name])
+	delete(s.objects, name)
+
+	return nil
+}
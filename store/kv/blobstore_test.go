@@ -0,0 +1,134 @@
+package purbkv
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testBlobStore(t, NewFileStore(dir))
+
+	// temporary files are never left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	err = NewFileStore(dir).Put("object", []byte("data"))
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(dir, "object"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(filePerm), info.Mode().Perm())
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+
+	testBlobStore(t, store)
+
+	data := []byte("data")
+	require.NoError(t, store.Put("object", data))
+
+	// the store keeps its own copy
+	data[0] = 'x'
+
+	stored, err := store.Get("object")
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), stored)
+
+	stored[0] = 'x'
+
+	stored, err = store.Get("object")
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), stored)
+}
+
+func TestDb_BlobStore(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewMemoryStore()
+
+	db, err := NewDB(dir, true, WithBlobStore(store))
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("ping"), []byte("pong"))
+	require.NoError(t, db.Close())
+
+	// only the keys are written to the directory
+	require.FileExists(t, filepath.Join(dir, keysFileName))
+	require.NoFileExists(t, filepath.Join(dir, purbFileName))
+
+	exists, err := store.Exists(purbFileName)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	db, err = NewDB(dir, true, WithBlobStore(store))
+	require.NoError(t, err)
+
+	requireValue(t, db, "bucket", "ping", "pong")
+
+	require.NoError(t, db.(Migrator).Migrate(false))
+	require.NoError(t, db.Close())
+
+	exists, err = store.Exists(purbFileName)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	_, err = NewDB(dir, true, WithBlobStore(store))
+	require.ErrorIs(t, err, ErrOtherFormat)
+
+	db, err = NewDB(dir, false, WithBlobStore(store))
+	require.NoError(t, err)
+	defer db.Close()
+
+	requireValue(t, db, "bucket", "ping", "pong")
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// testBlobStore checks the contract of an empty store.
+func testBlobStore(t *testing.T, store BlobStore) {
+	_, err := store.Get("object")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	exists, err := store.Exists("object")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, store.Delete("object"))
+
+	require.NoError(t, store.Put("object", []byte("first")))
+	require.NoError(t, store.Put("object", []byte("second")))
+
+	exists, err = store.Exists("object")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	data, err := store.Get("object")
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), data)
+
+	require.NoError(t, store.Put("empty", nil))
+
+	data, err = store.Get("empty")
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	require.NoError(t, store.Delete("object"))
+	require.NoError(t, store.Delete("empty"))
+
+	exists, err = store.Exists("object")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
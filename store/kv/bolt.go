@@ -0,0 +1,223 @@
+package purbkv
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"go.dedis.ch/dela"
+	delakv "go.dedis.ch/dela/core/store/kv"
+	"go.etcd.io/bbolt"
+	"golang.org/x/xerrors"
+)
+
+// boltTimeout is how long to wait for the lock of a bbolt file, which is held
+// by a running node.
+const boltTimeout = time.Second
+
+// TransferReport is the result of an import or an export.
+type TransferReport struct {
+	Buckets int
+	Pairs   int
+}
+
+// ImportBolt copies every bucket of the bbolt database file used by dela's
+// kv.DB into a fresh database in the directory at the given path, which must
+// not hold a database yet, in the store of the options if any. The bbolt file
+// is opened read-only and must not be in use by a node. The files of the new
+// database are removed when the import fails, so that it can be retried.
+func ImportBolt(boltPath, path string, purbIsOn bool, opts ...Option) (TransferReport, error) {
+	var report TransferReport
+
+	for _, format := range []bool{true, false} {
+		exists, err := dbExists(path, format, opts)
+		if err != nil {
+			return report, err
+		}
+		if exists {
+			return report, xerrors.Errorf("refusing to import into existing %s",
+				dbFileName(format))
+		}
+	}
+
+	bolt, err := bbolt.Open(boltPath, filePerm, &bbolt.Options{
+		ReadOnly: true,
+		Timeout:  boltTimeout,
+	})
+	if err != nil {
+		return report, xerrors.Errorf("failed to open bolt DB: %v", err)
+	}
+
+	defer bolt.Close()
+
+	db := make(map[string]*dpBucket)
+
+	err = bolt.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			bucket := &dpBucket{Kv: make(kv)}
+
+			err := b.ForEach(func(k, v []byte) error {
+				if v == nil && b.Bucket(k) != nil {
+					return xerrors.Errorf("nested bucket %q is not supported", k)
+				}
+
+				// the memory of bbolt is only valid during the transaction
+				bucket.Kv[string(k)] = slices.Clone(v)
+
+				return nil
+			})
+			if err != nil {
+				return xerrors.Errorf("bucket %q: %v", name, err)
+			}
+
+			bucket.updateIndex()
+			db[string(name)] = bucket
+
+			report.Buckets++
+			report.Pairs += len(bucket.Kv)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return TransferReport{}, xerrors.Errorf("failed to read bolt DB: %v", err)
+	}
+
+	tmpl := newDbTemplate(opts)
+
+	keys, err := fileExists(tmpl.fsys, filepath.Join(path, keysFileName))
+	if err != nil {
+		return TransferReport{}, xerrors.Errorf("failed to stat keys: %v", err)
+	}
+
+	fresh, err := NewDB(path, purbIsOn, opts...)
+	if err != nil {
+		discardImport(tmpl, path, purbIsOn, nil, !keys)
+		return TransferReport{}, xerrors.Errorf("failed to create DB: %v", err)
+	}
+
+	err = fresh.(*purbDB).replace(db)
+	if err != nil {
+		fresh.Close()
+		discardImport(tmpl, path, purbIsOn, fresh.(*purbDB).shards, !keys)
+		return TransferReport{}, xerrors.Errorf("failed to write DB: %v", err)
+	}
+
+	err = fresh.Close()
+	if err != nil {
+		return TransferReport{}, xerrors.Errorf("failed to close DB: %v", err)
+	}
+
+	return report, nil
+}
+
+// ExportBolt copies every bucket of the database in the directory at the given
+// path into a new bbolt file that can be opened by dela's kv.DB. The file must
+// not exist, and it is created with the same permissions as the database, as
+// its content is in plaintext. It fails when there is no database to export.
+func ExportBolt(path string, purbIsOn bool, boltPath string, opts ...Option) (TransferReport, error) {
+	var report TransferReport
+
+	exists, err := dbExists(path, purbIsOn, opts)
+	if err != nil {
+		return report, xerrors.Errorf("failed to open DB: %v", err)
+	}
+	if !exists {
+		return report, xerrors.Errorf("failed to open DB: %w: %s", fs.ErrNotExist, dbFileName(purbIsOn))
+	}
+
+	// bbolt initializes an empty file, which makes sure the export never
+	// merges into an existing database nor is readable by others
+	file, err := os.OpenFile(boltPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerm)
+	if err != nil {
+		return report, xerrors.Errorf("failed to create bolt file: %v", err)
+	}
+
+	file.Close()
+
+	src, err := NewDB(path, purbIsOn, opts...)
+	if err != nil {
+		os.Remove(boltPath)
+		return report, xerrors.Errorf("failed to open DB: %w", err)
+	}
+
+	defer src.Close()
+
+	dst, err := delakv.New(boltPath)
+	if err != nil {
+		os.Remove(boltPath)
+		return report, xerrors.Errorf("failed to open bolt DB: %v", err)
+	}
+
+	p := src.(*purbDB)
+
+	p.bucketDb.RLock()
+	defer p.bucketDb.RUnlock()
+
+	err = dst.Update(func(tx delakv.WritableTx) error {
+		return p.forEachBucket(func(name string, b Bucket) error {
+			bucket, err := tx.GetBucketOrCreate([]byte(name))
+			if err != nil {
+				return xerrors.Errorf("failed to create bucket %q: %v", name, err)
+			}
+
+			err = b.ForEach(func(k, v []byte) error {
+				report.Pairs++
+				return bucket.Set(k, v)
+			})
+			if err != nil {
+				return xerrors.Errorf("failed to set key in bucket %q: %v", name, err)
+			}
+
+			report.Buckets++
+
+			return nil
+		})
+	})
+
+	closeErr := dst.Close()
+
+	if err != nil {
+		os.Remove(boltPath)
+		return TransferReport{}, xerrors.Errorf("failed to write bolt DB: %v", err)
+	}
+	if closeErr != nil {
+		return TransferReport{}, xerrors.Errorf("failed to close bolt DB: %v", closeErr)
+	}
+
+	return report, nil
+}
+
+// discardImport removes the files of a database that could not be imported, so
+// that the import can be retried. The keys are removed when the import created
+// them.
+func discardImport(tmpl dbTemplate, path string, purbIsOn bool, m *manifest, keys bool) {
+	store := openStore(tmpl, path)
+	name := dbFileName(purbIsOn)
+
+	names := []string{name}
+	if m != nil {
+		for i, gen := range m.shards {
+			if gen != 0 {
+				names = append(names, shardName(name, i, gen))
+			}
+		}
+	}
+
+	for _, name := range names {
+		err := store.Delete(name)
+		if err != nil {
+			dela.Logger.Warn().Err(err).Msgf("failed to remove %s", name)
+		}
+	}
+
+	if keys {
+		err := tmpl.fsys.Remove(filepath.Join(path, keysFileName))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			dela.Logger.Warn().Err(err).Msg("failed to remove keys")
+		}
+	}
+}
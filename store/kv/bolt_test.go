@@ -0,0 +1,247 @@
+package purbkv
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	delakv "go.dedis.ch/dela/core/store/kv"
+	"go.etcd.io/bbolt"
+	"golang.org/x/xerrors"
+)
+
+func TestBolt_ImportExport(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	boltPath := filepath.Join(dir, "dela.db")
+
+	bolt, err := delakv.New(boltPath)
+	require.NoError(t, err)
+
+	err = bolt.Update(func(tx delakv.WritableTx) error {
+		a, err := tx.GetBucketOrCreate([]byte("A"))
+		require.NoError(t, err)
+		require.NoError(t, a.Set([]byte("ping"), []byte("pong")))
+
+		b, err := tx.GetBucketOrCreate([]byte("B"))
+		require.NoError(t, err)
+		require.NoError(t, b.Set([]byte("3"), []byte("c")))
+		require.NoError(t, b.Set([]byte("1"), []byte("a")))
+		require.NoError(t, b.Set([]byte("2"), []byte("b")))
+
+		_, err = tx.GetBucketOrCreate([]byte("E"))
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, bolt.Close())
+
+	path := filepath.Join(dir, "purb")
+	require.NoError(t, os.Mkdir(path, dirPerm))
+
+	report, err := ImportBolt(boltPath, path, true)
+	require.NoError(t, err)
+	require.Equal(t, TransferReport{Buckets: 3, Pairs: 4}, report)
+
+	// the content is the same as the one of fillProverDB
+	expected := newProverDB(t, false)
+	fillProverDB(t, expected)
+
+	verified, err := Verify(path, true, WithExpectedRoot(expected.(Prover).Root()))
+	require.NoError(t, err)
+	require.True(t, verified.OK(), verified.String())
+
+	_, err = ImportBolt(boltPath, path, false)
+	require.ErrorContains(t, err, "refusing to import into existing")
+
+	exported := filepath.Join(dir, "exported.db")
+
+	report, err = ExportBolt(path, true, exported)
+	require.NoError(t, err)
+	require.Equal(t, TransferReport{Buckets: 3, Pairs: 4}, report)
+
+	info, err := os.Stat(exported)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(filePerm), info.Mode().Perm())
+
+	bolt, err = delakv.New(exported)
+	require.NoError(t, err)
+	defer bolt.Close()
+
+	err = bolt.View(func(tx delakv.ReadableTx) error {
+		var keys []string
+		err := tx.GetBucket([]byte("B")).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", "2", "3"}, keys)
+
+		require.Equal(t, []byte("pong"), tx.GetBucket([]byte("A")).Get([]byte("ping")))
+		require.NotNil(t, tx.GetBucket([]byte("E")))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = ExportBolt(path, true, exported)
+	require.ErrorContains(t, err, "failed to create bolt file")
+}
+
+func TestBolt_ImportNestedBucket(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	boltPath := filepath.Join(dir, "nested.db")
+
+	bolt, err := bbolt.Open(boltPath, filePerm, nil)
+	require.NoError(t, err)
+
+	err = bolt.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("A"))
+		require.NoError(t, err)
+
+		_, err = b.CreateBucket([]byte("nested"))
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, bolt.Close())
+
+	_, err = ImportBolt(boltPath, dir, false)
+	require.ErrorContains(t, err, `nested bucket "nested" is not supported`)
+	require.NoFileExists(t, filepath.Join(dir, kvFileName))
+
+	_, err = ImportBolt(filepath.Join(dir, "missing.db"), dir, false)
+	require.ErrorContains(t, err, "failed to open bolt DB")
+}
+
+func TestBolt_ExportMissingDB(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exported := filepath.Join(dir, "exported.db")
+
+	_, err = ExportBolt(filepath.Join(dir, "missing"), false, exported)
+	require.ErrorContains(t, err, "failed to open DB")
+	require.NoFileExists(t, exported)
+
+	// an empty directory is not mistaken for an empty database
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, os.Mkdir(empty, dirPerm))
+
+	_, err = ExportBolt(empty, false, exported)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.NoFileExists(t, exported)
+	require.NoFileExists(t, filepath.Join(empty, kvFileName))
+}
+
+func TestBolt_ImportIntoStore(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	boltPath := filepath.Join(dir, "dela.db")
+
+	bolt, err := delakv.New(boltPath)
+	require.NoError(t, err)
+
+	err = bolt.Update(func(tx delakv.WritableTx) error {
+		b, err := tx.GetBucketOrCreate([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+
+		return b.Set([]byte("key"), []byte("value"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, bolt.Close())
+
+	store := NewMemoryStore()
+
+	report, err := ImportBolt(boltPath, dir, false, WithBlobStore(store))
+	require.NoError(t, err)
+	require.Equal(t, TransferReport{Buckets: 1, Pairs: 1}, report)
+	require.NoFileExists(t, filepath.Join(dir, kvFileName))
+
+	// the database in the store is found even if the directory is empty
+	_, err = ImportBolt(boltPath, dir, false, WithBlobStore(store))
+	require.ErrorContains(t, err, "refusing to import into existing")
+
+	exported := filepath.Join(dir, "exported.db")
+
+	report, err = ExportBolt(dir, false, exported, WithBlobStore(store))
+	require.NoError(t, err)
+	require.Equal(t, TransferReport{Buckets: 1, Pairs: 1}, report)
+}
+
+func TestBolt_ImportRetry(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithShards(4)}} {
+		dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		boltPath := filepath.Join(os.TempDir(), filepath.Base(dir)+".bolt")
+		defer os.Remove(boltPath)
+
+		bolt, err := delakv.New(boltPath)
+		require.NoError(t, err)
+
+		err = bolt.Update(func(tx delakv.WritableTx) error {
+			b, err := tx.GetBucketOrCreate([]byte("bucket"))
+			if err != nil {
+				return err
+			}
+
+			for i := 0; i < 100; i++ {
+				err = b.Set([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 100))
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, bolt.Close())
+
+		// the empty database is written, but not the imported buckets
+		store := &smallStore{BlobStore: NewFileStore(dir), limit: 4096}
+
+		_, err = ImportBolt(boltPath, dir, true, append(opts, WithBlobStore(store))...)
+		require.ErrorContains(t, err, "failed to write DB")
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+
+		report, err := ImportBolt(boltPath, dir, true, opts...)
+		require.NoError(t, err)
+		require.Equal(t, TransferReport{Buckets: 1, Pairs: 100}, report)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// smallStore is a store that refuses the objects larger than its limit.
+type smallStore struct {
+	BlobStore
+
+	limit int
+}
+
+func (s *smallStore) Put(name string, data []byte) error {
+	if len(data) > s.limit {
+		return xerrors.Errorf("object %s is too large", name)
+	}
+
+	return s.BlobStore.Put(name, data)
+}
@@ -2,24 +2,63 @@ package purbkv
 
 import (
 	"slices"
-	"strings"
+	"sync"
 
 	"golang.org/x/exp/maps"
 	"golang.org/x/xerrors"
 )
 
 type kv map[string][]byte
-type kOrder []string
 
 // dpBucket implements kv.Bucket
 type dpBucket struct {
 	Kv  kv
 	idx kOrder
+
+	// root caches the Merkle root of the bucket, and tree the hashes of all
+	// the nodes of its tree once a key is proven
+	root     []byte
+	tree     *merkleTree
+	rootLock sync.Mutex
+
+	// pending holds the changes of a commit that is being written, on top of
+	// the saved bucket, until the bucket is settled
+	pending *txBucket
+}
+
+// pairs calls the function for every pair of the bucket, in no particular
+// order. A staged bucket is read through its changes.
+func (b *dpBucket) pairs(fn func(k string, v []byte)) {
+	if b.pending == nil {
+		for k, v := range b.Kv {
+			fn(k, v)
+		}
+
+		return
+	}
+
+	for _, k := range b.idx.keys() {
+		v, _ := b.pending.get(k)
+		fn(k, v)
+	}
+}
+
+// settle applies the pending changes of a staged bucket to the saved bucket,
+// whose keys it then shares. The caller must hold the lock of the buckets.
+func (b *dpBucket) settle() {
+	if b.pending == nil {
+		return
+	}
+
+	b.Kv = b.pending.apply().Kv
+	b.pending = nil
 }
 
 func (b *dpBucket) updateIndex() {
-	b.idx = maps.Keys(b.Kv)
-	slices.Sort(b.idx)
+	keys := maps.Keys(b.Kv)
+	slices.Sort(keys)
+
+	b.idx = newOrder(keys)
 }
 
 // Get implements kv.Bucket. It returns the value associated to the key, or nil
@@ -32,49 +71,66 @@ func (b *dpBucket) Get(key []byte) ([]byte, error) {
 	return nil, xerrors.Errorf("failed to find key %v in bucket", string(key))
 }
 
-// Set implements kv.Bucket. It sets the provided key to the value.
+// Set implements kv.Bucket. It sets the provided key to a copy of the value.
 func (t *dpBucket) Set(key, value []byte) error {
 	if _, found := t.Kv[string(key)]; !found {
-		t.idx = append(t.idx, string(key))
-		slices.Sort(t.idx)
+		t.idx.insert(string(key))
 	}
 
-	t.Kv[string(key)] = value
+	t.Kv[string(key)] = slices.Clone(value)
+	t.root = nil
+	t.tree = nil
 
 	return nil
 }
 
 // Delete implements kv.Bucket. It deletes the key from the bucket.
 func (b *dpBucket) Delete(key []byte) error {
+	if _, found := b.Kv[string(key)]; !found {
+		return nil
+	}
+
 	delete(b.Kv, string(key))
+	b.idx.remove(string(key))
+
+	b.root = nil
+	b.tree = nil
+
 	return nil
 }
 
-// ForEach implements kv.Bucket. It iterates over the whole bucket in an
-// unspecified order. If the callback returns an error, the iteration is stopped
-// and the error returned to the caller.
+// ForEach implements kv.Bucket. It iterates over the whole bucket in the order
+// of the keys. The keys are those of the bucket when the iteration starts, less
+// the ones the callback deletes. If the callback returns an error, the
+// iteration is stopped and the error returned to the caller.
 func (b *dpBucket) ForEach(fn func(k, v []byte) error) error {
-	for _, k := range b.idx {
-		err := fn([]byte(k), b.Kv[k])
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return b.iterate(b.idx.keys(), fn)
 }
 
 // Scan implements kv.Bucket. It iterates over the keys matching the prefix in a
-// sorted order. If the callback returns an error, the iteration is stopped and
-// the error returned to the caller.
+// sorted order. The keys are those of the bucket when the iteration starts,
+// less the ones the callback deletes. If the callback returns an error, the
+// iteration is stopped and the error returned to the caller.
 func (b *dpBucket) Scan(prefix []byte, fn func(k, v []byte) error) error {
-	for _, k := range b.idx {
-		if !strings.HasPrefix(k, string(prefix)) {
+	return b.iterate(b.idx.prefixed(string(prefix)), fn)
+}
+
+// iterate calls the function for the keys that are still in the bucket, as the
+// function may modify it.
+func (b *dpBucket) iterate(keys []string, fn func(k, v []byte) error) error {
+	for _, k := range keys {
+		v, found := b.Kv[k]
+		if !found {
 			continue
 		}
-		err := fn([]byte(k), b.Kv[k])
+
+		// the error of the callback is returned as is so that the caller can
+		// compare it
+		err := fn([]byte(k), v)
 		if err != nil {
-			return xerrors.Errorf("failed to scan bucket: %v", err)
+			return err
 		}
 	}
+
 	return nil
 }
@@ -0,0 +1,82 @@
+package purbkv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket_ScanDelete(t *testing.T) {
+	b := newFilledBucket(t, 1000)
+
+	count := 0
+
+	err := b.Scan([]byte("key"), func(k, v []byte) error {
+		count++
+		return b.Delete(k)
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 1000, count)
+	require.Empty(t, b.Kv)
+	require.Zero(t, b.idx.len())
+}
+
+func TestBucket_ForEachDelete(t *testing.T) {
+	b := newFilledBucket(t, 1000)
+
+	var visited []string
+
+	// the callback deletes the key that follows the current one
+	err := b.ForEach(func(k, v []byte) error {
+		visited = append(visited, string(k))
+
+		var i int
+		_, err := fmt.Sscanf(string(k), "key%04d", &i)
+		if err != nil {
+			return err
+		}
+
+		return b.Delete([]byte(fmt.Sprintf("key%04d", i+1)))
+	})
+	require.NoError(t, err)
+
+	require.Len(t, visited, 500)
+	require.Len(t, b.Kv, 500)
+
+	for i, k := range visited {
+		require.Equal(t, fmt.Sprintf("key%04d", 2*i), k)
+	}
+}
+
+func TestBucket_ScanSet(t *testing.T) {
+	b := newFilledBucket(t, 100)
+
+	count := 0
+
+	// the keys set by the callback are not part of the iteration
+	err := b.Scan([]byte("key"), func(k, v []byte) error {
+		count++
+		return b.Set(append(k, '+'), v)
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 100, count)
+	require.Len(t, b.Kv, 200)
+	require.Equal(t, 200, b.idx.len())
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func newFilledBucket(t *testing.T, n int) *dpBucket {
+	b := &dpBucket{Kv: make(kv)}
+
+	for i := 0; i < n; i++ {
+		err := b.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i)))
+		require.NoError(t, err)
+	}
+
+	return b
+}
@@ -0,0 +1,119 @@
+package command
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"go.dedis.ch/dela/cli"
+	"go.dedis.ch/purb-db/store/kv"
+	"golang.org/x/xerrors"
+)
+
+// action defines the different cli actions of the database commands. Defining
+// functions and printer helps in testing the commands.
+type action struct {
+	printer io.Writer
+
+	verify  func(path string, purbIsOn bool, opts ...purbkv.Option) (purbkv.Report, error)
+	repair  func(path, output string, opts ...purbkv.Option) (purbkv.RepairReport, error)
+	migrate func(path string, purbIsOn bool, opts ...purbkv.Option) error
+
+	importBolt func(boltPath, path string, purbIsOn bool, opts ...purbkv.Option) (purbkv.TransferReport, error)
+	exportBolt func(path string, purbIsOn bool, boltPath string, opts ...purbkv.Option) (purbkv.TransferReport, error)
+
+	fixPermissions func(path string) error
+}
+
+func (a action) verifyAction(flags cli.Flags) error {
+	var opts []purbkv.Option
+	if flags.Bool("simplified") {
+		opts = append(opts, purbkv.WithBlobOptions(purbkv.WithSimplifiedEntryPoints()))
+	}
+
+	if flags.String("root") != "" {
+		root, err := hex.DecodeString(flags.String("root"))
+		if err != nil {
+			return xerrors.Errorf("failed to decode root: %v", err)
+		}
+
+		opts = append(opts, purbkv.WithExpectedRoot(root))
+	}
+
+	report, err := a.verify(flags.Path("path"), flags.Bool("purb"), opts...)
+	if err != nil {
+		return xerrors.Errorf("failed to verify: %v", err)
+	}
+
+	fmt.Fprintln(a.printer, report)
+
+	if !report.OK() {
+		return xerrors.Errorf("found %d problem(s)", len(report.Problems))
+	}
+
+	return nil
+}
+
+func (a action) repairAction(flags cli.Flags) error {
+	report, err := a.repair(flags.Path("path"), flags.Path("out"))
+	if err != nil {
+		return xerrors.Errorf("failed to repair: %v", err)
+	}
+
+	fmt.Fprintln(a.printer, report)
+
+	return nil
+}
+
+func (a action) migrateAction(flags cli.Flags) error {
+	var opts []purbkv.Option
+	if flags.Bool("simplified") {
+		opts = append(opts, purbkv.WithBlobOptions(purbkv.WithSimplifiedEntryPoints()))
+	}
+
+	err := a.migrate(flags.Path("path"), flags.Bool("purb"), opts...)
+	if err != nil {
+		return xerrors.Errorf("failed to migrate: %v", err)
+	}
+
+	if flags.Bool("purb") {
+		fmt.Fprintln(a.printer, "database converted to purb.db")
+	} else {
+		fmt.Fprintln(a.printer, "database converted to kv.db")
+	}
+
+	return nil
+}
+
+func (a action) importAction(flags cli.Flags) error {
+	report, err := a.importBolt(flags.Path("bolt"), flags.Path("path"), flags.Bool("purb"))
+	if err != nil {
+		return xerrors.Errorf("failed to import: %v", err)
+	}
+
+	fmt.Fprintf(a.printer, "imported %d bucket(s) and %d pair(s)\n", report.Buckets, report.Pairs)
+
+	return nil
+}
+
+func (a action) exportAction(flags cli.Flags) error {
+	report, err := a.exportBolt(flags.Path("path"), flags.Bool("purb"), flags.Path("bolt"))
+	if err != nil {
+		return xerrors.Errorf("failed to export: %v", err)
+	}
+
+	fmt.Fprintf(a.printer, "exported %d bucket(s) and %d pair(s)\n", report.Buckets, report.Pairs)
+
+	return nil
+}
+
+func (a action) permissionsAction(flags cli.Flags) error {
+	err := a.fixPermissions(flags.Path("path"))
+	if err != nil {
+		return xerrors.Errorf("failed to fix permissions: %v", err)
+	}
+
+	fmt.Fprintln(a.printer, "permissions restricted to the owner")
+
+	return nil
+}
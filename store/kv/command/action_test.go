@@ -0,0 +1,182 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/dela/cli/node"
+	"go.dedis.ch/dela/testing/fake"
+	"go.dedis.ch/purb-db/store/kv"
+)
+
+func TestVerifyAction(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "purbkv-command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := purbkv.NewDB(dir, true)
+	require.NoError(t, err)
+	root := db.(purbkv.Prover).Root()
+	require.NoError(t, db.Close())
+
+	buf := new(bytes.Buffer)
+	action := action{
+		printer: buf,
+		verify:  purbkv.Verify,
+	}
+
+	set := node.FlagSet{"path": dir, "purb": true, "root": fmt.Sprintf("%x", root)}
+	err = action.verifyAction(set)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "status: ok")
+
+	set["root"] = "00"
+	err = action.verifyAction(set)
+	require.EqualError(t, err, "found 1 problem(s)")
+
+	set["root"] = "zz"
+	err = action.verifyAction(set)
+	require.ErrorContains(t, err, "failed to decode root")
+
+	set["root"] = ""
+	set["purb"] = false
+	err = action.verifyAction(set)
+	require.ErrorContains(t, err, "failed to verify")
+}
+
+func TestVerifyAction_Error(t *testing.T) {
+	action := action{
+		printer: io.Discard,
+		verify:  badVerify,
+	}
+
+	err := action.verifyAction(node.FlagSet{})
+	require.EqualError(t, err, fake.Err("failed to verify"))
+}
+
+func TestRepairAction(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "purbkv-command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := purbkv.NewDB(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	buf := new(bytes.Buffer)
+	action := action{
+		printer: buf,
+		repair:  purbkv.Repair,
+	}
+
+	out := filepath.Join(dir, "repaired")
+
+	err = action.repairAction(node.FlagSet{"path": dir, "out": out})
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "problems: 0")
+
+	err = action.repairAction(node.FlagSet{"path": dir, "out": out})
+	require.ErrorContains(t, err, "failed to repair")
+}
+
+func TestMigrateAction(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "purbkv-command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := purbkv.NewDB(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	buf := new(bytes.Buffer)
+	action := action{
+		printer: buf,
+		migrate: purbkv.Migrate,
+	}
+
+	err = action.migrateAction(node.FlagSet{"path": dir, "purb": true, "simplified": true})
+	require.NoError(t, err)
+	require.Equal(t, "database converted to purb.db\n", buf.String())
+
+	err = action.migrateAction(node.FlagSet{"path": dir, "purb": true})
+	require.ErrorContains(t, err, "failed to migrate")
+
+	buf.Reset()
+	err = action.migrateAction(node.FlagSet{"path": dir, "simplified": true})
+	require.NoError(t, err)
+	require.Equal(t, "database converted to kv.db\n", buf.String())
+}
+
+func TestImportExportAction(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "purbkv-command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := purbkv.NewDB(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	buf := new(bytes.Buffer)
+	action := action{
+		printer:    buf,
+		importBolt: purbkv.ImportBolt,
+		exportBolt: purbkv.ExportBolt,
+	}
+
+	bolt := filepath.Join(dir, "dela.db")
+
+	err = action.exportAction(node.FlagSet{"path": dir, "bolt": bolt})
+	require.NoError(t, err)
+	require.Equal(t, "exported 0 bucket(s) and 0 pair(s)\n", buf.String())
+
+	err = action.exportAction(node.FlagSet{"path": dir, "bolt": bolt})
+	require.ErrorContains(t, err, "failed to export")
+
+	buf.Reset()
+	imported := filepath.Join(dir, "imported")
+	require.NoError(t, os.Mkdir(imported, 0700))
+
+	err = action.importAction(node.FlagSet{"bolt": bolt, "path": imported, "purb": true})
+	require.NoError(t, err)
+	require.Equal(t, "imported 0 bucket(s) and 0 pair(s)\n", buf.String())
+
+	err = action.importAction(node.FlagSet{"bolt": bolt, "path": imported})
+	require.ErrorContains(t, err, "failed to import")
+}
+
+func TestPermissionsAction(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "purbkv-command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Chmod(dir, 0755))
+
+	buf := new(bytes.Buffer)
+	action := action{
+		printer:        buf,
+		fixPermissions: purbkv.FixPermissions,
+	}
+
+	err = action.permissionsAction(node.FlagSet{"path": dir})
+	require.NoError(t, err)
+	require.Equal(t, "permissions restricted to the owner\n", buf.String())
+
+	db, err := purbkv.NewDB(dir, true, purbkv.WithPermissionPolicy(purbkv.PermissionsEnforce))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	err = action.permissionsAction(node.FlagSet{"path": filepath.Join(dir, "missing")})
+	require.ErrorContains(t, err, "failed to fix permissions")
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func badVerify(string, bool, ...purbkv.Option) (purbkv.Report, error) {
+	return purbkv.Report{}, fake.GetError()
+}
@@ -0,0 +1,131 @@
+// Package command defines cli commands to maintain a key/value database
+// offline.
+package command
+
+import (
+	"os"
+
+	"go.dedis.ch/dela/cli"
+	"go.dedis.ch/purb-db/store/kv"
+)
+
+// Initializer implements the database initializer for the purbkv CLI.
+//
+// - implements cli.Initializer
+type Initializer struct {
+}
+
+// SetCommands implements cli.Initializer.
+func (i Initializer) SetCommands(provider cli.Provider) {
+	action := action{
+		printer: os.Stdout,
+
+		verify:     purbkv.Verify,
+		repair:     purbkv.Repair,
+		migrate:    purbkv.Migrate,
+		importBolt: purbkv.ImportBolt,
+		exportBolt: purbkv.ExportBolt,
+
+		fixPermissions: purbkv.FixPermissions,
+	}
+
+	cmd := provider.SetCommand("db")
+	cmd.SetDescription("maintain a database without starting a node")
+
+	verify := cmd.SetSubCommand("verify")
+	verify.SetDescription("check the integrity of a database and print a report")
+	verify.SetFlags(cli.StringFlag{
+		Name:     "path",
+		Usage:    "path to the directory of the database",
+		Required: true,
+	}, cli.BoolFlag{
+		Name:     "purb",
+		Usage:    "verify purb.db instead of kv.db",
+		Required: false,
+	}, cli.BoolFlag{
+		Name:     "simplified",
+		Usage:    "the PURB uses simplified entry points",
+		Required: false,
+	}, cli.StringFlag{
+		Name:     "root",
+		Usage:    "if provided, the expected Merkle root in hexadecimal",
+		Required: false,
+	})
+	verify.SetAction(action.verifyAction)
+
+	repair := cmd.SetSubCommand("repair")
+	repair.SetDescription("recover what can be read of a damaged plaintext database " +
+		"into a fresh one")
+	repair.SetFlags(cli.StringFlag{
+		Name:     "path",
+		Usage:    "path to the directory of the damaged database",
+		Required: true,
+	}, cli.StringFlag{
+		Name:     "out",
+		Usage:    "path to the directory of the fresh database",
+		Required: true,
+	})
+	repair.SetAction(action.repairAction)
+
+	migrate := cmd.SetSubCommand("migrate")
+	migrate.SetDescription("convert a database between kv.db and purb.db, the node " +
+		"must be stopped")
+	migrate.SetFlags(cli.StringFlag{
+		Name:     "path",
+		Usage:    "path to the directory of the database",
+		Required: true,
+	}, cli.BoolFlag{
+		Name:     "purb",
+		Usage:    "convert kv.db to purb.db, otherwise convert purb.db to kv.db",
+		Required: false,
+	}, cli.BoolFlag{
+		Name:     "simplified",
+		Usage:    "the PURB uses simplified entry points",
+		Required: false,
+	})
+	migrate.SetAction(action.migrateAction)
+
+	importBolt := cmd.SetSubCommand("import")
+	importBolt.SetDescription("copy a bbolt database of dela into a fresh database")
+	importBolt.SetFlags(cli.StringFlag{
+		Name:     "bolt",
+		Usage:    "path to the bbolt file, which must not be in use",
+		Required: true,
+	}, cli.StringFlag{
+		Name:     "path",
+		Usage:    "path to the directory of the fresh database",
+		Required: true,
+	}, cli.BoolFlag{
+		Name:     "purb",
+		Usage:    "create purb.db instead of kv.db",
+		Required: false,
+	})
+	importBolt.SetAction(action.importAction)
+
+	exportBolt := cmd.SetSubCommand("export")
+	exportBolt.SetDescription("copy a database into a new bbolt database of dela")
+	exportBolt.SetFlags(cli.StringFlag{
+		Name:     "path",
+		Usage:    "path to the directory of the database",
+		Required: true,
+	}, cli.BoolFlag{
+		Name:     "purb",
+		Usage:    "export purb.db instead of kv.db",
+		Required: false,
+	}, cli.StringFlag{
+		Name:     "bolt",
+		Usage:    "path to the bbolt file to create",
+		Required: true,
+	})
+	exportBolt.SetAction(action.exportAction)
+
+	permissions := cmd.SetSubCommand("permissions")
+	permissions.SetDescription("restrict the access to a database and its keys to the " +
+		"owner, as required by the enforce policy")
+	permissions.SetFlags(cli.StringFlag{
+		Name:     "path",
+		Usage:    "path to the directory of the database",
+		Required: true,
+	})
+	permissions.SetAction(action.permissionsAction)
+}
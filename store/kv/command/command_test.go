@@ -0,0 +1,59 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/dela/cli"
+	"go.dedis.ch/dela/testing/fake"
+)
+
+func TestSetCommands(t *testing.T) {
+	init := Initializer{}
+
+	call := &fake.Call{}
+	provider := fakeBuilder{call: call}
+	init.SetCommands(provider)
+
+	require.Equal(t, 26, call.Len())
+	require.Equal(t, "db", call.Get(0, 0))
+	require.Equal(t, "verify", call.Get(2, 0))
+	require.Equal(t, "repair", call.Get(6, 0))
+	require.Equal(t, "migrate", call.Get(10, 0))
+	require.Equal(t, "import", call.Get(14, 0))
+	require.Equal(t, "export", call.Get(18, 0))
+	require.Equal(t, "permissions", call.Get(22, 0))
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+type fakeCommandBuilder struct {
+	call *fake.Call
+}
+
+func (b fakeCommandBuilder) SetSubCommand(name string) cli.CommandBuilder {
+	b.call.Add(name)
+	return b
+}
+
+func (b fakeCommandBuilder) SetDescription(value string) {
+	b.call.Add(value)
+}
+
+func (b fakeCommandBuilder) SetFlags(flags ...cli.Flag) {
+	b.call.Add(flags)
+}
+
+func (b fakeCommandBuilder) SetAction(a cli.Action) {
+	b.call.Add(a)
+}
+
+type fakeBuilder struct {
+	call *fake.Call
+}
+
+func (b fakeBuilder) SetCommand(name string) cli.CommandBuilder {
+	b.call.Add(name)
+	return fakeCommandBuilder(b)
+}
@@ -0,0 +1,98 @@
+package purbkv_test
+
+import (
+	"testing"
+	"time"
+
+	"go.dedis.ch/purb-db/store/kv"
+	"go.dedis.ch/purb-db/store/kv/kvtest"
+)
+
+func TestConformance_Plaintext(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, false)
+	})
+}
+
+func TestConformance_Purb(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, true)
+	})
+}
+
+func TestConformance_Sharded(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, false, purbkv.WithShards(4))
+	})
+}
+
+func TestConformance_ShardedPurb(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, true, purbkv.WithShards(4))
+	})
+}
+
+func TestConformance_Lazy(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, true, purbkv.WithShards(4), purbkv.WithMemoryBudget(1))
+	})
+}
+
+func TestConformance_LazyScheduledWrites(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, false, purbkv.WithShards(4), purbkv.WithLazyLoading(),
+			purbkv.WithScheduledWrites(time.Hour))
+	})
+}
+
+func TestConformance_Paged(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, false, purbkv.WithShards(4), purbkv.WithPaging(16),
+			purbkv.WithMemoryBudget(1))
+	})
+}
+
+func TestConformance_PagedScheduledWrites(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, false, purbkv.WithShards(4), purbkv.WithPaging(16),
+			purbkv.WithScheduledWrites(time.Hour))
+	})
+}
+
+func TestConformance_ScheduledWrites(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, false, purbkv.WithScheduledWrites(time.Hour))
+	})
+}
+
+func TestConformance_ManualDurability(t *testing.T) {
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		return purbkv.NewDB(dir, true, purbkv.WithDurability(purbkv.DurabilityManual))
+	})
+}
+
+func TestConformance_Memory(t *testing.T) {
+	kvtest.Run(t, func(string) (purbkv.DB, error) {
+		return purbkv.NewMemoryDB(false)
+	}, kvtest.WithoutPersistence())
+}
+
+func TestConformance_MemoryPurb(t *testing.T) {
+	kvtest.Run(t, func(string) (purbkv.DB, error) {
+		return purbkv.NewMemoryDB(true)
+	}, kvtest.WithoutPersistence())
+}
+
+func TestConformance_MemoryStore(t *testing.T) {
+	stores := make(map[string]purbkv.BlobStore)
+
+	kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+		store, found := stores[dir]
+		if !found {
+			store = purbkv.NewMemoryStore()
+			stores[dir] = store
+		}
+
+		return purbkv.NewDB(dir, true, purbkv.WithBlobStore(store))
+	})
+}
@@ -15,40 +15,107 @@ import (
 // - implements node.Initializer
 type minimalController struct {
 	purbIsOn bool
+	inMemory bool
+
+	permissions purbkv.PermissionPolicy
+	// fixPermissions tightens the permissions before the database is opened
+	fixPermissions bool
+}
+
+// Option is the type of option to set some fields of the controller.
+type Option func(*minimalController)
+
+// WithMemoryDB is an option to inject a database that only lives in memory
+// instead of a file in the config path, for ephemeral nodes such as the ones
+// of test networks. Its content is lost when the node stops.
+func WithMemoryDB() Option {
+	return func(m *minimalController) {
+		m.inMemory = true
+	}
+}
+
+// WithPermissionPolicy is an option to choose what happens when the database
+// in the config path can be accessed by someone else than the owner. The
+// default is purbkv.PermissionsWarn.
+func WithPermissionPolicy(policy purbkv.PermissionPolicy) Option {
+	return func(m *minimalController) {
+		m.permissions = policy
+	}
+}
+
+// WithFixedPermissions is an option to tighten the permissions of the database
+// in the config path with purbkv.FixPermissions when the node starts, so that
+// the databases created by earlier versions can be used with
+// purbkv.PermissionsEnforce.
+func WithFixedPermissions() Option {
+	return func(m *minimalController) {
+		m.fixPermissions = true
+	}
 }
 
 // NewController returns a minimal controller
 // that will inject a key/value database.
-func NewController() node.Initializer {
-	return minimalController{
-		purbIsOn: true,
-	}
+func NewController(opts ...Option) node.Initializer {
+	return newController(true, opts)
 }
 
 // NewControllerWithoutPurb returns a minimal controller without PURB
 // that will inject a key/value database.
-func NewControllerWithoutPurb() node.Initializer {
-	return minimalController{
-		purbIsOn: false,
+func NewControllerWithoutPurb(opts ...Option) node.Initializer {
+	return newController(false, opts)
+}
+
+func newController(purbIsOn bool, opts []Option) minimalController {
+	m := minimalController{
+		purbIsOn:    purbIsOn,
+		permissions: purbkv.PermissionsWarn,
+	}
+
+	for _, opt := range opts {
+		opt(&m)
 	}
+
+	return m
 }
 
 // SetCommands implements node.Initializer. It does not register any command.
 func (m minimalController) SetCommands(builder node.Builder) {}
 
 // OnStart implements node.Initializer. It opens the database in a file using
-// the config path as the base.
+// the config path as the base, or in memory. The database is injected both as
+// a purbkv.DB and as a kv.DB of dela so that dela services can resolve it.
 func (m minimalController) OnStart(flags cli.Flags, inj node.Injector) error {
-	db, err := purbkv.NewDB(flags.String("config"), m.purbIsOn)
+	var db purbkv.DB
+	var err error
+
+	if m.inMemory {
+		db, err = purbkv.NewMemoryDB(m.purbIsOn)
+	} else {
+		db, err = m.openDB(flags.String("config"))
+	}
 	if err != nil {
 		return xerrors.Errorf("db: %v", err)
 	}
 
 	inj.Inject(db)
+	inj.Inject(purbkv.NewDelaDB(db))
 
 	return nil
 }
 
+// openDB opens the database in the directory after its permissions are fixed
+// if the controller is asked to.
+func (m minimalController) openDB(path string) (purbkv.DB, error) {
+	if m.fixPermissions {
+		err := purbkv.FixPermissions(path)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to fix permissions: %v", err)
+		}
+	}
+
+	return purbkv.NewDB(path, m.purbIsOn, purbkv.WithPermissionPolicy(m.permissions))
+}
+
 // OnStop implements node.Initializer. It closes the database.
 func (m minimalController) OnStop(inj node.Injector) error {
 	var db purbkv.DB
@@ -1,23 +1,34 @@
 package controller
 
 import (
+	"os"
+	"testing"
+
 	"github.com/stretchr/testify/require"
 	"go.dedis.ch/dela/cli/node"
-	"testing"
+	"go.dedis.ch/dela/core/store/kv"
+	"go.dedis.ch/purb-db/store/kv"
 )
 
 func TestNewController(t *testing.T) {
 	c := NewController()
 	require.NotNil(t, c)
 
-	require.Equal(t, minimalController{true}, c)
+	require.Equal(t, minimalController{purbIsOn: true, permissions: purbkv.PermissionsWarn}, c)
+
+	c = NewController(WithMemoryDB())
+	require.Equal(t, minimalController{
+		purbIsOn:    true,
+		inMemory:    true,
+		permissions: purbkv.PermissionsWarn,
+	}, c)
 }
 
 func TestNewControllerWithoutPurb(t *testing.T) {
 	c := NewControllerWithoutPurb()
 	require.NotNil(t, c)
 
-	require.Equal(t, minimalController{false}, c)
+	require.Equal(t, minimalController{purbIsOn: false, permissions: purbkv.PermissionsWarn}, c)
 }
 
 func TestOnStart(t *testing.T) {
@@ -27,6 +38,80 @@ func TestOnStart(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestOnStart_Inject(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "controller")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := NewController()
+	inj := node.NewInjector()
+
+	err = c.OnStart(node.FlagSet{"config": dir}, inj)
+	require.NoError(t, err)
+
+	var db purbkv.DB
+	require.NoError(t, inj.Resolve(&db))
+
+	var delaDB kv.DB
+	require.NoError(t, inj.Resolve(&delaDB))
+
+	require.NoError(t, c.OnStop(inj))
+}
+
+func TestOnStart_Permissions(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "controller")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the mode of the directories of earlier versions
+	require.NoError(t, os.Chmod(dir, 0755))
+
+	c := NewController(WithPermissionPolicy(purbkv.PermissionsEnforce))
+
+	err = c.OnStart(node.FlagSet{"config": dir}, node.NewInjector())
+	require.ErrorContains(t, err, "expected no access for group and others")
+
+	c = NewController(WithPermissionPolicy(purbkv.PermissionsEnforce), WithFixedPermissions())
+	inj := node.NewInjector()
+
+	err = c.OnStart(node.FlagSet{"config": dir}, inj)
+	require.NoError(t, err)
+	require.NoError(t, c.OnStop(inj))
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestOnStart_Memory(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "controller")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := NewController(WithMemoryDB())
+	inj := node.NewInjector()
+
+	err = c.OnStart(node.FlagSet{"config": dir}, inj)
+	require.NoError(t, err)
+
+	var delaDB kv.DB
+	require.NoError(t, inj.Resolve(&delaDB))
+
+	err = delaDB.Update(func(tx kv.WritableTx) error {
+		b, err := tx.GetBucketOrCreate([]byte("bucket"))
+		require.NoError(t, err)
+
+		return b.Set([]byte("ping"), []byte("pong"))
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, c.OnStop(inj))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
 func TestOnStop(t *testing.T) {
 	c := NewController()
 
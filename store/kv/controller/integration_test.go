@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/dela/cli/node"
+	"go.dedis.ch/dela/core/access/darc"
+	"go.dedis.ch/dela/core/execution"
+	"go.dedis.ch/dela/core/execution/native"
+	"go.dedis.ch/dela/core/ordering"
+	"go.dedis.ch/dela/core/ordering/cosipbft"
+	"go.dedis.ch/dela/core/ordering/cosipbft/authority"
+	"go.dedis.ch/dela/core/store"
+	"go.dedis.ch/dela/core/store/hashtree"
+	"go.dedis.ch/dela/core/store/hashtree/binprefix"
+	"go.dedis.ch/dela/core/store/kv"
+	"go.dedis.ch/dela/core/txn"
+	poolgossip "go.dedis.ch/dela/core/txn/pool/gossip"
+	"go.dedis.ch/dela/core/txn/signed"
+	"go.dedis.ch/dela/core/validation/simple"
+	"go.dedis.ch/dela/cosi/threshold"
+	"go.dedis.ch/dela/crypto"
+	"go.dedis.ch/dela/crypto/bls"
+	"go.dedis.ch/dela/mino"
+	"go.dedis.ch/dela/mino/gossip"
+	"go.dedis.ch/dela/mino/minoch"
+	"go.dedis.ch/dela/serde/json"
+	"go.dedis.ch/purb-db/store/kv"
+)
+
+// TestIntegration_Ordering runs a small chain of dela nodes whose databases are
+// injected by the controller, and checks that the state written by the
+// ordering service survives a restart.
+func TestIntegration_Ordering(t *testing.T) {
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+
+	nodes, ro := makeNodes(t, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := nodes[0].service.Setup(ctx, ro)
+	require.NoError(t, err)
+
+	events := nodes[1].service.Watch(ctx)
+
+	for i := uint64(0); i < 3; i++ {
+		err = nodes[0].pool.Add(makeTx(t, i, nodes[0].signer))
+		require.NoError(t, err)
+
+		evt := waitEvent(t, events, 10*cosipbft.DefaultRoundTimeout)
+		require.Equal(t, i, evt.Index)
+	}
+
+	root := nodes[1].service.GetStore().(hashtree.Tree).GetRoot()
+
+	for _, n := range nodes {
+		require.NoError(t, n.service.Close())
+		require.NoError(t, n.ctrl.OnStop(n.inj))
+	}
+
+	db, err := purbkv.NewDB(nodes[1].dir, true)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tree := binprefix.NewMerkleTree(purbkv.NewDelaDB(db), binprefix.Nonce{})
+	require.NoError(t, tree.Load())
+	require.Equal(t, root, tree.GetRoot())
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+const testContractName = "purbkv"
+
+type testNode struct {
+	ctrl    node.Initializer
+	inj     node.Injector
+	dir     string
+	service *cosipbft.Service
+	pool    *poolgossip.Pool
+	signer  crypto.Signer
+}
+
+type testExec struct{}
+
+func (e testExec) Execute(snap store.Snapshot, step execution.Step) error {
+	return snap.Set(step.Current.GetID(), []byte("done"))
+}
+
+func (e testExec) UID() string {
+	return "PKVT"
+}
+
+// makeNodes creates the nodes of a chain on top of databases injected by the
+// controller, in the same way dela components resolve them.
+func makeNodes(t *testing.T, n int) ([]testNode, authority.Authority) {
+	manager := minoch.NewManager()
+
+	addrs := make([]mino.Address, n)
+	pubkeys := make([]crypto.PublicKey, n)
+	nodes := make([]testNode, n)
+
+	for i := 0; i < n; i++ {
+		m := minoch.MustCreate(manager, fmt.Sprintf("node%d", i))
+
+		addrs[i] = m.GetAddress()
+
+		signer := bls.NewSigner()
+		pubkeys[i] = signer.GetPublicKey()
+
+		c := threshold.NewThreshold(m, signer)
+		c.SetThreshold(threshold.ByzantineThreshold)
+
+		dir, err := os.MkdirTemp(os.TempDir(), "controller")
+		require.NoError(t, err)
+
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		ctrl := NewController()
+		inj := node.NewInjector()
+
+		err = ctrl.OnStart(node.FlagSet{"config": dir}, inj)
+		require.NoError(t, err)
+
+		var db kv.DB
+		require.NoError(t, inj.Resolve(&db))
+
+		txFac := signed.NewTransactionFactory()
+
+		p, err := poolgossip.NewPool(gossip.NewFlat(m, txFac))
+		require.NoError(t, err)
+
+		exec := native.NewExecution()
+		exec.Set(testContractName, testExec{})
+
+		accessSrvc := darc.NewService(json.NewContext())
+
+		rosterFac := authority.NewFactory(m.GetAddressFactory(), c.GetPublicKeyFactory())
+		cosipbft.RegisterRosterContract(exec, rosterFac, accessSrvc)
+
+		param := cosipbft.ServiceParam{
+			Mino:       m,
+			Cosi:       c,
+			Validation: simple.NewService(exec, txFac),
+			Access:     accessSrvc,
+			Pool:       p,
+			Tree:       binprefix.NewMerkleTree(db, binprefix.Nonce{}),
+			DB:         db,
+		}
+
+		srv, err := cosipbft.NewService(param)
+		require.NoError(t, err)
+
+		nodes[i] = testNode{
+			ctrl:    ctrl,
+			inj:     inj,
+			dir:     dir,
+			service: srv,
+			pool:    p,
+			signer:  c.GetSigner(),
+		}
+	}
+
+	return nodes, authority.New(addrs, pubkeys)
+}
+
+func makeTx(t *testing.T, nonce uint64, signer crypto.Signer) txn.Transaction {
+	tx, err := signed.NewTransaction(nonce, signer.GetPublicKey(),
+		signed.WithArg(native.ContractArg, []byte(testContractName)))
+	require.NoError(t, err)
+
+	require.NoError(t, tx.Sign(signer))
+
+	return tx
+}
+
+func waitEvent(t *testing.T, events <-chan ordering.Event, timeout time.Duration) ordering.Event {
+	select {
+	case <-time.After(timeout):
+		t.Fatal("no event received before the timeout")
+		return ordering.Event{}
+	case evt := <-events:
+		return evt
+	}
+}
@@ -0,0 +1,294 @@
+package purbkv_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/purb-db/store/kv"
+	"go.dedis.ch/purb-db/store/kv/faultfs"
+)
+
+const crashTestDir = "purbkv-crash"
+
+var crashBucket = []byte("bucket")
+
+// crashScenario is an operation that is interrupted at every step, after which
+// the database must open in one of the expected states.
+type crashScenario struct {
+	// prepare creates the state of the database before the operation
+	prepare func(t *testing.T, dir string)
+	// run runs the operation on the file system
+	run func(dir string, fsys purbkv.FileSystem) error
+	// reopen opens the database after the operation
+	reopen func(dir string) (purbkv.DB, error)
+	// states are the keys the database may contain after the operation
+	states [][]string
+}
+
+func TestCrash_Create(t *testing.T) {
+	for _, purbIsOn := range []bool{false, true} {
+		runCrashes(t, crashScenario{
+			prepare: func(*testing.T, string) {},
+			run: func(dir string, fsys purbkv.FileSystem) error {
+				return setKeys(dir, purbIsOn, fsys, "a")
+			},
+			reopen: func(dir string) (purbkv.DB, error) {
+				return purbkv.NewDB(dir, purbIsOn)
+			},
+			states: [][]string{nil, {"a"}},
+		})
+	}
+}
+
+func TestCrash_Update(t *testing.T) {
+	for _, purbIsOn := range []bool{false, true} {
+		runCrashes(t, crashScenario{
+			prepare: func(t *testing.T, dir string) {
+				require.NoError(t, setKeys(dir, purbIsOn, purbkv.NewOSFileSystem(), "a"))
+			},
+			run: func(dir string, fsys purbkv.FileSystem) error {
+				return setKeys(dir, purbIsOn, fsys, "b", "c")
+			},
+			reopen: func(dir string) (purbkv.DB, error) {
+				return purbkv.NewDB(dir, purbIsOn)
+			},
+			states: [][]string{{"a"}, {"a", "b", "c"}},
+		})
+	}
+}
+
+func TestCrash_Sharded(t *testing.T) {
+	for _, purbIsOn := range []bool{false, true} {
+		runCrashes(t, crashScenario{
+			prepare: func(t *testing.T, dir string) {
+				db, err := purbkv.NewDB(dir, purbIsOn, purbkv.WithShards(4))
+				require.NoError(t, err)
+				require.NoError(t, setKeysInDB(db, "a"))
+				require.NoError(t, db.Close())
+			},
+			run: func(dir string, fsys purbkv.FileSystem) error {
+				err := setKeys(dir, purbIsOn, fsys, "b", "c")
+
+				// the shards replaced by the commit are deleted on a best
+				// effort basis, and a crash then is not reported
+				if err == nil && fsys.(*faultfs.FS).Crashed() {
+					return faultfs.ErrCrashed
+				}
+
+				return err
+			},
+			reopen: func(dir string) (purbkv.DB, error) {
+				return purbkv.NewDB(dir, purbIsOn)
+			},
+			states: [][]string{{"a"}, {"a", "b", "c"}},
+		})
+	}
+}
+
+func TestCrash_Paged(t *testing.T) {
+	runCrashes(t, crashScenario{
+		prepare: func(t *testing.T, dir string) {
+			db, err := purbkv.NewDB(dir, true, purbkv.WithShards(4), purbkv.WithPaging(16))
+			require.NoError(t, err)
+			require.NoError(t, setKeysInDB(db, "a"))
+			require.NoError(t, db.Close())
+		},
+		run: func(dir string, fsys purbkv.FileSystem) error {
+			err := setKeys(dir, true, fsys, "b", "c")
+
+			if err == nil && fsys.(*faultfs.FS).Crashed() {
+				return faultfs.ErrCrashed
+			}
+
+			return err
+		},
+		reopen: func(dir string) (purbkv.DB, error) {
+			return purbkv.NewDB(dir, true)
+		},
+		states: [][]string{{"a"}, {"a", "b", "c"}},
+	})
+}
+
+func TestCrash_Migrate(t *testing.T) {
+	for _, purbIsOn := range []bool{false, true} {
+		runCrashes(t, crashScenario{
+			prepare: func(t *testing.T, dir string) {
+				require.NoError(t, setKeys(dir, !purbIsOn, purbkv.NewOSFileSystem(), "a"))
+			},
+			run: func(dir string, fsys purbkv.FileSystem) error {
+				return purbkv.Migrate(dir, purbIsOn, purbkv.WithFileSystem(fsys))
+			},
+			reopen: func(dir string) (purbkv.DB, error) {
+				// the new file is used as soon as it exists
+				db, err := purbkv.NewDB(dir, purbIsOn)
+				if errors.Is(err, purbkv.ErrOtherFormat) {
+					return purbkv.NewDB(dir, !purbIsOn)
+				}
+
+				return db, err
+			},
+			states: [][]string{{"a"}},
+		})
+	}
+}
+
+func TestFault_NoSpace(t *testing.T) {
+	dir := newCrashDir(t)
+
+	fsys := faultfs.New(purbkv.NewOSFileSystem())
+
+	db, err := purbkv.NewDB(dir, true, purbkv.WithFileSystem(fsys))
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	start := fsys.Steps()
+
+	require.NoError(t, setKeysInDB(db, "a"))
+
+	steps := fsys.Steps() - start
+
+	for i := 1; i <= steps; i++ {
+		fsys.FailAt(fsys.Steps()+i, syscall.ENOSPC)
+
+		err = setKeysInDB(db, "b")
+		require.ErrorContains(t, err, syscall.ENOSPC.Error())
+
+		// the commit is not applied when it cannot be written, but it is once
+		// the file is renamed and only the directory fails to sync
+		if i < steps {
+			require.Equal(t, []string{"a"}, readKeys(t, db))
+		} else {
+			require.ErrorContains(t, err, "commit is saved but not synced")
+			require.Equal(t, []string{"a", "b"}, readKeys(t, db))
+		}
+	}
+
+	require.NoError(t, setKeysInDB(db, "b"))
+	require.NoError(t, db.Close())
+
+	requireNoTempFiles(t, dir)
+
+	db, err = purbkv.NewDB(dir, true)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"a", "b"}, readKeys(t, db))
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// runCrashes counts the steps of the operation and then runs it again with a
+// crash at each of them. After a crash, the database must open in one of the
+// expected states, the last of which is the state after the operation.
+func runCrashes(t *testing.T, s crashScenario) {
+	dir := newCrashDir(t)
+
+	s.prepare(t, dir)
+
+	fsys := faultfs.New(purbkv.NewOSFileSystem())
+
+	require.NoError(t, s.run(dir, fsys))
+	requireState(t, s, dir, s.states[len(s.states)-1:])
+
+	steps := fsys.Steps()
+	require.Positive(t, steps)
+
+	for step := 1; step <= steps; step++ {
+		dir := newCrashDir(t)
+
+		s.prepare(t, dir)
+
+		fsys := faultfs.New(purbkv.NewOSFileSystem())
+		fsys.CrashAt(step)
+
+		err := s.run(dir, fsys)
+		require.Error(t, err, "step %d", step)
+		require.True(t, fsys.Crashed(), "step %d", step)
+
+		requireState(t, s, dir, s.states)
+	}
+}
+
+func requireState(t *testing.T, s crashScenario, dir string, states [][]string) {
+	db, err := s.reopen(dir)
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	require.Contains(t, states, readKeys(t, db))
+}
+
+func newCrashDir(t *testing.T) string {
+	dir, err := os.MkdirTemp(os.TempDir(), crashTestDir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+// setKeys opens the database, sets the keys in one update and closes it.
+func setKeys(dir string, purbIsOn bool, fsys purbkv.FileSystem, keys ...string) error {
+	db, err := purbkv.NewDB(dir, purbIsOn, purbkv.WithFileSystem(fsys))
+	if err != nil {
+		return err
+	}
+
+	err = setKeysInDB(db, keys...)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	return db.Close()
+}
+
+func setKeysInDB(db purbkv.DB, keys ...string) error {
+	return db.Update(func(txn purbkv.WritableTx) error {
+		b, err := txn.GetBucketOrCreate(crashBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			err = b.Set([]byte(k), []byte(k))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// readKeys returns the keys of the bucket, or nil if it does not exist.
+func readKeys(t *testing.T, db purbkv.DB) []string {
+	var keys []string
+
+	err := db.View(func(txn purbkv.ReadableTx) error {
+		b := txn.GetBucket(crashBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	require.NoError(t, err)
+
+	return keys
+}
+
+func requireNoTempFiles(t *testing.T, dir string) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp*"))
+	require.NoError(t, err)
+	require.Empty(t, matches, strings.Join(matches, ", "))
+}
@@ -2,14 +2,12 @@ package purbkv
 
 import (
 	"bytes"
-	"encoding/gob"
 	"errors"
-	"io"
-	"os"
 	"path/filepath"
 	"sync"
 
-	"go.dedis.ch/libpurb/libpurb"
+	"go.dedis.ch/dela"
+	"golang.org/x/exp/maps"
 	"golang.org/x/xerrors"
 )
 
@@ -20,69 +18,228 @@ type privateRWMutex struct {
 type bucketDb struct {
 	privateRWMutex
 	Db map[string]*dpBucket
+	// pages are the pages of a paged database that are not saved yet
+	pages pageSet
 }
 
 func newBucketDb() bucketDb {
 	return bucketDb{Db: make(map[string]*dpBucket)}
 }
 
+const (
+	purbFileName = "purb.db"
+	kvFileName   = "kv.db"
+	keysFileName = "purb.keys"
+)
+
+// ErrClosed is returned when the database is used after it is closed.
+var ErrClosed = errors.New("database is closed")
+
+// ErrOtherFormat is returned when a database is opened in a format but its
+// directory holds a database in the other format.
+var ErrOtherFormat = errors.New("database exists in the other format")
+
 // DB is the DELA/PURB implementation of the KV database.
 //
 // - implements kv.DB
 type purbDB struct {
-	dbFile   string
+	// path is the directory of the keys
+	path string
+	// store is nil when the database only lives in memory
+	store    BlobStore
+	dbName   string
 	bucketDb bucketDb
-	blob     *libpurb.Purb
+	blob     *Blob
 	purbIsOn bool
+	// blobOpts are the options of the blob, kept to create one on migration
+	blobOpts []BlobOption
+	// lockBuffers is true when the plaintext is serialized in locked buffers
+	lockBuffers bool
+	// image is the last encoded state of an in-memory database with PURB
+	image []byte
+	// shards is the manifest of a sharded database, nil otherwise, and it is
+	// protected by the file lock
+	shards *manifest
+	// cache holds the saved buckets of a lazily loaded database, whose state
+	// then only holds the changes that are not saved yet
+	cache *shardCache
+	// merkle holds the roots of the committed buckets
+	merkle merkleCache
+	// pageSize is the size of the pages of a paged database, and zero when its
+	// buckets are not split in pages
+	pageSize int
+
+	// updateLock serializes the writable transactions
+	updateLock sync.Mutex
+	// fileLock prevents concurrent writes of the file
+	fileLock sync.Mutex
+	// durability defines when the commits are written
+	durability Durability
+	// scheduler runs the periodic writes
+	scheduler *scheduler
+	// batches groups the concurrent calls to Batch
+	batches *batcher
+	// closed is protected by the lock of the buckets
+	closed bool
 }
 
 // NewDB opens a new database to the given file.
-func NewDB(path string, purbIsOn bool) (DB, error) {
-	var filePath string
-	if purbIsOn {
-		filePath = filepath.Join(path, "purb.db")
-	} else {
-		filePath = filepath.Join(path, "kv.db")
+func NewDB(path string, purbIsOn bool, opts ...Option) (DB, error) {
+	tmpl := newDbTemplate(opts)
+
+	err := checkPermissions(tmpl.fsys, path, tmpl.permissions)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to check permissions: %v", err)
+	}
+
+	if tmpl.lockMemory {
+		err = lockMemory()
+		if err != nil {
+			return nil, xerrors.Errorf("failed to lock memory: %v", err)
+		}
+	}
+
+	if tmpl.lockBuffers {
+		buf, err := newLockedBuffer(0)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to lock memory: %v", err)
+		}
+
+		buf.release()
+	}
+
+	store := openStore(tmpl, path)
+
+	name := dbFileName(purbIsOn)
+
+	exists, err := store.Exists(name)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open DB file: %v", err)
 	}
 
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0755)
+	other := dbFileName(!purbIsOn)
+
+	otherExists, err := store.Exists(other)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to open DB file: %v", err)
 	}
-	defer f.Close()
 
-	var b *libpurb.Purb = nil
+	if otherExists && !exists {
+		return nil, xerrors.Errorf("%w: found %s, migrate it first", ErrOtherFormat, other)
+	}
+
+	if otherExists {
+		dela.Logger.Warn().Msgf("ignoring %s in the other format, it should be removed", other)
+	}
+
+	blobOpts := tmpl.blobOptions()
+
+	var b *Blob = nil
 	if purbIsOn {
-		b = NewBlob(path)
+		b, err = NewBlob(path, blobOpts...)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to create blob: %v", err)
+		}
 	}
 
 	p := &purbDB{
-		dbFile:   filePath,
+		path:     path,
+		store:    store,
+		dbName:   name,
 		bucketDb: newBucketDb(),
 		purbIsOn: purbIsOn,
 		blob:     b,
+		blobOpts: blobOpts,
+
+		lockBuffers: tmpl.lockBuffers,
 	}
 
-	stats, _ := f.Stat()
-	s := stats.Size()
-	if s > 0 {
+	p.batches = newBatcher(tmpl.batchSize, tmpl.batchDelay, p.Update)
+
+	if tmpl.lazy || tmpl.memoryBudget > 0 || tmpl.pageSize > 0 {
+		p.cache = newShardCache(nil, tmpl.memoryBudget, p.readShard, p.readPage)
+	}
+
+	if exists {
 		err = p.load()
+
+		// the first versions created an empty file before the first commit,
+		// which is an empty database rather than a damaged one
+		if errors.Is(err, ErrEmpty) {
+			exists = false
+		} else if err != nil {
+			return nil, xerrors.Errorf("failed to load DB file: %w", err)
+		}
+	}
+
+	if !exists {
+		if tmpl.shards > 0 {
+			p.shards, err = newManifest(tmpl.shards)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to create manifest: %v", err)
+			}
+
+			p.shards.paged = tmpl.pageSize > 0
+		} else if tmpl.pageSize > 0 {
+			return nil, xerrors.New("paging requires a sharded database")
+		}
+
+		if p.cache != nil {
+			p.cache.manifest = p.shards
+		}
+	}
+
+	// a single file is decoded as a whole to read any of its buckets
+	if p.shards == nil {
+		p.cache = nil
+	}
+
+	if p.shards != nil && p.shards.paged {
+		p.pageSize = tmpl.pageSize
+		if p.pageSize <= 0 {
+			p.pageSize = defaultPageSize
+		}
+	}
+
+	if !exists {
+		// an empty database is written right away so that the file always
+		// has a header
+		err = p.save(p.bucketDb.Db, p.bucketDb.pages, nil)
 		if err != nil {
-			return nil, xerrors.Errorf("failed to load DB file: %v", err)
+			return nil, xerrors.Errorf("failed to create DB file: %v", err)
 		}
 	}
+
+	p.durability = tmpl.durability
+
+	if p.durability == DurabilityPeriodic {
+		p.scheduler = newScheduler(tmpl.writeInterval)
+		p.scheduler.start(p.Flush)
+	}
+
 	return p, nil
 }
 
 // View implements kv.DB. It executes the read-only transaction in the context
 // of the database.
 func (p *purbDB) View(fn func(ReadableTx) error) error {
-	tx := &dpTx{db: &p.bucketDb, new: newBucketDb()}
+	tx := p.newTx()
 
 	tx.db.RLock()
+
+	if p.closed {
+		tx.db.RUnlock()
+		return ErrClosed
+	}
+
 	err := fn(tx)
 	tx.db.RUnlock()
 
+	// a bucket that could not be read looks missing to the callback
+	if tx.err != nil {
+		return tx.err
+	}
+
 	if err != nil {
 		return err
 	}
@@ -91,106 +248,451 @@ func (p *purbDB) View(fn func(ReadableTx) error) error {
 }
 
 // Update implements kv.DB. It executes the writable transaction in the context
-// of the database.
+// of the database. Writable transactions are executed one at a time so that
+// they never overwrite each other. Only the buckets that the transaction
+// modifies are written, and nothing is written when it only reads.
 func (p *purbDB) Update(fn func(WritableTx) error) error {
-	tx := &dpTx{db: &p.bucketDb, new: newBucketDb()}
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+
+	tx := p.newTx()
 
 	tx.db.RLock()
+
+	if p.closed {
+		tx.db.RUnlock()
+		return ErrClosed
+	}
+
 	err := fn(tx)
 	tx.db.RUnlock()
 
+	if tx.err != nil {
+		return tx.err
+	}
+
 	if err != nil {
 		return err
 	}
 
-	p.bucketDb.Lock()
-	for k, v := range tx.new.Db {
-		p.bucketDb.Db[k] = v
+	dirty := tx.changed()
+
+	// a transaction that only reads is neither merged nor written
+	if len(dirty) > 0 {
+		err = p.commit(tx, dirty)
+
+		// the commit is applied when it is saved even if it is not durable
+		if err != nil && !errors.Is(err, errNotSynced) {
+			return err
+		}
 	}
-	p.bucketDb.Unlock()
 
-	err = p.save()
+	// the callbacks may read the database
+	for _, fn := range tx.onCommit {
+		fn()
+	}
+
+	return err
+}
+
+// commit merges the buckets modified by the transaction in the state of the
+// database. With DurabilitySync, the new state is written and synced before it
+// replaces the current one, which transactions can read in the meantime, like
+// the snapshot of a bbolt database. A transaction that starts before the end of
+// the commit must not see its changes, as the callbacks that update what is
+// derived from them are not called yet. The caller must hold the lock of the
+// updates.
+func (p *purbDB) commit(tx *dpTx, dirty []string) error {
+	if p.durability != DurabilitySync {
+		p.bucketDb.Lock()
+		defer p.bucketDb.Unlock()
+
+		// the state is written by the next flush
+		next := maps.Clone(p.bucketDb.Db)
+		tx.merge(next)
+
+		p.bucketDb.Db = next
+		p.bucketDb.pages = p.bucketDb.pages.merge(tx.new.pages)
+		p.merkle.invalidate(dirty)
+
+		return nil
+	}
+
+	// only the commits replace the state, and they hold the lock of the updates
+	next := maps.Clone(p.bucketDb.Db)
+	tx.stage(next)
+
+	pages := p.bucketDb.pages.merge(tx.new.pages)
+
+	publish, err := p.write(next, pages, dirty)
 	if err != nil {
 		return err
 	}
 
-	if tx.onCommit != nil {
-		tx.onCommit()
+	err = p.sync()
+	if err != nil {
+		err = xerrors.Errorf("%w: %v", errNotSynced, err)
 	}
 
-	return nil
+	p.bucketDb.Lock()
+	defer p.bucketDb.Unlock()
+
+	// the changes are applied in place to the saved buckets, rather than to
+	// copies of them, now that the transactions cannot read them
+	for _, name := range dirty {
+		bucket := next[name]
+		if bucket != nil {
+			bucket.settle()
+		}
+	}
+
+	publish()
+
+	// the cache of a lazily loaded database holds what is saved
+	if p.cache != nil {
+		next = make(map[string]*dpBucket)
+		pages = pageSet{}
+	}
+
+	p.bucketDb.Db = next
+	p.bucketDb.pages = pages
+	p.merkle.invalidate(dirty)
+
+	return err
+}
+
+// newTx returns a transaction on the state of the database.
+func (p *purbDB) newTx() *dpTx {
+	return &dpTx{
+		db:       &p.bucketDb,
+		cache:    p.cache,
+		paged:    p.pageSize > 0,
+		pageSize: p.pageSize,
+		new:      newBucketDb(),
+	}
+}
+
+// Headroom implements purbkv.SizeReporter. It returns the number of bytes the
+// database can still grow before its file grows.
+func (p *purbDB) Headroom() (int, error) {
+	p.bucketDb.RLock()
+
+	if !p.purbIsOn {
+		p.bucketDb.RUnlock()
+		return 0, xerrors.New("size hiding requires PURB")
+	}
+
+	if p.shards != nil {
+		defer p.bucketDb.RUnlock()
+
+		p.fileLock.Lock()
+		defer p.fileLock.Unlock()
+
+		return p.shardsHeadroom(p.bucketDb.Db)
+	}
+
+	data := p.serialize(p.bucketDb.Db)
+	p.bucketDb.RUnlock()
+
+	size := data.Len()
+	wipe(data.Bytes())
+
+	return p.blob.Headroom(size)
 }
 
 // Close implements kv.DB. It closes the database. Any view or update call will
-// result in an error after this function is called.
+// result in an error after this function is called. The private keys are wiped
+// from memory. Pending changes are written to disk first. Closing the database
+// again does nothing.
 func (p *purbDB) Close() error {
+	// a background write takes the lock of the updates
+	if p.scheduler != nil {
+		p.scheduler.halt()
+	}
+
+	// running updates are completed first
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+
+	p.bucketDb.RLock()
+	closed := p.closed
+	p.bucketDb.RUnlock()
+
+	if closed {
+		return nil
+	}
+
+	var err error
+
+	if p.durability != DurabilitySync {
+		err = p.flush()
+	}
+
+	p.bucketDb.Lock()
+	p.closed = true
+	p.bucketDb.Unlock()
+
+	if p.blob != nil {
+		p.blob.Wipe()
+	}
+
+	if err != nil {
+		return xerrors.Errorf("failed to write pending changes: %v", err)
+	}
+
 	return nil
 }
 
 // ---------------------------------------------------------------------------
 // helper functions
 
-func (p *purbDB) serialize() (*bytes.Buffer, error) {
-	var data bytes.Buffer
-	encoder := gob.NewEncoder(&data)
+func (p *purbDB) serialize(db map[string]*dpBucket) *bytes.Buffer {
+	return encodeBuckets(db, p.flags())
+}
 
-	p.bucketDb.RLock()
-	defer p.bucketDb.RUnlock()
-	err := encoder.Encode(p.bucketDb.Db)
-	return &data, err
+// flags returns the flags of the format for the files of the database.
+func (p *purbDB) flags() uint16 {
+	var flags uint16
+
+	// a PURB is already authenticated
+	if !p.purbIsOn {
+		flags |= flagChecksums
+	}
+
+	return flags
 }
 
-func (p *purbDB) deserialize(input *bytes.Buffer) error {
-	decoder := gob.NewDecoder(input)
+func (p *purbDB) deserialize(data []byte) error {
+	db, err := decodeBuckets(data)
+	if err != nil {
+		return xerrors.Errorf("failed to decode buckets: %w", err)
+	}
 
-	err := decoder.Decode(&p.bucketDb.Db)
+	p.bucketDb.Db = db
 
-	for _, x := range p.bucketDb.Db {
-		x.updateIndex()
+	return nil
+}
+
+// save writes the buckets, and the pages of a paged database that are not
+// saved yet. The names of the buckets changed since the last save allow a
+// sharded database to only write their shards, and every shard is written
+// when it is nil.
+func (p *purbDB) save(db map[string]*dpBucket, pages pageSet, dirty []string) error {
+	publish, err := p.write(db, pages, dirty)
+	if err != nil {
+		return err
 	}
 
-	return err
+	publish()
+
+	return nil
 }
 
-func (p *purbDB) save() error {
-	data, err := p.serialize()
+// write writes the buckets like save, and returns the function that makes the
+// files written the saved state of the database. The files of the previous
+// state are kept until then, so that the transactions that read it can still
+// load its shards.
+func (p *purbDB) write(db map[string]*dpBucket, pages pageSet, dirty []string) (func(), error) {
+	p.fileLock.Lock()
+	defer p.fileLock.Unlock()
+
+	if p.store == nil {
+		return func() {}, p.saveInMemory(db)
+	}
+
+	if p.shards != nil {
+		return p.writeShards(db, pages, dirty)
+	}
+
+	data, err := p.encode(db)
 	if err != nil {
-		return xerrors.Errorf("failed to serialize DB file: %v", err)
+		return nil, err
 	}
 
-	if p.purbIsOn {
-		blob, err := Encode(p.blob, data.Bytes())
-		if err != nil {
-			return xerrors.Errorf("failed to purbify DB file: %v", err)
-		}
-		data = bytes.NewBuffer(blob)
+	err = p.store.Put(p.dbName, data)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to save DB file: %v", err)
 	}
 
-	err = os.WriteFile(p.dbFile, data.Bytes(), 0755)
+	return func() {}, nil
+}
+
+// encode returns the content of the file for the buckets. The plaintext is
+// serialized in a locked buffer when the buffers are locked.
+func (p *purbDB) encode(db map[string]*dpBucket) ([]byte, error) {
+	if !p.lockBuffers || !p.purbIsOn {
+		return p.seal(p.serialize(db))
+	}
+
+	length := encodedLength(db, p.flags())
+
+	buf, err := newLockedBuffer(length)
 	if err != nil {
-		return xerrors.Errorf("failed to save DB file: %v", err)
+		return nil, xerrors.Errorf("failed to lock buffer: %v", err)
 	}
 
+	defer buf.release()
+
+	data := bytes.NewBuffer(buf.mem[:0])
+	writeBuckets(data, db, p.flags(), length)
+
+	return p.seal(data)
+}
+
+// seal returns the content of a file for the serialized data, which is wiped
+// when it is encoded.
+func (p *purbDB) seal(data *bytes.Buffer) ([]byte, error) {
+	if !p.purbIsOn {
+		return data.Bytes(), nil
+	}
+
+	blob, err := p.blob.Encode(data.Bytes())
+	wipe(data.Bytes())
+	if err != nil {
+		return nil, xerrors.Errorf("failed to purbify DB file: %w", err)
+	}
+
+	return blob, nil
+}
+
+// replace writes the buckets to disk and makes them the content of the
+// database. The buckets are split in pages in one update when the database is
+// paged, which must then be empty.
+func (p *purbDB) replace(db map[string]*dpBucket) error {
+	if p.pageSize > 0 {
+		return p.Update(func(txn WritableTx) error {
+			for name, bucket := range db {
+				b, err := txn.GetBucketOrCreate([]byte(name))
+				if err != nil {
+					return err
+				}
+
+				for _, k := range bucket.idx.keys() {
+					err = b.Set([]byte(k), bucket.Kv[k])
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		})
+	}
+
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+
+	p.bucketDb.Lock()
+	defer p.bucketDb.Unlock()
+
+	err := p.save(db, pageSet{}, nil)
+	if err != nil {
+		return err
+	}
+
+	p.bucketDb.Db = db
+	p.merkle.reset()
+
 	return nil
 }
 
+// load reads the database file, and the shards it lists when it is the
+// manifest of a sharded database.
 func (p *purbDB) load() error {
-	data, err := os.ReadFile(p.dbFile)
+	data, err := p.readFile(p.dbName)
 	if err != nil {
-		return xerrors.Errorf("failed to load DB from file: %v", err)
+		return err
 	}
 
-	if p.purbIsOn && len(data) > 0 {
-		data, err = Decode(p.blob, data)
+	defer wipe(data)
+
+	if isManifest(data) {
+		hdr, body, _ := parseHeader(data)
+
+		m, err := decodeManifest(body, hdr.flags)
 		if err != nil {
-			return xerrors.Errorf("failed to decode purbified DB file: %v", err)
+			return err
 		}
+
+		return p.loadShards(m)
 	}
 
-	buffer := bytes.NewBuffer(data)
-	err = p.deserialize(buffer)
-	if err != nil && errors.Is(err, io.EOF) {
-		return nil
+	return p.deserialize(data)
+}
+
+// readBuckets reads the buckets of a file of the database.
+func (p *purbDB) readBuckets(name string) (map[string]*dpBucket, error) {
+	data, err := p.readFile(name)
+	if err != nil {
+		return nil, err
 	}
-	return err
+
+	defer wipe(data)
+
+	db, err := decodeBuckets(data)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to decode buckets: %w", err)
+	}
+
+	return db, nil
+}
+
+// readFile returns the content of a file of the database, after it is decoded
+// when PURB is on.
+func (p *purbDB) readFile(name string) ([]byte, error) {
+	data, err := p.store.Get(name)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load DB from file: %v", err)
+	}
+
+	if len(data) == 0 {
+		return nil, ErrEmpty
+	}
+
+	if p.purbIsOn {
+		data, err = p.blob.Decode(data)
+		if err != nil {
+			return nil, xerrors.Errorf("%w: failed to decode purbified DB file: %v", ErrCorrupted, err)
+		}
+	}
+
+	return data, nil
+}
+
+// openStore returns the store of the options, or the directory at the given
+// path when there is none.
+func openStore(tmpl dbTemplate, path string) BlobStore {
+	if tmpl.store != nil {
+		return tmpl.store
+	}
+
+	return newFileStore(tmpl.fsys, path)
+}
+
+// dbExists returns true if the database file in the given format exists in the
+// store that the options configure for the directory at the given path.
+func dbExists(path string, purbIsOn bool, opts []Option) (bool, error) {
+	store := openStore(newDbTemplate(opts), path)
+
+	exists, err := store.Exists(dbFileName(purbIsOn))
+	if err != nil {
+		return false, xerrors.Errorf("failed to stat DB file: %v", err)
+	}
+
+	return exists, nil
+}
+
+// dbFilePath returns the path of the database file in the directory.
+func dbFilePath(path string, purbIsOn bool) string {
+	return filepath.Join(path, dbFileName(purbIsOn))
+}
+
+// dbFileName returns the name of the database file, which is also the name of
+// its object in a store.
+func dbFileName(purbIsOn bool) string {
+	if purbIsOn {
+		return purbFileName
+	}
+
+	return kvFileName
 }
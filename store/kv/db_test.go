@@ -351,3 +351,103 @@ func TestDb_Scan(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestDb_DeleteThenSet(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+
+	err = db.Update(func(txn WritableTx) error {
+		b, err := txn.GetBucketOrCreate([]byte("bucket"))
+		require.NoError(t, err)
+
+		require.NoError(t, b.Set([]byte("ping"), []byte("pong")))
+		require.NoError(t, b.Delete([]byte("ping")))
+		require.NoError(t, b.Delete([]byte("ping")))
+		require.NoError(t, b.Set([]byte("ping"), []byte("pong")))
+
+		count := 0
+		err = b.ForEach(func(k, v []byte) error {
+			count++
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDb_OnCommitOrder(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var calls []int
+
+	err = db.Update(func(txn WritableTx) error {
+		txn.OnCommit(func() { calls = append(calls, 1) })
+		txn.OnCommit(func() {
+			// the database can be read from a callback
+			require.NoError(t, db.View(func(ReadableTx) error { return nil }))
+			calls = append(calls, 2)
+		})
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, calls)
+}
+
+func TestDb_ConcurrentUpdates(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	const n = 20
+
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- db.Update(func(txn WritableTx) error {
+				b, err := txn.GetBucketOrCreate([]byte("bucket"))
+				if err != nil {
+					return err
+				}
+
+				return b.Set([]byte{byte(i)}, []byte{byte(i)})
+			})
+		}(i)
+	}
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	err = db.View(func(txn ReadableTx) error {
+		count := 0
+		err := txn.GetBucket([]byte("bucket")).ForEach(func(k, v []byte) error {
+			count++
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, n, count)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
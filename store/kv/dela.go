@@ -0,0 +1,105 @@
+package purbkv
+
+import (
+	delakv "go.dedis.ch/dela/core/store/kv"
+)
+
+// delaDB is an adapter of the database for the key/value interfaces of dela,
+// which only differ by the signature of Bucket.Get.
+//
+// - implements kv.DB
+type delaDB struct {
+	db DB
+}
+
+// NewDelaDB returns the database as a kv.DB of dela so that it can be used by
+// dela services in place of the bbolt database. Closing the adapter closes the
+// database.
+func NewDelaDB(db DB) delakv.DB {
+	return delaDB{db: db}
+}
+
+// View implements kv.DB. It executes the read-only transaction in the context
+// of the database.
+func (d delaDB) View(fn func(delakv.ReadableTx) error) error {
+	return d.db.View(func(tx ReadableTx) error {
+		return fn(delaTx{ReadableTx: tx})
+	})
+}
+
+// Update implements kv.DB. It executes the writable transaction in the context
+// of the database.
+func (d delaDB) Update(fn func(delakv.WritableTx) error) error {
+	return d.db.Update(func(tx WritableTx) error {
+		return fn(delaWritableTx{delaTx: delaTx{ReadableTx: tx}, writable: tx})
+	})
+}
+
+// Close implements kv.DB. It closes the database.
+func (d delaDB) Close() error {
+	return d.db.Close()
+}
+
+// delaTx is an adapter of a read-only transaction for the key/value interfaces
+// of dela.
+//
+// - implements kv.ReadableTx
+type delaTx struct {
+	ReadableTx
+}
+
+// GetBucket implements kv.ReadableTx. It returns the bucket with the given name
+// or nil if it does not exist.
+func (tx delaTx) GetBucket(name []byte) delakv.Bucket {
+	bucket := tx.ReadableTx.GetBucket(name)
+	if bucket == nil {
+		return nil
+	}
+
+	return delaBucket{Bucket: bucket}
+}
+
+// delaWritableTx is an adapter of a writable transaction for the key/value
+// interfaces of dela.
+//
+// - implements kv.WritableTx
+type delaWritableTx struct {
+	delaTx
+
+	writable WritableTx
+}
+
+// GetBucketOrCreate implements kv.WritableTx. It creates the bucket if it does
+// not exist and then return it.
+func (tx delaWritableTx) GetBucketOrCreate(name []byte) (delakv.Bucket, error) {
+	bucket, err := tx.writable.GetBucketOrCreate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return delaBucket{Bucket: bucket}, nil
+}
+
+// OnCommit implements store.Transaction. It registers a callback that is called
+// after the transaction is successful.
+func (tx delaWritableTx) OnCommit(fn func()) {
+	tx.writable.OnCommit(fn)
+}
+
+// delaBucket is an adapter of a bucket for the key/value interfaces of dela.
+//
+// - implements kv.Bucket
+type delaBucket struct {
+	Bucket
+}
+
+// Get implements kv.Bucket. It returns the value associated to the key, or nil
+// if it does not exist.
+func (b delaBucket) Get(key []byte) []byte {
+	value, err := b.Bucket.Get(key)
+	if err != nil {
+		return nil
+	}
+
+	return value
+}
@@ -0,0 +1,53 @@
+package purbkv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	delakv "go.dedis.ch/dela/core/store/kv"
+)
+
+func TestDela_Adapter(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+
+	adapter := NewDelaDB(db)
+
+	committed := false
+
+	err = adapter.Update(func(txn delakv.WritableTx) error {
+		require.Nil(t, txn.GetBucket([]byte("bucket")))
+
+		b, err := txn.GetBucketOrCreate([]byte("bucket"))
+		require.NoError(t, err)
+		require.NoError(t, b.Set([]byte("ping"), []byte("pong")))
+
+		_, err = txn.GetBucketOrCreate(nil)
+		require.Error(t, err)
+
+		txn.OnCommit(func() { committed = true })
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, committed)
+
+	err = adapter.View(func(txn delakv.ReadableTx) error {
+		_, writable := txn.(delakv.WritableTx)
+		require.False(t, writable)
+
+		b := txn.GetBucket([]byte("bucket"))
+		require.Equal(t, []byte("pong"), b.Get([]byte("ping")))
+		require.Nil(t, b.Get([]byte("unknown")))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, adapter.Close())
+}
@@ -0,0 +1,52 @@
+package purbkv
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Durability defines when the commits of a database are written to disk.
+// Every write is synced, along with the directory of the files, so that it
+// survives a crash once it returns.
+type Durability int
+
+const (
+	// DurabilitySync writes every commit before the update returns. A commit
+	// that is written but whose directory cannot be synced is applied, and the
+	// update returns an error as it may not survive a crash.
+	DurabilitySync Durability = iota
+	// DurabilityPeriodic writes the database in the background at a fixed
+	// interval, so that a crash loses at most the commits of the last
+	// interval.
+	DurabilityPeriodic
+	// DurabilityManual keeps the commits in memory until Flusher.Flush is
+	// called or the database is closed.
+	DurabilityManual
+)
+
+// errNotSynced is returned by a commit that is written but whose directory
+// cannot be synced. The commit is applied.
+var errNotSynced = errors.New("commit is saved but not synced")
+
+// defaultWriteInterval is the interval of the periodic writes when it is not
+// set.
+const defaultWriteInterval = time.Second
+
+// sync makes the files written in the directory of the store durable, as a
+// renamed file may otherwise be lost in a crash. The other stores are durable
+// once their objects are written.
+func (p *purbDB) sync() error {
+	store, ok := p.store.(fileStore)
+	if !ok {
+		return nil
+	}
+
+	err := syncDir(store.fsys, store.dir)
+	if err != nil {
+		return xerrors.Errorf("failed to sync directory: %v", err)
+	}
+
+	return nil
+}
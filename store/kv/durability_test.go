@@ -0,0 +1,202 @@
+package purbkv
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurability_Sync(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fsys := &syncingFS{FileSystem: osFS{}}
+
+	db, err := NewDB(dir, true, WithFileSystem(fsys))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the keys are synced when they are created
+	require.Contains(t, fsys.synced(), dir)
+
+	fsys.reset()
+
+	setBuckets(t, db, "a")
+
+	// the file is synced before it is renamed, and then its directory
+	synced := fsys.synced()
+	require.Len(t, synced, 2)
+	require.Equal(t, dir, synced[1])
+
+	// with every commit written, there is nothing to flush
+	fsys.reset()
+
+	require.NoError(t, db.(Flusher).Flush())
+	require.Empty(t, fsys.synced())
+}
+
+func TestDurability_Manual(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &failingStore{BlobStore: NewMemoryStore()}
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithDurability(DurabilityManual))
+	require.NoError(t, err)
+
+	p := db.(*purbDB)
+	require.Nil(t, p.scheduler)
+
+	store.puts.Store(0)
+
+	setBuckets(t, db, "a")
+	setBuckets(t, db, "b")
+
+	// the commits are only in memory
+	require.Zero(t, store.puts.Load())
+
+	require.NoError(t, db.(Flusher).Flush())
+	require.Equal(t, int64(1), store.puts.Load())
+
+	setBuckets(t, db, "c")
+	require.Equal(t, int64(1), store.puts.Load())
+
+	// the pending commits are written when the database is closed
+	require.NoError(t, db.Close())
+	require.Equal(t, int64(2), store.puts.Load())
+
+	db, err = NewDB(dir, false, WithBlobStore(store))
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		requireValue(t, db, name, "key", name)
+	}
+}
+
+func TestDurability_ManualSync(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fsys := &syncingFS{FileSystem: osFS{}}
+
+	db, err := NewDB(dir, false, WithFileSystem(fsys), WithDurability(DurabilityManual))
+	require.NoError(t, err)
+	defer db.Close()
+
+	fsys.reset()
+
+	// nothing is written, so nothing is synced
+	setBuckets(t, db, "a")
+	setBuckets(t, db, "b")
+	require.Empty(t, fsys.synced())
+
+	require.NoError(t, db.(Flusher).Flush())
+
+	synced := fsys.synced()
+	require.Len(t, synced, 2)
+	require.Equal(t, dir, synced[1])
+}
+
+func TestDurability_Periodic(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &failingStore{BlobStore: NewMemoryStore()}
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithDurability(DurabilityPeriodic))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Equal(t, defaultWriteInterval, db.(*purbDB).scheduler.interval)
+
+	store.puts.Store(0)
+
+	setBuckets(t, db, "a")
+
+	// the commit is written at the next tick
+	require.Eventually(t, func() bool {
+		return store.puts.Load() > 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestDurability_Options(t *testing.T) {
+	tmpl := newDbTemplate(nil)
+	require.Equal(t, DurabilitySync, tmpl.durability)
+
+	tmpl = newDbTemplate([]Option{WithScheduledWrites(time.Minute)})
+	require.Equal(t, DurabilityPeriodic, tmpl.durability)
+	require.Equal(t, time.Minute, tmpl.writeInterval)
+
+	// the last option wins
+	tmpl = newDbTemplate([]Option{WithScheduledWrites(time.Minute), WithDurability(DurabilitySync)})
+	require.Equal(t, DurabilitySync, tmpl.durability)
+
+	tmpl = newDbTemplate([]Option{WithDurability(DurabilityPeriodic)})
+	require.Equal(t, defaultWriteInterval, tmpl.writeInterval)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// syncingFS is a file system that records the names of the files that are
+// synced.
+type syncingFS struct {
+	FileSystem
+
+	sync.Mutex
+	names []string
+}
+
+func (f *syncingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncingFile{File: file, fs: f}, nil
+}
+
+func (f *syncingFS) CreateTemp(dir, pattern string) (File, error) {
+	file, err := f.FileSystem.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncingFile{File: file, fs: f}, nil
+}
+
+func (f *syncingFS) synced() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	return append([]string(nil), f.names...)
+}
+
+func (f *syncingFS) reset() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.names = nil
+}
+
+type syncingFile struct {
+	File
+
+	fs *syncingFS
+}
+
+func (f *syncingFile) Sync() error {
+	f.fs.Lock()
+	f.fs.names = append(f.fs.names, f.Name())
+	f.fs.Unlock()
+
+	return f.File.Sync()
+}
@@ -0,0 +1,257 @@
+// Package faultfs provides a file system that injects faults in the file
+// operations of a database, to check how it behaves when the disk is full or
+// when the process crashes in the middle of a write.
+//
+// The operations that change the disk are counted as steps: opening a file
+// for writing, creating a temporary file, writing, syncing, changing the mode,
+// renaming and removing. A fault is injected at a given step, so that a test
+// can first count the steps of an operation and then replay it with a fault at
+// each of them.
+package faultfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	"go.dedis.ch/purb-db/store/kv"
+)
+
+// ErrCrashed is returned by every operation once the file system has crashed.
+var ErrCrashed = errors.New("file system has crashed")
+
+// writeFlags are the flags that open a file to change it.
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+// FS is a file system that injects faults in the operations of another one.
+//
+// - implements purbkv.FileSystem
+type FS struct {
+	sync.Mutex
+
+	base     purbkv.FileSystem
+	steps    int
+	failures map[int]error
+	crashAt  int
+	crashed  bool
+}
+
+// New returns a file system that forwards the operations to the base one until
+// a fault is injected.
+func New(base purbkv.FileSystem) *FS {
+	return &FS{
+		base:     base,
+		failures: make(map[int]error),
+	}
+}
+
+// Steps returns the number of steps that were taken.
+func (f *FS) Steps() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.steps
+}
+
+// FailAt makes the step fail with the error, as a full disk does with
+// syscall.ENOSPC. A write at that step is torn, and only the first half of the
+// data reaches the file. The next steps succeed.
+func (f *FS) FailAt(step int, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.failures[step] = err
+}
+
+// CrashAt makes the file system crash at the step, as if the process was killed
+// while it is running. A write at that step is torn, and any other operation at
+// that step is not done. Every operation returns ErrCrashed afterwards.
+func (f *FS) CrashAt(step int) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.crashAt = step
+}
+
+// Crashed returns true if the file system has crashed.
+func (f *FS) Crashed() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.crashed
+}
+
+// OpenFile implements purbkv.FileSystem. Opening a file for writing is a step.
+func (f *FS) OpenFile(name string, flag int, perm fs.FileMode) (purbkv.File, error) {
+	var err error
+
+	if flag&writeFlags != 0 {
+		err = f.step()
+	} else {
+		err = f.check()
+	}
+
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	file, err := f.base.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: file, fs: f}, nil
+}
+
+// CreateTemp implements purbkv.FileSystem. Creating the file is a step.
+func (f *FS) CreateTemp(dir, pattern string) (purbkv.File, error) {
+	err := f.step()
+	if err != nil {
+		return nil, &fs.PathError{Op: "createtemp", Path: dir, Err: err}
+	}
+
+	file, err := f.base.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: file, fs: f}, nil
+}
+
+// ReadFile implements purbkv.FileSystem.
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	err := f.check()
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+
+	return f.base.ReadFile(name)
+}
+
+// Stat implements purbkv.FileSystem.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	err := f.check()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return f.base.Stat(name)
+}
+
+// Rename implements purbkv.FileSystem. Renaming is a step.
+func (f *FS) Rename(oldpath, newpath string) error {
+	err := f.step()
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	return f.base.Rename(oldpath, newpath)
+}
+
+// Remove implements purbkv.FileSystem. Removing is a step.
+func (f *FS) Remove(name string) error {
+	err := f.step()
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	return f.base.Remove(name)
+}
+
+// step counts a step and returns the fault injected at it, if any.
+func (f *FS) step() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+
+	f.steps++
+
+	if f.steps == f.crashAt {
+		f.crashed = true
+		return ErrCrashed
+	}
+
+	err, found := f.failures[f.steps]
+	if found {
+		delete(f.failures, f.steps)
+		return err
+	}
+
+	return nil
+}
+
+// check returns an error if the file system has crashed.
+func (f *FS) check() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+
+	return nil
+}
+
+// faultFile is a file opened by the fault-injecting file system.
+//
+// - implements purbkv.File
+type faultFile struct {
+	purbkv.File
+
+	fs *FS
+}
+
+// Read implements io.Reader.
+func (f *faultFile) Read(p []byte) (int, error) {
+	err := f.fs.check()
+	if err != nil {
+		return 0, err
+	}
+
+	return f.File.Read(p)
+}
+
+// Write implements io.Writer. Writing is a step, and a fault tears the write.
+func (f *faultFile) Write(p []byte) (int, error) {
+	err := f.fs.step()
+	if err != nil {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+
+	return f.File.Write(p)
+}
+
+// Sync implements purbkv.File. Syncing is a step.
+func (f *faultFile) Sync() error {
+	err := f.fs.step()
+	if err != nil {
+		return err
+	}
+
+	return f.File.Sync()
+}
+
+// Chmod implements purbkv.File. Changing the mode is a step.
+func (f *faultFile) Chmod(mode fs.FileMode) error {
+	err := f.fs.step()
+	if err != nil {
+		return err
+	}
+
+	return f.File.Chmod(mode)
+}
+
+// Stat implements purbkv.File.
+func (f *faultFile) Stat() (fs.FileInfo, error) {
+	err := f.fs.check()
+	if err != nil {
+		return nil, err
+	}
+
+	return f.File.Stat()
+}
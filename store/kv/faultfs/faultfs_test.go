@@ -0,0 +1,110 @@
+package faultfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/purb-db/store/kv"
+)
+
+func TestFS_Steps(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "faultfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+
+	fsys := New(purbkv.NewOSFileSystem())
+
+	file, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	require.NoError(t, err)
+
+	_, err = file.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, file.Sync())
+	require.NoError(t, file.Chmod(0600))
+	require.NoError(t, file.Close())
+
+	// reading is not a step
+	data, err := fsys.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+
+	_, err = fsys.Stat(path)
+	require.NoError(t, err)
+
+	file, err = fsys.OpenFile(path, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	require.NoError(t, fsys.Rename(path, path+".new"))
+	require.NoError(t, fsys.Remove(path+".new"))
+
+	require.Equal(t, 6, fsys.Steps())
+}
+
+func TestFS_FailAt(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "faultfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fsys := New(purbkv.NewOSFileSystem())
+	fsys.FailAt(2, syscall.ENOSPC)
+
+	file, err := fsys.CreateTemp(dir, "file")
+	require.NoError(t, err)
+
+	defer file.Close()
+
+	// the write is torn
+	n, err := file.Write([]byte("data"))
+	require.ErrorIs(t, err, syscall.ENOSPC)
+	require.Equal(t, 2, n)
+
+	data, err := os.ReadFile(file.Name())
+	require.NoError(t, err)
+	require.Equal(t, []byte("da"), data)
+
+	// the next steps succeed
+	_, err = file.Write([]byte("ta"))
+	require.NoError(t, err)
+	require.False(t, fsys.Crashed())
+}
+
+func TestFS_CrashAt(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "faultfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+
+	err = os.WriteFile(path, []byte("data"), 0600)
+	require.NoError(t, err)
+
+	fsys := New(purbkv.NewOSFileSystem())
+	fsys.CrashAt(1)
+
+	err = fsys.Rename(path, path+".new")
+	require.ErrorIs(t, err, ErrCrashed)
+	require.True(t, fsys.Crashed())
+
+	// the operation was not done
+	require.FileExists(t, path)
+
+	_, err = fsys.ReadFile(path)
+	require.ErrorIs(t, err, ErrCrashed)
+
+	_, err = fsys.Stat(path)
+	require.ErrorIs(t, err, ErrCrashed)
+
+	_, err = fsys.OpenFile(path, os.O_RDONLY, 0)
+	require.ErrorIs(t, err, ErrCrashed)
+
+	err = fsys.Remove(path)
+	require.ErrorIs(t, err, ErrCrashed)
+
+	require.Equal(t, 1, fsys.Steps())
+}
@@ -0,0 +1,142 @@
+package purbkv
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/xerrors"
+)
+
+// osFS is the file system of the operating system.
+//
+// - implements purbkv.FileSystem
+type osFS struct{}
+
+// NewOSFileSystem returns the file system of the operating system, which is
+// the default of a database.
+func NewOSFileSystem() FileSystem {
+	return osFS{}
+}
+
+// OpenFile implements purbkv.FileSystem. It opens the file with os.OpenFile.
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// CreateTemp implements purbkv.FileSystem. It creates the file with
+// os.CreateTemp.
+func (osFS) CreateTemp(dir, pattern string) (File, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// ReadFile implements purbkv.FileSystem. It reads the file with os.ReadFile.
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// Stat implements purbkv.FileSystem. It describes the file with os.Stat.
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Rename implements purbkv.FileSystem. It renames the file with os.Rename.
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Remove implements purbkv.FileSystem. It removes the file with os.Remove.
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory,
+// and renames it once it is synced to disk. The temporary file is removed if
+// anything fails before.
+func writeFileAtomic(fsys FileSystem, path string, data []byte) error {
+	file, err := fsys.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return xerrors.Errorf("failed to create file: %v", err)
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = fsys.Rename(file.Name(), path)
+		if err != nil {
+			err = xerrors.Errorf("failed to rename file: %v", err)
+		}
+	} else {
+		err = xerrors.Errorf("failed to write file: %v", err)
+	}
+
+	if err != nil {
+		fsys.Remove(file.Name())
+		return err
+	}
+
+	return nil
+}
+
+// shredFile overwrites the file with zeros before removing it. The content may
+// still be recoverable on file systems or disks that do not write in place,
+// for instance with copy-on-write or wear levelling.
+func shredFile(fsys FileSystem, path string) error {
+	file, err := fsys.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return xerrors.Errorf("failed to open file: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err == nil {
+		_, err = file.Write(make([]byte, info.Size()))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+
+	file.Close()
+
+	if err != nil {
+		return xerrors.Errorf("failed to overwrite file: %v", err)
+	}
+
+	err = fsys.Remove(path)
+	if err != nil {
+		return xerrors.Errorf("failed to remove file: %v", err)
+	}
+
+	return nil
+}
+
+// fileExists returns true if the file exists.
+func fileExists(fsys FileSystem, path string) (bool, error) {
+	_, err := fsys.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,498 @@
+package purbkv
+
+// This file implements the serialization of the database.
+//
+// Format version 2 is a header followed by the body of the buckets:
+//
+//	header  = magic (4 bytes "PKVD") | version (uint16) | flags (uint16) |
+//	          length (uint64) | checksum (uint32)
+//	body    = count (uvarint) | section*
+//	section = bucket | checksum (uint32, only with flagChecksums)
+//	bucket  = name (bytes) | count (uvarint) | pair*
+//	pair    = key (bytes) | value (bytes)
+//	bytes   = length (uvarint) | data
+//
+// Integers of the header are big endian. The length is the size of the body,
+// and the checksum of the header is a CRC32C of the fields before it. With
+// flagChecksums, every bucket is followed by the CRC32C of its encoding.
+// Buckets are sorted by name and pairs by key, so that two databases with the
+// same content produce the same bytes. Anything following the body is padding.
+//
+// With flagManifest, the body is the manifest of a sharded database instead of
+// buckets, which is described with the sharded layout.
+//
+// Version 1 is the same without the length, the header checksum and the
+// section checksums. Version 0 is the legacy format which is a gob encoding of
+// the map of buckets without any header. Both are still accepted by the
+// decoder.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"slices"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// formatVersion is the version written by the encoder.
+	formatVersion uint16 = 2
+
+	// flagChecksums is set when every bucket is followed by a checksum.
+	flagChecksums uint16 = 1 << 0
+	// flagManifest is set when the body is the manifest of a sharded database.
+	flagManifest uint16 = 1 << 1
+	// flagPaged is set on the manifest of a database whose buckets are split in
+	// pages.
+	flagPaged uint16 = 1 << 2
+
+	// headerLengthV1 is the length of the header of the version 1.
+	headerLengthV1 = 8
+	headerLength   = 20
+	checksumLength = 4
+)
+
+var (
+	formatMagic = []byte("PKVD")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrEmpty is reported by Verify and Repair when the database file exists
+	// but is empty. NewDB opens such a file as an empty database.
+	ErrEmpty = errors.New("database file is empty")
+
+	// ErrTruncated is returned when the database file is shorter than what its
+	// content announces.
+	ErrTruncated = errors.New("database file is truncated")
+
+	// ErrCorrupted is returned when the content of the database file does not
+	// match its checksums or cannot be decoded.
+	ErrCorrupted = errors.New("database file is corrupted")
+)
+
+// encodeBuckets serializes the buckets in the current format.
+func encodeBuckets(db map[string]*dpBucket, flags uint16) *bytes.Buffer {
+	length := encodedLength(db, flags)
+
+	buf := bytes.NewBuffer(make([]byte, 0, length))
+	writeBuckets(buf, db, flags, length)
+
+	return buf
+}
+
+// writeBuckets writes the serialized buckets, whose length is given by
+// encodedLength, to the buffer, which is not grown when it has the capacity.
+func writeBuckets(buf *bytes.Buffer, db map[string]*dpBucket, flags uint16, length int) {
+	buf.Write(encodeHeader(flags, length-headerLength))
+
+	names := maps.Keys(db)
+	slices.Sort(names)
+
+	writeUvarint(buf, uint64(len(names)))
+
+	for _, name := range names {
+		start := buf.Len()
+
+		writeBucket(buf, name, db[name])
+
+		if flags&flagChecksums != 0 {
+			sum := crc32.Checksum(buf.Bytes()[start:], castagnoli)
+			buf.Write(binary.BigEndian.AppendUint32(nil, sum))
+		}
+	}
+}
+
+// encodedLength returns the length of the serialized buckets.
+func encodedLength(db map[string]*dpBucket, flags uint16) int {
+	length := headerLength + uvarintLength(uint64(len(db)))
+
+	for name, bucket := range db {
+		length += bytesLength(len(name))
+
+		count := 0
+
+		bucket.pairs(func(k string, v []byte) {
+			length += bytesLength(len(k)) + bytesLength(len(v))
+			count++
+		})
+
+		length += uvarintLength(uint64(count))
+
+		if flags&flagChecksums != 0 {
+			length += checksumLength
+		}
+	}
+
+	return length
+}
+
+// encodeHeader returns the header of a body of the given length.
+func encodeHeader(flags uint16, length int) []byte {
+	header := make([]byte, 0, headerLength)
+	header = append(header, formatMagic...)
+	header = binary.BigEndian.AppendUint16(header, formatVersion)
+	header = binary.BigEndian.AppendUint16(header, flags)
+	header = binary.BigEndian.AppendUint64(header, uint64(length))
+	header = binary.BigEndian.AppendUint32(header, crc32.Checksum(header, castagnoli))
+
+	return header
+}
+
+func writeBucket(buf *bytes.Buffer, name string, bucket *dpBucket) {
+	writeBytes(buf, []byte(name))
+
+	// a staged bucket is read through its changes, and its index holds the
+	// sorted keys
+	if bucket.pending != nil {
+		keys := bucket.idx.keys()
+		writeUvarint(buf, uint64(len(keys)))
+
+		for _, key := range keys {
+			value, _ := bucket.pending.get(key)
+
+			writeBytes(buf, []byte(key))
+			writeBytes(buf, value)
+		}
+
+		return
+	}
+
+	keys := maps.Keys(bucket.Kv)
+	slices.Sort(keys)
+
+	writeUvarint(buf, uint64(len(keys)))
+
+	for _, key := range keys {
+		writeBytes(buf, []byte(key))
+		writeBytes(buf, bucket.Kv[key])
+	}
+}
+
+// decodeBuckets deserializes the buckets from any known version of the format.
+// Errors wrap ErrEmpty, ErrTruncated or ErrCorrupted.
+func decodeBuckets(data []byte) (map[string]*dpBucket, error) {
+	hdr, body, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.version == 0 {
+		return decodeLegacy(body)
+	}
+
+	if hdr.flags&flagManifest != 0 {
+		return nil, errManifest
+	}
+
+	return decodeBody(body, hdr.flags)
+}
+
+// header is the header of an encoded database.
+type header struct {
+	version uint16
+	flags   uint16
+}
+
+// parseHeader verifies the header and returns it with the body it describes.
+// The version 0 has no header and the whole data is the body.
+func parseHeader(data []byte) (header, []byte, error) {
+	var hdr header
+
+	if len(data) == 0 {
+		return hdr, nil, ErrEmpty
+	}
+
+	if !bytes.HasPrefix(data, formatMagic) {
+		return hdr, data, nil
+	}
+
+	if len(data) < headerLengthV1 {
+		return hdr, nil, xerrors.Errorf("%w: header is incomplete", ErrTruncated)
+	}
+
+	hdr.version = binary.BigEndian.Uint16(data[4:6])
+	hdr.flags = binary.BigEndian.Uint16(data[6:8])
+
+	switch hdr.version {
+	case 1:
+		return hdr, data[headerLengthV1:], nil
+	case formatVersion:
+	default:
+		return hdr, nil, xerrors.Errorf("%w: unknown format version %d", ErrCorrupted, hdr.version)
+	}
+
+	if len(data) < headerLength {
+		return hdr, nil, xerrors.Errorf("%w: header is incomplete", ErrTruncated)
+	}
+
+	sum := binary.BigEndian.Uint32(data[headerLength-checksumLength : headerLength])
+	if crc32.Checksum(data[:headerLength-checksumLength], castagnoli) != sum {
+		return hdr, nil, xerrors.Errorf("%w: header checksum mismatch", ErrCorrupted)
+	}
+
+	length := binary.BigEndian.Uint64(data[8:16])
+	if length > uint64(len(data)-headerLength) {
+		return hdr, nil, xerrors.Errorf("%w: expected %d bytes of data but got %d",
+			ErrTruncated, length, len(data)-headerLength)
+	}
+
+	return hdr, data[headerLength : headerLength+int(length)], nil
+}
+
+// decodeBody decodes the buckets, which must be sorted. When checksums are
+// present, the body must contain exactly the buckets.
+func decodeBody(body []byte, flags uint16) (map[string]*dpBucket, error) {
+	br, err := newBodyReader(body, flags)
+	if err != nil {
+		return nil, xerrors.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	db := make(map[string]*dpBucket)
+	prev := ""
+
+	for {
+		name, bucket, keys, err := br.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("%w: %v", ErrCorrupted, err)
+		}
+
+		if len(db) > 0 && name <= prev {
+			return nil, xerrors.Errorf("%w: bucket %q is out of order", ErrCorrupted, name)
+		}
+
+		if !slices.Equal(keys, bucket.idx.keys()) {
+			return nil, xerrors.Errorf("%w: keys of bucket %q are out of order", ErrCorrupted, name)
+		}
+
+		db[name] = bucket
+		prev = name
+	}
+
+	if flags&flagChecksums != 0 && br.remaining() > 0 {
+		return nil, xerrors.Errorf("%w: %d unexpected bytes after the buckets",
+			ErrCorrupted, br.remaining())
+	}
+
+	return db, nil
+}
+
+// errManifest is returned when buckets are expected but the file is the
+// manifest of a sharded database.
+var errManifest = errors.New("file is the manifest of a sharded database")
+
+// errChecksum is returned by the body reader when a bucket could be read but
+// its checksum does not match.
+var errChecksum = errors.New("checksum mismatch")
+
+// bodyReader reads the buckets of a body one after the other.
+type bodyReader struct {
+	body  []byte
+	r     *bytes.Reader
+	flags uint16
+	count uint64
+	read  uint64
+}
+
+func newBodyReader(body []byte, flags uint16) (*bodyReader, error) {
+	r := bytes.NewReader(body)
+
+	count, err := readUvarint(r)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read number of buckets: %v", err)
+	}
+
+	br := &bodyReader{
+		body:  body,
+		r:     r,
+		flags: flags,
+		count: count,
+	}
+
+	return br, nil
+}
+
+// next returns the next bucket with its keys in the order of the file, or
+// io.EOF after the last one. A bucket with a wrong checksum is returned along
+// with an error wrapping errChecksum, and the reader can continue. Any other
+// error means the rest of the body cannot be read.
+func (br *bodyReader) next() (string, *dpBucket, []string, error) {
+	if br.read == br.count {
+		return "", nil, nil, io.EOF
+	}
+
+	br.read++
+	start := len(br.body) - br.r.Len()
+
+	name, bucket, keys, err := readBucket(br.r)
+	if err != nil {
+		return "", nil, nil, xerrors.Errorf("failed to read bucket #%d: %v", br.read-1, err)
+	}
+
+	if br.flags&flagChecksums != 0 {
+		end := len(br.body) - br.r.Len()
+
+		err = verifyChecksum(br.body[start:end], br.r)
+		if errors.Is(err, errChecksum) {
+			return name, bucket, keys, xerrors.Errorf("%w for bucket %q", errChecksum, name)
+		}
+		if err != nil {
+			return "", nil, nil, xerrors.Errorf("bucket %q: %v", name, err)
+		}
+	}
+
+	return name, bucket, keys, nil
+}
+
+// remaining returns the number of bytes left after the last bucket read.
+func (br *bodyReader) remaining() int {
+	return br.r.Len()
+}
+
+// verifyChecksum reads the checksum from the reader and compares it with the
+// checksum of the section.
+func verifyChecksum(section []byte, rd *bytes.Reader) error {
+	var sum uint32
+
+	err := binary.Read(rd, binary.BigEndian, &sum)
+	if err != nil {
+		return xerrors.Errorf("failed to read checksum: %v", err)
+	}
+
+	if crc32.Checksum(section, castagnoli) != sum {
+		return errChecksum
+	}
+
+	return nil
+}
+
+// readBucket reads a bucket and returns its name, its content and its keys in
+// the order of the file. On error, the pairs read so far are returned with it.
+func readBucket(r *bytes.Reader) (string, *dpBucket, []string, error) {
+	name, err := readBytes(r)
+	if err != nil {
+		return "", nil, nil, xerrors.Errorf("failed to read bucket name: %v", err)
+	}
+
+	bucket := &dpBucket{Kv: make(kv)}
+
+	count, err := readUvarint(r)
+	if err != nil {
+		return string(name), bucket, nil, xerrors.Errorf("failed to read number of keys: %v", err)
+	}
+
+	keys := make([]string, 0, min(count, uint64(r.Len())))
+
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes(r)
+		if err != nil {
+			bucket.updateIndex()
+			return string(name), bucket, keys, xerrors.Errorf("failed to read key: %v", err)
+		}
+
+		value, err := readBytes(r)
+		if err != nil {
+			bucket.updateIndex()
+			return string(name), bucket, keys, xerrors.Errorf("failed to read value: %v", err)
+		}
+
+		// an empty value is read as it is set, which is never nil
+		if value == nil {
+			value = []byte{}
+		}
+
+		bucket.Kv[string(key)] = value
+		keys = append(keys, string(key))
+	}
+
+	bucket.updateIndex()
+
+	return string(name), bucket, keys, nil
+}
+
+// decodeLegacy decodes the gob encoding of version 0.
+func decodeLegacy(data []byte) (map[string]*dpBucket, error) {
+	db := make(map[string]*dpBucket)
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&db)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, xerrors.Errorf("%w: failed to decode gob: %v", ErrTruncated, err)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("%w: failed to decode gob: %v", ErrCorrupted, err)
+	}
+
+	for _, bucket := range db {
+		if bucket.Kv == nil {
+			bucket.Kv = make(kv)
+		}
+
+		bucket.updateIndex()
+	}
+
+	return db, nil
+}
+
+// uvarintLength returns the number of bytes of the value as a uvarint.
+func uvarintLength(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+
+	return n
+}
+
+// bytesLength returns the number of bytes of data of the given length with its
+// length prefix.
+func bytesLength(n int) int {
+	return uvarintLength(uint64(n)) + n
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	writeUvarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func readUvarint(r *bytes.Reader) (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to read varint: %v", err)
+	}
+
+	return v, nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	length, err := readUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > uint64(r.Len()) {
+		return nil, xerrors.Errorf("length %d exceeds the remaining %d bytes", length, r.Len())
+	}
+
+	if length == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read bytes: %v", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,256 @@
+package purbkv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat_RoundTrip(t *testing.T) {
+	db := map[string]*dpBucket{
+		"A": makeBucket("ping", "pong", "empty", ""),
+		"B": makeBucket(),
+	}
+
+	data := encodeBuckets(db, flagChecksums)
+
+	decoded, err := decodeBuckets(data.Bytes())
+	require.NoError(t, err)
+	require.Len(t, decoded, 2)
+	require.Equal(t, []byte("pong"), decoded["A"].Kv["ping"])
+	require.Equal(t, []byte{}, decoded["A"].Kv["empty"])
+	require.Equal(t, []string{"empty", "ping"}, decoded["A"].idx.keys())
+	require.Empty(t, decoded["B"].Kv)
+}
+
+func TestFormat_Deterministic(t *testing.T) {
+	first := map[string]*dpBucket{
+		"A": makeBucket("1", "a", "2", "b", "3", "c"),
+		"B": makeBucket("x", "y"),
+	}
+
+	second := map[string]*dpBucket{
+		"B": makeBucket("x", "y"),
+		"A": makeBucket("3", "c", "1", "a", "2", "b"),
+	}
+
+	require.Equal(t, encodeBuckets(first, flagChecksums).Bytes(), encodeBuckets(second, flagChecksums).Bytes())
+}
+
+func TestFormat_Header(t *testing.T) {
+	data := encodeBuckets(map[string]*dpBucket{}, flagChecksums).Bytes()
+
+	require.Len(t, data, headerLength+1)
+	require.Equal(t, []byte("PKVD\x00\x02\x00\x01"), data[:8])
+	require.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1}, data[8:16])
+}
+
+func TestFormat_Version1(t *testing.T) {
+	data := []byte("PKVD\x00\x01\x00\x00\x01\x01A\x01\x04ping\x04pong")
+
+	decoded, err := decodeBuckets(data)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), decoded["A"].Kv["ping"])
+}
+
+func TestFormat_IgnorePadding(t *testing.T) {
+	data := encodeBuckets(map[string]*dpBucket{"A": makeBucket("ping", "pong")}, 0)
+	data.Write(make([]byte, 100))
+
+	decoded, err := decodeBuckets(data.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), decoded["A"].Kv["ping"])
+}
+
+func TestFormat_Legacy(t *testing.T) {
+	legacy := map[string]*dpBucket{"A": makeBucket("ping", "pong")}
+
+	var data bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&data).Encode(legacy))
+
+	decoded, err := decodeBuckets(data.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), decoded["A"].Kv["ping"])
+	require.Equal(t, []string{"ping"}, decoded["A"].idx.keys())
+
+	_, err = decodeBuckets([]byte("\x03abc"))
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	_, err = decodeBuckets(data.Bytes()[:data.Len()-2])
+	require.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestFormat_OpenLegacyFile(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var data bytes.Buffer
+	err = gob.NewEncoder(&data).Encode(map[string]*dpBucket{"bucket": makeBucket("ping", "pong")})
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, kvFileName), data.Bytes(), filePerm)
+	require.NoError(t, err)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+
+	// the next commit upgrades the file to the current format
+	setValue(t, db, []byte("A"), []byte("B"))
+
+	raw, err := os.ReadFile(filepath.Join(dir, kvFileName))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(raw, formatMagic))
+
+	err = db.View(func(txn ReadableTx) error {
+		value, err := txn.GetBucket([]byte("bucket")).Get([]byte("ping"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("pong"), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestFormat_EncodedLength(t *testing.T) {
+	large := &dpBucket{Kv: make(kv)}
+	for i := 0; i < 200; i++ {
+		large.Kv[fmt.Sprintf("key%03d", i)] = make([]byte, i)
+	}
+
+	large.updateIndex()
+
+	// a staged bucket is read through its changes
+	overlay := newTxBucket(large)
+	require.NoError(t, overlay.Set([]byte("new"), make([]byte, 300)))
+	require.NoError(t, overlay.Delete([]byte("key000")))
+
+	dbs := []map[string]*dpBucket{
+		{},
+		{"": makeBucket()},
+		{"A": makeBucket("ping", "pong"), "large": large},
+		{"staged": overlay.staged()},
+	}
+
+	for _, db := range dbs {
+		for _, flags := range []uint16{0, flagChecksums} {
+			length := encodedLength(db, flags)
+
+			data := encodeBuckets(db, flags)
+			require.Equal(t, length, data.Len())
+			require.Equal(t, length, data.Cap())
+
+			decoded, err := decodeBuckets(data.Bytes())
+			require.NoError(t, err)
+			require.Len(t, decoded, len(db))
+		}
+	}
+}
+
+func TestFormat_Errors(t *testing.T) {
+	_, err := decodeBuckets(nil)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	_, err = decodeBuckets([]byte("PKVD\x00"))
+	require.ErrorIs(t, err, ErrTruncated)
+
+	_, err = decodeBuckets([]byte("PKVD\x00\x09\x00\x00\x00"))
+	require.ErrorIs(t, err, ErrCorrupted)
+	require.ErrorContains(t, err, "unknown format version 9")
+
+	db := map[string]*dpBucket{"A": makeBucket("ping", "pong")}
+	data := encodeBuckets(db, flagChecksums).Bytes()
+
+	_, err = decodeBuckets(data[:headerLength-1])
+	require.ErrorIs(t, err, ErrTruncated)
+
+	_, err = decodeBuckets(data[:len(data)-2])
+	require.ErrorIs(t, err, ErrTruncated)
+
+	for _, i := range []int{10, headerLength + 6, len(data) - 1} {
+		corrupted := append([]byte{}, data...)
+		corrupted[i] ^= 0xff
+
+		_, err = decodeBuckets(corrupted)
+		require.ErrorIs(t, err, ErrCorrupted, "byte %d", i)
+	}
+
+	_, err = decodeBuckets(data[:len(data)-1])
+	require.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestFormat_OpenDamagedFile(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("ping"), []byte("pong"))
+	require.NoError(t, db.Close())
+
+	path := filepath.Join(dir, kvFileName)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, data[:len(data)-3], filePerm))
+	_, err = NewDB(dir, false)
+	require.ErrorIs(t, err, ErrTruncated)
+
+	data[len(data)-6] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, filePerm))
+	_, err = NewDB(dir, false)
+	require.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestFormat_OpenEmptyFile(t *testing.T) {
+	for _, purbIsOn := range []bool{false, true} {
+		dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		// the first versions created the file before the first commit
+		path := filepath.Join(dir, dbFileName(purbIsOn))
+		require.NoError(t, os.WriteFile(path, nil, filePerm))
+
+		// it is still reported as a problem of the file
+		report, err := Verify(dir, purbIsOn)
+		require.NoError(t, err)
+		require.Len(t, report.Problems, 1)
+		require.ErrorIs(t, report.Problems[0].Err, ErrEmpty)
+
+		db, err := NewDB(dir, purbIsOn)
+		require.NoError(t, err)
+
+		setValue(t, db, []byte("ping"), []byte("pong"))
+		require.NoError(t, db.Close())
+
+		db, err = NewDB(dir, purbIsOn)
+		require.NoError(t, err)
+
+		requireValue(t, db, "bucket", "ping", "pong")
+		require.NoError(t, db.Close())
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// makeBucket creates a bucket from a list of keys and values.
+func makeBucket(pairs ...string) *dpBucket {
+	b := &dpBucket{Kv: make(kv)}
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		b.Kv[pairs[i]] = []byte(pairs[i+1])
+	}
+
+	b.updateIndex()
+
+	return b
+}
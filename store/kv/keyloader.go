@@ -2,11 +2,13 @@ package purbkv
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"go.dedis.ch/kyber/v3/group/curve25519"
 	"go.dedis.ch/kyber/v3/util/key"
 	"golang.org/x/xerrors"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -15,24 +17,32 @@ import (
 // - implements loader.Loader
 type fileLoader struct {
 	path string
+	// strict makes Load refuse a key file accessible by other users
+	strict bool
 
-	openFileFn func(path string, flags int, perms os.FileMode) (*os.File, error)
-	statFn     func(path string) (os.FileInfo, error)
+	fsys FileSystem
 }
 
 // NewKeyLoader creates a new key file loader using the given file path.
 func NewKeysLoader(path string) fileLoader {
 	return fileLoader{
-		path:       path,
-		openFileFn: os.OpenFile,
-		statFn:     os.Stat,
+		path:   path,
+		strict: true,
+		fsys:   osFS{},
 	}
 }
 
 // Load loads the keys from the file if it exists,
 // otherwise it returns an error.
 func (l fileLoader) Load(keypair *[]key.Pair) error {
-	file, err := l.openFileFn(l.path, os.O_RDONLY, 0400)
+	if l.strict {
+		err := l.Verify()
+		if err != nil {
+			return xerrors.Errorf("insecure key file: %v", err)
+		}
+	}
+
+	file, err := l.fsys.OpenFile(l.path, os.O_RDONLY, 0400)
 	if err != nil {
 		return xerrors.Errorf("while opening file: %v", err)
 	}
@@ -67,6 +77,7 @@ func (l fileLoader) Load(keypair *[]key.Pair) error {
 		}
 
 		err = kp.Private.UnmarshalBinary(privk)
+		wipe(privk)
 		if err != nil {
 			return xerrors.Errorf("while unmarshaling privk in %v: %v", line, err)
 		}
@@ -85,8 +96,20 @@ func (l fileLoader) Load(keypair *[]key.Pair) error {
 	return nil
 }
 
-// Save the keys to the file in path,
-// otherwise it returns an error
+// Exists returns true if the key file is present on disk.
+func (l fileLoader) Exists() bool {
+	_, err := l.fsys.Stat(l.path)
+	return err == nil
+}
+
+// Verify checks that the key file is only accessible by its owner. It returns
+// nil if the file does not exist.
+func (l fileLoader) Verify() error {
+	return verifyPrivate(l.path, l.fsys.Stat)
+}
+
+// Save the keys to the file in path, which is replaced at once so that the
+// keys are never partially written, otherwise it returns an error
 func (l fileLoader) Save(keypair *[]key.Pair) error {
 	if keypair == nil {
 		return xerrors.Errorf("keypair is nil")
@@ -96,11 +119,8 @@ func (l fileLoader) Save(keypair *[]key.Pair) error {
 		return xerrors.Errorf("number of keys is 0")
 	}
 
-	file, err := l.openFileFn(l.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return xerrors.Errorf("while creating file: %v", err)
-	}
-	defer file.Close()
+	var buf bytes.Buffer
+	defer func() { wipe(buf.Bytes()) }()
 
 	for _, k := range *keypair {
 		pubk, err := k.Public.MarshalBinary()
@@ -114,15 +134,21 @@ func (l fileLoader) Save(keypair *[]key.Pair) error {
 			return xerrors.Errorf("while marshaling privk: %v", err)
 		}
 		privkString := base64.URLEncoding.EncodeToString(privk)
+		wipe(privk)
 
-		_, err = file.WriteString(pubkString + ":" + privkString + "\n")
-		if err != nil {
-			return xerrors.Errorf("while writing pubk:privk {%v:%v} to disk: %v", pubkString, privkString, err)
-		}
+		buf.WriteString(pubkString + ":" + privkString + "\n")
+	}
+
+	// the temporary file is only accessible by the owner
+	err := writeFileAtomic(l.fsys, l.path, buf.Bytes())
+	if err != nil {
+		return xerrors.Errorf("while writing keys to disk: %v", err)
 	}
 
+	// the database cannot be read without its keys
+	err = syncDir(l.fsys, filepath.Dir(l.path))
 	if err != nil {
-		return xerrors.Errorf("while encoding: %v", err)
+		return xerrors.Errorf("while syncing keys to disk: %v", err)
 	}
 
 	return nil
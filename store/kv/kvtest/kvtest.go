@@ -0,0 +1,654 @@
+// Package kvtest provides a conformance suite for implementations of the
+// key/value interfaces of purbkv.
+//
+// An implementation runs the suite from one of its tests:
+//
+//	func TestConformance(t *testing.T) {
+//		kvtest.Run(t, func(dir string) (purbkv.DB, error) {
+//			return mydb.Open(dir)
+//		})
+//	}
+package kvtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/purb-db/store/kv"
+)
+
+// Opener opens the database stored in the directory, and creates it if the
+// directory is empty. It is called again on the same directory to check that
+// the content persists.
+type Opener func(dir string) (purbkv.DB, error)
+
+// suiteTemplate contains the parameters of the suite.
+type suiteTemplate struct {
+	persistent bool
+}
+
+// Option is the type of option to set some fields of the suite.
+type Option func(*suiteTemplate)
+
+// WithoutPersistence is an option to skip the checks of the content after the
+// database is reopened, for implementations that only keep it in memory.
+func WithoutPersistence() Option {
+	return func(tmpl *suiteTemplate) {
+		tmpl.persistent = false
+	}
+}
+
+// errCallback is returned by the callbacks of the suite to check that errors
+// are returned as is.
+var errCallback = errors.New("callback error")
+
+var bucketName = []byte("bucket")
+
+// Run runs the conformance suite on the databases opened by the function.
+func Run(t *testing.T, open Opener, opts ...Option) {
+	tmpl := suiteTemplate{
+		persistent: true,
+	}
+
+	for _, opt := range opts {
+		opt(&tmpl)
+	}
+
+	s := suite{open: open, tmpl: tmpl}
+
+	t.Run("GetBucket", s.testGetBucket)
+	t.Run("GetBucketOrCreate", s.testGetBucketOrCreate)
+	t.Run("GetSetDelete", s.testGetSetDelete)
+	t.Run("SetCopiesValue", s.testSetCopiesValue)
+	t.Run("Order", s.testOrder)
+	t.Run("Scan", s.testScan)
+	t.Run("CallbackError", s.testCallbackError)
+	t.Run("ModifyWhileIterating", s.testModifyWhileIterating)
+	t.Run("Rollback", s.testRollback)
+	t.Run("Isolation", s.testIsolation)
+	t.Run("ViewDiscardsChanges", s.testViewDiscardsChanges)
+	t.Run("OnCommit", s.testOnCommit)
+	t.Run("ConcurrentUpdates", s.testConcurrentUpdates)
+	t.Run("Persistence", s.testPersistence)
+	t.Run("Closed", s.testClosed)
+}
+
+type suite struct {
+	open Opener
+	tmpl suiteTemplate
+}
+
+func (s suite) testGetBucket(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	err := db.View(func(txn purbkv.ReadableTx) error {
+		require.Nil(t, txn.GetBucket(bucketName))
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(txn purbkv.WritableTx) error {
+		require.Nil(t, txn.GetBucket(bucketName))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func (s suite) testGetBucketOrCreate(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		_, err := txn.GetBucketOrCreate(nil)
+		require.Error(t, err)
+
+		_, err = txn.GetBucketOrCreate([]byte{})
+		require.Error(t, err)
+
+		b, err := txn.GetBucketOrCreate(bucketName)
+		require.NoError(t, err)
+		require.NoError(t, b.Set([]byte("ping"), []byte("pong")))
+
+		// the bucket is visible in the transaction that created it
+		require.NotNil(t, txn.GetBucket(bucketName))
+
+		b, err = txn.GetBucketOrCreate(bucketName)
+		require.NoError(t, err)
+		requireGet(t, b, "ping", "pong")
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(txn purbkv.ReadableTx) error {
+		requireGet(t, txn.GetBucket(bucketName), "ping", "pong")
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func (s suite) testGetSetDelete(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		b, err := txn.GetBucketOrCreate(bucketName)
+		require.NoError(t, err)
+
+		value, err := b.Get([]byte("ping"))
+		require.Error(t, err)
+		require.Nil(t, value)
+
+		require.NoError(t, b.Set([]byte("ping"), []byte("pong")))
+		requireGet(t, b, "ping", "pong")
+
+		require.NoError(t, b.Set([]byte("ping"), []byte("PONG")))
+		requireGet(t, b, "ping", "PONG")
+
+		require.NoError(t, b.Set([]byte("empty"), nil))
+		value, err = b.Get([]byte("empty"))
+		require.NoError(t, err)
+		require.Empty(t, value)
+
+		require.NoError(t, b.Delete([]byte("ping")))
+		_, err = b.Get([]byte("ping"))
+		require.Error(t, err)
+
+		require.NoError(t, b.Delete([]byte("ping")))
+		require.NoError(t, b.Delete([]byte("unknown")))
+
+		require.NoError(t, b.Set([]byte("deleted"), []byte("value")))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(txn purbkv.WritableTx) error {
+		b := txn.GetBucket(bucketName)
+		require.NotNil(t, b)
+
+		return b.Delete([]byte("deleted"))
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"empty"}, keys(t, db))
+}
+
+func (s suite) testSetCopiesValue(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	key := []byte("ping")
+	value := []byte("pong")
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		b, err := txn.GetBucketOrCreate(bucketName)
+		require.NoError(t, err)
+
+		err = b.Set(key, value)
+		require.NoError(t, err)
+
+		key[0] = 'x'
+		value[0] = 'x'
+
+		requireGet(t, b, "ping", "pong")
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(txn purbkv.ReadableTx) error {
+		requireGet(t, txn.GetBucket(bucketName), "ping", "pong")
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func (s suite) testOrder(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	// keys are ordered by bytes, not by length or as UTF-8 strings
+	expected := []string{"", "\x00", "\x00\x00", "\x01", "a", "ab", "b", "\x7f", "é", "\xff"}
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		b, err := txn.GetBucketOrCreate(bucketName)
+		require.NoError(t, err)
+
+		for i := len(expected) - 1; i >= 0; i-- {
+			require.NoError(t, b.Set([]byte(expected[i]), []byte(expected[i])))
+		}
+
+		// the order is kept before the commit
+		require.Equal(t, expected, collect(t, b.ForEach))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(txn purbkv.ReadableTx) error {
+		b := txn.GetBucket(bucketName)
+
+		require.Equal(t, expected, collect(t, b.ForEach))
+		require.Equal(t, expected, collect(t, func(fn func(k, v []byte) error) error {
+			return b.Scan(nil, fn)
+		}))
+
+		return b.ForEach(func(k, v []byte) error {
+			require.Equal(t, k, v)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func (s suite) testScan(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		b, err := txn.GetBucketOrCreate(bucketName)
+		require.NoError(t, err)
+
+		for _, k := range []string{"b", "ab", "a", "aa", "c", "abc"} {
+			require.NoError(t, b.Set([]byte(k), []byte(k)))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(txn purbkv.ReadableTx) error {
+		b := txn.GetBucket(bucketName)
+
+		scan := func(prefix string) []string {
+			return collect(t, func(fn func(k, v []byte) error) error {
+				return b.Scan([]byte(prefix), fn)
+			})
+		}
+
+		require.Equal(t, []string{"a", "aa", "ab", "abc"}, scan("a"))
+		require.Equal(t, []string{"ab", "abc"}, scan("ab"))
+		require.Equal(t, []string{"a", "aa", "ab", "abc", "b", "c"}, scan(""))
+		require.Empty(t, scan("d"))
+		require.Empty(t, scan("abcd"))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func (s suite) testCallbackError(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	fill(t, db, "a", "b", "c")
+
+	err := db.View(func(txn purbkv.ReadableTx) error {
+		b := txn.GetBucket(bucketName)
+
+		calls := 0
+		err := b.ForEach(func(k, v []byte) error {
+			calls++
+			return errCallback
+		})
+		require.ErrorIs(t, err, errCallback)
+		require.Equal(t, 1, calls)
+
+		calls = 0
+		err = b.Scan(nil, func(k, v []byte) error {
+			calls++
+			return errCallback
+		})
+		require.ErrorIs(t, err, errCallback)
+		require.Equal(t, 1, calls)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(purbkv.ReadableTx) error {
+		return errCallback
+	})
+	require.ErrorIs(t, err, errCallback)
+}
+
+func (s suite) testModifyWhileIterating(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	committed := make([]string, 200)
+	for i := range committed {
+		committed[i] = fmt.Sprintf("key%03d", i)
+	}
+
+	fill(t, db, committed...)
+
+	visited := []string{}
+
+	// the keys set by the callback are not visited
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		b := txn.GetBucket(bucketName)
+
+		return b.ForEach(func(k, v []byte) error {
+			visited = append(visited, string(k))
+			return b.Set(append(k, '+'), v)
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, committed, visited)
+	require.Len(t, keys(t, db), 2*len(committed))
+
+	visited = []string{}
+
+	// the keys deleted by the callback, the current one or the next ones, are
+	// not visited
+	err = db.Update(func(txn purbkv.WritableTx) error {
+		b := txn.GetBucket(bucketName)
+
+		return b.Scan([]byte("key"), func(k, v []byte) error {
+			visited = append(visited, string(k))
+
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+
+			return b.Delete(append(k, '+'))
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, committed, visited)
+	require.Empty(t, keys(t, db))
+
+	visited = []string{}
+
+	// the keys set by the transaction are deleted as well
+	err = db.Update(func(txn purbkv.WritableTx) error {
+		b := txn.GetBucket(bucketName)
+
+		for _, k := range committed {
+			err := b.Set([]byte(k), []byte(k))
+			if err != nil {
+				return err
+			}
+		}
+
+		err := b.Scan(nil, func(k, v []byte) error {
+			visited = append(visited, string(k))
+			return b.Delete(k)
+		})
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			return fmt.Errorf("key %s is not deleted", k)
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, committed, visited)
+	require.Empty(t, keys(t, db))
+}
+
+func (s suite) testRollback(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	fill(t, db, "a")
+
+	called := false
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		txn.OnCommit(func() { called = true })
+
+		b := txn.GetBucket(bucketName)
+		require.NoError(t, b.Set([]byte("a"), []byte("changed")))
+		require.NoError(t, b.Set([]byte("b"), []byte("b")))
+
+		other, err := txn.GetBucketOrCreate([]byte("other"))
+		require.NoError(t, err)
+		require.NoError(t, other.Set([]byte("key"), []byte("value")))
+
+		return errCallback
+	})
+	require.ErrorIs(t, err, errCallback)
+	require.False(t, called)
+
+	err = db.View(func(txn purbkv.ReadableTx) error {
+		require.Nil(t, txn.GetBucket([]byte("other")))
+		requireGet(t, txn.GetBucket(bucketName), "a", "a")
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"a"}, keys(t, db))
+}
+
+func (s suite) testIsolation(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	fill(t, db, "a")
+
+	seen := make(chan []string)
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		b := txn.GetBucket(bucketName)
+		require.NoError(t, b.Set([]byte("b"), []byte("b")))
+		require.NoError(t, b.Delete([]byte("a")))
+
+		// reads its own writes
+		require.Equal(t, []string{"b"}, collect(t, b.ForEach))
+
+		// a concurrent view only sees the committed state
+		go func() {
+			seen <- keys(t, db)
+		}()
+
+		require.Equal(t, []string{"a"}, <-seen)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"b"}, keys(t, db))
+}
+
+func (s suite) testViewDiscardsChanges(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	fill(t, db, "a")
+
+	// a read-only transaction may refuse the change or ignore it
+	_ = db.View(func(txn purbkv.ReadableTx) error {
+		b := txn.GetBucket(bucketName)
+
+		_ = b.Set([]byte("b"), []byte("b"))
+		_ = b.Delete([]byte("a"))
+
+		return nil
+	})
+
+	require.Equal(t, []string{"a"}, keys(t, db))
+}
+
+func (s suite) testOnCommit(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	var calls []string
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		b, err := txn.GetBucketOrCreate(bucketName)
+		require.NoError(t, err)
+		require.NoError(t, b.Set([]byte("a"), []byte("a")))
+
+		txn.OnCommit(func() {
+			// the changes are committed and the database can be read
+			require.Equal(t, []string{"a"}, keys(t, db))
+			calls = append(calls, "first")
+		})
+
+		txn.OnCommit(func() {
+			calls = append(calls, "second")
+		})
+
+		require.Empty(t, calls)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"first", "second"}, calls)
+}
+
+func (s suite) testConcurrentUpdates(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	fill(t, db)
+
+	const n = 20
+
+	wg := sync.WaitGroup{}
+	wg.Add(n)
+
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			errs <- db.Update(func(txn purbkv.WritableTx) error {
+				b := txn.GetBucket(bucketName)
+				if b == nil {
+					return errors.New("missing bucket")
+				}
+
+				return b.Set([]byte{byte(i)}, []byte{byte(i)})
+			})
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Len(t, keys(t, db), n)
+}
+
+func (s suite) testPersistence(t *testing.T) {
+	if !s.tmpl.persistent {
+		t.Skip("database is not persistent")
+	}
+
+	db, dir := s.newDB(t)
+
+	fill(t, db, "a", "b", "c")
+
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		_, err := txn.GetBucketOrCreate([]byte("empty"))
+		require.NoError(t, err)
+
+		return txn.GetBucket(bucketName).Delete([]byte("b"))
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Close())
+
+	db, err = s.open(dir)
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	require.Equal(t, []string{"a", "c"}, keys(t, db))
+
+	err = db.View(func(txn purbkv.ReadableTx) error {
+		require.NotNil(t, txn.GetBucket([]byte("empty")))
+		requireGet(t, txn.GetBucket(bucketName), "c", "c")
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func (s suite) testClosed(t *testing.T) {
+	db, _ := s.newDB(t)
+
+	require.NoError(t, db.Close())
+
+	err := db.View(func(purbkv.ReadableTx) error { return nil })
+	require.Error(t, err)
+
+	err = db.Update(func(purbkv.WritableTx) error { return nil })
+	require.Error(t, err)
+}
+
+// newDB opens a database in a new directory, which is removed at the end of
+// the test.
+func (s suite) newDB(t *testing.T) (purbkv.DB, string) {
+	dir, err := os.MkdirTemp(os.TempDir(), "kvtest")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := s.open(dir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { db.Close() })
+
+	return db, dir
+}
+
+// fill creates the bucket with the keys, each set to itself.
+func fill(t *testing.T, db purbkv.DB, keys ...string) {
+	err := db.Update(func(txn purbkv.WritableTx) error {
+		b, err := txn.GetBucketOrCreate(bucketName)
+		require.NoError(t, err)
+
+		for _, k := range keys {
+			require.NoError(t, b.Set([]byte(k), []byte(k)))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// keys returns the committed keys of the bucket.
+func keys(t *testing.T, db purbkv.DB) []string {
+	var res []string
+
+	err := db.View(func(txn purbkv.ReadableTx) error {
+		b := txn.GetBucket(bucketName)
+		if b == nil {
+			return nil
+		}
+
+		res = collect(t, b.ForEach)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	return res
+}
+
+// collect returns the keys visited by the iteration.
+func collect(t *testing.T, iterate func(fn func(k, v []byte) error) error) []string {
+	res := []string{}
+
+	err := iterate(func(k, v []byte) error {
+		res = append(res, string(k))
+		return nil
+	})
+	require.NoError(t, err)
+
+	return res
+}
+
+func requireGet(t *testing.T, b purbkv.Bucket, key, value string) {
+	require.NotNil(t, b)
+
+	v, err := b.Get([]byte(key))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal([]byte(value), v), "expected %q, got %q", value, v)
+}
@@ -0,0 +1,330 @@
+package purbkv
+
+import (
+	"slices"
+	"sync"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/xerrors"
+)
+
+// shardCache holds the buckets of the shards of a lazily loaded database, and
+// the pages of a paged one. A shard is read the first time one of its buckets
+// is accessed, a page the first time it is accessed, and the least recently
+// used shards and pages are evicted when they exceed the memory budget. The
+// cache only holds what is saved, so that an evicted shard or page can always
+// be read again.
+type shardCache struct {
+	sync.Mutex
+
+	// manifest is the one of the saved state, which is not always the one of
+	// the database as it is updated before the cache during a save
+	manifest *manifest
+	read     func(m *manifest, shard int) (map[string]*dpBucket, error)
+	readPage func(ref pageRef) (map[string]*dpBucket, error)
+	// budget is the number of bytes of the buckets above which shards and
+	// pages are evicted, or zero to never evict them
+	budget int
+	shards map[int]*cachedShard
+	// pages hold the page of a paged database as the bucket with the empty
+	// name, like its file
+	pages map[pageRef]*cachedShard
+	size  int
+	clock uint64
+}
+
+// cachedShard is a shard, or a page, that is read.
+type cachedShard struct {
+	buckets map[string]*dpBucket
+	size    int
+	used    uint64
+}
+
+func newShardCache(m *manifest, budget int,
+	read func(*manifest, int) (map[string]*dpBucket, error),
+	readPage func(pageRef) (map[string]*dpBucket, error)) *shardCache {
+
+	return &shardCache{
+		manifest: m,
+		read:     read,
+		readPage: readPage,
+		budget:   budget,
+		shards:   make(map[int]*cachedShard),
+		pages:    make(map[pageRef]*cachedShard),
+	}
+}
+
+// get returns the saved bucket, or nil if it does not exist.
+func (c *shardCache) get(name string) (*dpBucket, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	s, err := c.load(c.manifest.shardOf(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.buckets[name], nil
+}
+
+// shard returns the saved buckets of the shard. They must not be modified.
+func (c *shardCache) shard(i int) (map[string]*dpBucket, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	s, err := c.load(i)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.buckets, nil
+}
+
+// page returns the saved page. It must not be modified.
+func (c *shardCache) page(ref pageRef) (*dpBucket, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.clock++
+
+	s, found := c.pages[ref]
+	if !found {
+		buckets, err := c.readPage(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		s = c.add(buckets)
+		c.pages[ref] = s
+		c.evict(s)
+	}
+
+	s.used = c.clock
+
+	return s.buckets[""], nil
+}
+
+// count returns the number of shards.
+func (c *shardCache) count() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return len(c.manifest.shards)
+}
+
+// update replaces the shards written by a save with their new buckets, adds
+// the pages it wrote and removes the ones it replaced.
+func (c *shardCache) update(m *manifest, groups map[int]map[string]*dpBucket, pages map[pageRef]*dpBucket) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.manifest = m
+
+	for i, buckets := range groups {
+		c.dropShard(i)
+		c.shards[i] = c.add(buckets)
+	}
+
+	for _, ref := range m.stalePages {
+		c.dropPage(ref)
+	}
+
+	for ref, page := range pages {
+		c.dropPage(ref)
+		c.pages[ref] = c.add(map[string]*dpBucket{"": page})
+	}
+
+	c.evict(nil)
+}
+
+// load returns the shard, after it is read if it is not in the cache.
+func (c *shardCache) load(i int) (*cachedShard, error) {
+	c.clock++
+
+	s, found := c.shards[i]
+	if !found {
+		buckets, err := c.read(c.manifest, i)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read shard #%d: %w", i, err)
+		}
+
+		s = c.add(buckets)
+		c.shards[i] = s
+		c.evict(s)
+	}
+
+	s.used = c.clock
+
+	return s, nil
+}
+
+func (c *shardCache) add(buckets map[string]*dpBucket) *cachedShard {
+	s := &cachedShard{
+		buckets: buckets,
+		size:    bucketsSize(buckets),
+		used:    c.clock,
+	}
+
+	c.size += s.size
+
+	return s
+}
+
+func (c *shardCache) dropShard(i int) {
+	s, found := c.shards[i]
+	if found {
+		c.size -= s.size
+		delete(c.shards, i)
+	}
+}
+
+func (c *shardCache) dropPage(ref pageRef) {
+	s, found := c.pages[ref]
+	if found {
+		c.size -= s.size
+		delete(c.pages, ref)
+	}
+}
+
+// evict removes the least recently used shards and pages, except the one to
+// keep, until they fit in the budget. The buckets are not wiped as
+// transactions may still use their values.
+func (c *shardCache) evict(keep *cachedShard) {
+	for c.budget > 0 && c.size > c.budget {
+		var oldest *cachedShard
+		var shard int
+		var page *pageRef
+
+		for i, s := range c.shards {
+			if s != keep && (oldest == nil || s.used < oldest.used) {
+				oldest, shard = s, i
+			}
+		}
+
+		for ref, s := range c.pages {
+			if s != keep && (oldest == nil || s.used < oldest.used) {
+				oldest, page = s, &pageRef{generation: ref.generation, index: ref.index}
+			}
+		}
+
+		switch {
+		case oldest == nil:
+			return
+		case page != nil:
+			c.dropPage(*page)
+		default:
+			c.dropShard(shard)
+		}
+	}
+}
+
+// bucketsSize returns the number of bytes of the names, keys and values of the
+// buckets.
+func bucketsSize(db map[string]*dpBucket) int {
+	size := 0
+
+	for name, bucket := range db {
+		size += len(name)
+
+		for k, v := range bucket.Kv {
+			size += len(k) + len(v)
+		}
+	}
+
+	return size
+}
+
+// readShard reads the buckets of the shard of the manifest.
+func (p *purbDB) readShard(m *manifest, shard int) (map[string]*dpBucket, error) {
+	if m.shards[shard] == 0 {
+		return make(map[string]*dpBucket), nil
+	}
+
+	name := shardName(p.dbName, shard, m.shards[shard])
+
+	buckets, err := p.readBuckets(name)
+	if err != nil {
+		return nil, xerrors.Errorf("shard %s: %w", name, err)
+	}
+
+	for bucket := range buckets {
+		if m.shardOf(bucket) != shard {
+			return nil, xerrors.Errorf("%w: bucket %q is in the wrong shard %s", ErrCorrupted, bucket, name)
+		}
+	}
+
+	return buckets, nil
+}
+
+// allBuckets returns every bucket of the database, or the roots of the buckets
+// of a paged database. The shards of a lazily loaded database are read when
+// they are not in the cache. The caller must hold the lock of the buckets.
+func (p *purbDB) allBuckets() (map[string]*dpBucket, error) {
+	if p.cache == nil {
+		return p.bucketDb.Db, nil
+	}
+
+	db := make(map[string]*dpBucket)
+
+	for i := 0; i < p.cache.count(); i++ {
+		buckets, err := p.cache.shard(i)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, bucket := range buckets {
+			db[name] = bucket
+		}
+	}
+
+	// the changes that are not saved yet
+	for name, bucket := range p.bucketDb.Db {
+		db[name] = bucket
+	}
+
+	return db, nil
+}
+
+// forget removes the saved buckets from the changes of a lazily loaded
+// database, as the cache now holds them. The caller must hold the lock of the
+// updates, so that no bucket changed since it was saved.
+func (p *purbDB) forget() {
+	p.bucketDb.Lock()
+	defer p.bucketDb.Unlock()
+
+	p.bucketDb.Db = make(map[string]*dpBucket)
+	p.bucketDb.pages = pageSet{}
+}
+
+// forEachBucket calls the function with every bucket in the order of their
+// names. The pages of a paged database are read one at a time when the buckets
+// are iterated. The caller must hold the lock of the buckets.
+func (p *purbDB) forEachBucket(fn func(name string, b Bucket) error) error {
+	db, err := p.allBuckets()
+	if err != nil {
+		return err
+	}
+
+	names := maps.Keys(db)
+	slices.Sort(names)
+
+	tx := p.newTx()
+
+	for _, name := range names {
+		var b Bucket = db[name]
+
+		if p.pageSize > 0 {
+			b = tx.getPaged(name)
+			if tx.err != nil {
+				return tx.err
+			}
+		}
+
+		err = fn(name, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
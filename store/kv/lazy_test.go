@@ -0,0 +1,281 @@
+package purbkv
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLazy_Open(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newCountingStore()
+
+	db, err := NewDB(dir, true, WithBlobStore(store), WithShards(8))
+	require.NoError(t, err)
+
+	setBuckets(t, db, "a", "b", "c", "d", "e", "f")
+	require.NoError(t, db.Close())
+
+	store.reset()
+
+	db, err = NewDB(dir, true, WithBlobStore(store), WithLazyLoading())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// only the manifest is read
+	require.Equal(t, []string{purbFileName}, store.reads())
+
+	p := db.(*purbDB)
+	requireValue(t, db, "a", "key", "a")
+
+	shard := p.shards.shardOf("a")
+	require.Equal(t, []string{purbFileName, shardName(purbFileName, shard, p.shards.shards[shard])},
+		store.reads())
+
+	// the shard stays in the cache
+	requireValue(t, db, "a", "key", "a")
+	require.Len(t, store.reads(), 2)
+
+	setBuckets(t, db, "a", "g")
+	requireValue(t, db, "g", "key", "g")
+
+	for _, name := range []string{"b", "c", "d", "e", "f"} {
+		requireValue(t, db, name, "key", name)
+	}
+
+	require.Empty(t, p.bucketDb.Db)
+}
+
+func TestLazy_MemoryBudget(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newCountingStore()
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithShards(16))
+	require.NoError(t, err)
+
+	names := make([]string, 64)
+	for i := range names {
+		names[i] = fmt.Sprintf("bucket%02d", i)
+	}
+
+	setBuckets(t, db, names...)
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, false, WithBlobStore(store), WithMemoryBudget(64))
+	require.NoError(t, err)
+	defer db.Close()
+
+	p := db.(*purbDB)
+
+	for _, name := range names {
+		requireValue(t, db, name, "key", name)
+	}
+
+	// one shard is always kept even when it does not fit
+	require.LessOrEqual(t, len(p.cache.shards), 4)
+	require.True(t, p.cache.size <= 64 || len(p.cache.shards) == 1)
+
+	// an evicted shard is read again
+	store.reset()
+
+	for _, name := range names {
+		requireValue(t, db, name, "key", name)
+	}
+
+	require.NotEmpty(t, store.reads())
+
+	// the root reads every shard
+	root := db.(Prover).Root()
+	require.NotNil(t, root)
+
+	eager, err := NewDB(dir, false, WithBlobStore(store))
+	require.NoError(t, err)
+	defer eager.Close()
+
+	require.Equal(t, eager.(Prover).Root(), root)
+}
+
+func TestLazy_Corrupted(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newCountingStore()
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithShards(2))
+	require.NoError(t, err)
+
+	setBuckets(t, db, "a")
+
+	m := db.(*purbDB).shards
+	require.NoError(t, db.Close())
+
+	shard := m.shardOf("a")
+	name := shardName(kvFileName, shard, m.shards[shard])
+
+	data, err := store.Get(name)
+	require.NoError(t, err)
+
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, store.Put(name, data))
+
+	// the shard is only read when it is accessed
+	db, err = NewDB(dir, false, WithBlobStore(store), WithLazyLoading())
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(txn ReadableTx) error {
+		require.Nil(t, txn.GetBucket([]byte("a")))
+		return nil
+	})
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	// the bucket is not created over the shard that cannot be read
+	err = db.Update(func(txn WritableTx) error {
+		_, err := txn.GetBucketOrCreate([]byte("a"))
+		return err
+	})
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	err = db.Update(func(txn WritableTx) error {
+		txn.GetBucket([]byte("a"))
+		return nil
+	})
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	require.Equal(t, m.generation, db.(*purbDB).shards.generation)
+
+	_, err = db.(Prover).Prove([]byte("a"), []byte("key"))
+	require.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestLazy_ScheduledWrites(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithShards(4), WithLazyLoading(),
+		WithScheduledWrites(time.Hour))
+	require.NoError(t, err)
+
+	p := db.(*purbDB)
+
+	setBuckets(t, db, "a", "b")
+	require.Len(t, p.bucketDb.Db, 2)
+
+	requireValue(t, db, "a", "key", "a")
+
+	// the saved changes move to the cache
+	require.NoError(t, db.(Flusher).Flush())
+	require.Empty(t, p.bucketDb.Db)
+
+	requireValue(t, db, "b", "key", "b")
+
+	setBuckets(t, db, "c")
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, true, WithLazyLoading())
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		requireValue(t, db, name, "key", name)
+	}
+}
+
+func TestLazy_SingleFile(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithLazyLoading())
+	require.NoError(t, err)
+
+	setBuckets(t, db, "a")
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, false, WithLazyLoading())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// a single file is read as a whole
+	require.Nil(t, db.(*purbDB).cache)
+	require.Contains(t, db.(*purbDB).bucketDb.Db, "a")
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// countingStore is a store in memory that records the objects that are read,
+// and the number of bytes read and written.
+type countingStore struct {
+	BlobStore
+
+	sync.Mutex
+	names   []string
+	read    int
+	written int
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{BlobStore: NewMemoryStore()}
+}
+
+func (s *countingStore) Get(name string) ([]byte, error) {
+	data, err := s.BlobStore.Get(name)
+
+	s.Lock()
+	s.names = append(s.names, name)
+	s.read += len(data)
+	s.Unlock()
+
+	return data, err
+}
+
+func (s *countingStore) Put(name string, data []byte) error {
+	s.Lock()
+	s.written += len(data)
+	s.Unlock()
+
+	return s.BlobStore.Put(name, data)
+}
+
+func (s *countingStore) bytesRead() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.read
+}
+
+func (s *countingStore) bytesWritten() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.written
+}
+
+func (s *countingStore) reads() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]string(nil), s.names...)
+}
+
+func (s *countingStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.names = nil
+	s.read = 0
+	s.written = 0
+}
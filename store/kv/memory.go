@@ -0,0 +1,33 @@
+package purbkv
+
+import (
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/group/mod"
+)
+
+// wipe overwrites the buffer with zeros so that plaintext does not linger in
+// memory until the garbage collector reuses it.
+func wipe(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// wipeScalar clears a private scalar. Setting the value to zero is not enough
+// for big integers as it only resets the length, so the words are overwritten
+// first when the implementation is known.
+func wipeScalar(s kyber.Scalar) {
+	if s == nil {
+		return
+	}
+
+	i, ok := s.(*mod.Int)
+	if ok {
+		words := i.V.Bits()
+		for j := range words {
+			words[j] = 0
+		}
+	}
+
+	s.Zero()
+}
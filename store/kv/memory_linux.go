@@ -0,0 +1,54 @@
+package purbkv
+
+import (
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+// lockMemory locks the current and future pages of the whole process in RAM so
+// that key material is never written to swap. It applies to every allocation of
+// the process, not only to the ones of the database.
+func lockMemory() error {
+	err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
+	if err != nil {
+		return xerrors.Errorf("mlockall failed: %v", err)
+	}
+
+	return nil
+}
+
+// lockedBuffer is memory that is mapped apart from the heap of the process and
+// locked in RAM, so that it is never written to swap.
+type lockedBuffer struct {
+	mem []byte
+}
+
+// newLockedBuffer maps and locks a buffer of the given size. It must be
+// released once it is not used anymore.
+func newLockedBuffer(size int) (*lockedBuffer, error) {
+	mem, err := syscall.Mmap(-1, 0, max(size, 1), syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, xerrors.Errorf("mmap failed: %v", err)
+	}
+
+	err = syscall.Mlock(mem)
+	if err != nil {
+		syscall.Munmap(mem)
+		return nil, xerrors.Errorf("mlock failed: %v", err)
+	}
+
+	return &lockedBuffer{mem: mem[:size]}, nil
+}
+
+// release wipes the buffer and unmaps it.
+func (b *lockedBuffer) release() {
+	mem := b.mem[:cap(b.mem)]
+	wipe(mem)
+
+	syscall.Munlock(mem)
+	syscall.Munmap(mem)
+
+	b.mem = nil
+}
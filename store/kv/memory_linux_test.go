@@ -0,0 +1,57 @@
+package purbkv
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory_WithMemoryLock(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer syscall.Munlockall()
+
+	db, err := NewDB(dir, true, WithMemoryLock())
+	if err != nil {
+		t.Skipf("memory cannot be locked in this environment: %v", err)
+	}
+
+	require.NoError(t, db.Close())
+}
+
+func TestMemory_LockedBuffer(t *testing.T) {
+	buf, err := newLockedBuffer(100)
+	if err != nil {
+		t.Skipf("memory cannot be locked in this environment: %v", err)
+	}
+
+	require.Len(t, buf.mem, 100)
+	copy(buf.mem, "plaintext")
+
+	buf.release()
+	require.Nil(t, buf.mem)
+}
+
+func TestMemory_WithLockedBuffers(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithLockedBuffers())
+	if err != nil {
+		t.Skipf("memory cannot be locked in this environment: %v", err)
+	}
+
+	setValue(t, db, []byte("ping"), []byte("pong"))
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, true, WithLockedBuffers())
+	require.NoError(t, err)
+	defer db.Close()
+
+	requireValue(t, db, "bucket", "ping", "pong")
+}
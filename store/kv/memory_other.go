@@ -0,0 +1,22 @@
+//go:build !linux
+
+package purbkv
+
+import "golang.org/x/xerrors"
+
+// lockMemory is only supported on Linux.
+func lockMemory() error {
+	return xerrors.New("memory locking is not supported on this platform")
+}
+
+// lockedBuffer is only supported on Linux.
+type lockedBuffer struct {
+	mem []byte
+}
+
+// newLockedBuffer is only supported on Linux.
+func newLockedBuffer(size int) (*lockedBuffer, error) {
+	return nil, xerrors.New("memory locking is not supported on this platform")
+}
+
+func (b *lockedBuffer) release() {}
@@ -0,0 +1,46 @@
+package purbkv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/kyber/v3/group/curve25519"
+	"go.dedis.ch/kyber/v3/util/key"
+)
+
+func TestMemory_Wipe(t *testing.T) {
+	buf := []byte("plaintext")
+
+	wipe(buf)
+	require.Equal(t, make([]byte, 9), buf)
+
+	wipe(nil)
+}
+
+func TestMemory_WipeScalar(t *testing.T) {
+	suite := curve25519.NewBlakeSHA256Curve25519(true)
+	kp := key.NewKeyPair(suite)
+
+	wipeScalar(kp.Private)
+	require.True(t, kp.Private.Equal(suite.Scalar().Zero()))
+
+	wipeScalar(nil)
+}
+
+func TestMemory_CloseWipesKeys(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true)
+	require.NoError(t, err)
+
+	recipients := db.(*purbDB).blob.recipients
+	zero := recipients[0].Suite.Scalar().Zero()
+	require.False(t, recipients[0].PrivateKey.Equal(zero))
+
+	err = db.Close()
+	require.NoError(t, err)
+	require.True(t, recipients[0].PrivateKey.Equal(zero))
+}
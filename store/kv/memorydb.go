@@ -0,0 +1,64 @@
+package purbkv
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// NewMemoryDB opens a new database that only lives in memory, for tests and
+// ephemeral nodes. Nothing is written to disk and the content is lost when the
+// database is closed. When PURB is on, every commit is still encoded with keys
+// generated for the database, so that the encoding is exercised as it is with
+// a file. The permission policy does not apply.
+func NewMemoryDB(purbIsOn bool, opts ...Option) (DB, error) {
+	tmpl := newDbTemplate(opts)
+
+	if tmpl.lockMemory {
+		err := lockMemory()
+		if err != nil {
+			return nil, xerrors.Errorf("failed to lock memory: %v", err)
+		}
+	}
+
+	p := &purbDB{
+		bucketDb: newBucketDb(),
+		purbIsOn: purbIsOn,
+		blobOpts: tmpl.blobOpts,
+	}
+
+	p.batches = newBatcher(tmpl.batchSize, tmpl.batchDelay, p.Update)
+
+	if purbIsOn {
+		b, err := NewBlob("", append(tmpl.blobOpts, withEphemeralKeys())...)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to create blob: %v", err)
+		}
+
+		p.blob = b
+	}
+
+	p.durability = tmpl.durability
+
+	if p.durability == DurabilityPeriodic {
+		p.scheduler = newScheduler(tmpl.writeInterval)
+		p.scheduler.start(p.Flush)
+	}
+
+	return p, nil
+}
+
+// saveInMemory encodes the buckets in place of writing the file. Without PURB
+// there is nothing to exercise and the encoding is skipped.
+func (p *purbDB) saveInMemory(db map[string]*dpBucket) error {
+	if !p.purbIsOn {
+		return nil
+	}
+
+	data, err := p.encode(db)
+	if err != nil {
+		return err
+	}
+
+	p.image = data
+
+	return nil
+}
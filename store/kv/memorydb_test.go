@@ -0,0 +1,59 @@
+package purbkv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDb_Plaintext(t *testing.T) {
+	db, err := NewMemoryDB(false)
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("ping"), []byte("pong"))
+	requireValue(t, db, "bucket", "ping", "pong")
+
+	// nothing is encoded without PURB
+	require.Nil(t, db.(*purbDB).image)
+
+	require.NoError(t, db.Close())
+}
+
+func TestMemoryDb_Purb(t *testing.T) {
+	db, err := NewMemoryDB(true, WithBlobOptions(WithSimplifiedEntryPoints()))
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("ping"), []byte("pong"))
+	requireValue(t, db, "bucket", "ping", "pong")
+
+	p := db.(*purbDB)
+	require.NotNil(t, p.image)
+
+	data, err := p.blob.Decode(p.image)
+	require.NoError(t, err)
+
+	buckets, err := decodeBuckets(data)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), buckets["bucket"].Kv["ping"])
+
+	headroom, err := db.(SizeReporter).Headroom()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, headroom, 0)
+
+	require.NoError(t, db.Close())
+
+	// the keys are wiped when the database is closed
+	_, err = p.blob.Decode(p.image)
+	require.Error(t, err)
+}
+
+func TestMemoryDb_Migrate(t *testing.T) {
+	db, err := NewMemoryDB(false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.(Migrator).Migrate(false))
+
+	err = db.(Migrator).Migrate(true)
+	require.EqualError(t, err, "an in-memory database cannot be migrated")
+}
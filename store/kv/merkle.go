@@ -0,0 +1,725 @@
+package purbkv
+
+// This file implements a Merkle commitment to the content of the database.
+//
+// Every bucket is committed by a tree whose leaves are its pairs sorted by key,
+// and the database is committed by a tree whose leaves are the buckets sorted
+// by name, each with the root of its own tree. The trees follow RFC 6962: a
+// leaf is hashed as H(0x00 | data) and a node as H(0x01 | left | right), which
+// prevents a leaf from being presented as a node. The root of an empty tree is
+// the hash of the empty string.
+//
+// As the leaves are sorted, the absence of a key is proven by the inclusion of
+// its neighbours, which must be adjacent in the tree.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"slices"
+	"sync"
+
+	"go.dedis.ch/dela"
+	"golang.org/x/exp/maps"
+	"golang.org/x/xerrors"
+)
+
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Leaf is a leaf of a Merkle tree with its audit path.
+type Leaf struct {
+	// Key is the key of the pair, or the name of the bucket.
+	Key []byte
+	// Value is the value of the pair, or the root of the bucket.
+	Value []byte
+	// Index is the position of the leaf in the tree.
+	Index uint64
+	// Path is the list of sibling hashes from the leaf to the root.
+	Path [][]byte
+}
+
+// TreeProof proves the presence of a key in a tree with the leaf of the key,
+// or its absence with the leaves surrounding the position it would have.
+type TreeProof struct {
+	Size   uint64
+	Leaves []Leaf
+}
+
+// Proof proves the value of a key of a bucket, or its absence, against the
+// root of a database.
+type Proof struct {
+	Bucket []byte
+	Key    []byte
+
+	// Buckets is the proof of the bucket in the tree of buckets.
+	Buckets TreeProof
+	// Pairs is the proof of the key in the tree of the bucket, or nil if the
+	// bucket does not exist.
+	Pairs *TreeProof
+}
+
+// VerifyProof verifies the proof against the root. It returns the value of the
+// key, or nil and false if the proof shows the key does not exist.
+func VerifyProof(root []byte, proof Proof) ([]byte, bool, error) {
+	bucketRoot, found, err := proof.Buckets.verify(root, proof.Bucket)
+	if err != nil {
+		return nil, false, xerrors.Errorf("invalid bucket proof: %v", err)
+	}
+
+	if !found {
+		if proof.Pairs != nil {
+			return nil, false, xerrors.New("unexpected key proof for a missing bucket")
+		}
+
+		return nil, false, nil
+	}
+
+	if proof.Pairs == nil {
+		return nil, false, xerrors.New("missing key proof")
+	}
+
+	value, found, err := proof.Pairs.verify(bucketRoot, proof.Key)
+	if err != nil {
+		return nil, false, xerrors.Errorf("invalid key proof: %v", err)
+	}
+
+	return value, found, nil
+}
+
+// verify checks the proof against the root and returns the value of the key
+// if it is present.
+func (p TreeProof) verify(root []byte, key []byte) ([]byte, bool, error) {
+	for _, leaf := range p.Leaves {
+		if !verifyPath(root, leafHash(leaf.Key, leaf.Value), leaf.Index, p.Size, leaf.Path) {
+			return nil, false, xerrors.Errorf("invalid path for leaf %d", leaf.Index)
+		}
+	}
+
+	if len(p.Leaves) == 1 && bytes.Equal(p.Leaves[0].Key, key) {
+		return p.Leaves[0].Value, true, nil
+	}
+
+	// the key is absent, the leaves must surround its position
+	switch len(p.Leaves) {
+	case 0:
+		if p.Size != 0 || !bytes.Equal(root, emptyRoot()) {
+			return nil, false, xerrors.New("missing leaves")
+		}
+	case 1:
+		leaf := p.Leaves[0]
+		first := leaf.Index == 0 && bytes.Compare(key, leaf.Key) < 0
+		last := leaf.Index == p.Size-1 && bytes.Compare(key, leaf.Key) > 0
+		if !first && !last {
+			return nil, false, xerrors.New("leaf is not a boundary of the key")
+		}
+	case 2:
+		left, right := p.Leaves[0], p.Leaves[1]
+		if left.Index+1 != right.Index {
+			return nil, false, xerrors.New("leaves are not adjacent")
+		}
+		if bytes.Compare(left.Key, key) >= 0 || bytes.Compare(key, right.Key) >= 0 {
+			return nil, false, xerrors.New("leaves do not surround the key")
+		}
+	default:
+		return nil, false, xerrors.Errorf("unexpected %d leaves", len(p.Leaves))
+	}
+
+	return nil, false, nil
+}
+
+// Root implements purbkv.Prover. It returns the Merkle root of the committed
+// content of the database, or nil if a shard of a lazily loaded database cannot
+// be read.
+func (p *purbDB) Root() []byte {
+	p.bucketDb.RLock()
+	defer p.bucketDb.RUnlock()
+
+	tree, _, err := p.merkle.buckets(p)
+	if err != nil {
+		dela.Logger.Err(err).Msg("failed to compute the root")
+		return nil
+	}
+
+	return tree.root.hash
+}
+
+// Prove implements purbkv.Prover. It returns a proof of the value of the key in
+// the bucket, or of its absence, against the current root.
+func (p *purbDB) Prove(bucket, key []byte) (Proof, error) {
+	p.bucketDb.RLock()
+	defer p.bucketDb.RUnlock()
+
+	proof := Proof{
+		Bucket: bucket,
+		Key:    key,
+	}
+
+	tree, roots, err := p.merkle.buckets(p)
+	if err != nil {
+		return Proof{}, xerrors.Errorf("failed to read buckets: %w", err)
+	}
+
+	proof.Buckets = tree.prove(string(bucket), func(i int) []byte {
+		return roots[tree.keys[i]]
+	})
+
+	_, found := slices.BinarySearch(tree.keys, string(bucket))
+	if !found {
+		return proof, nil
+	}
+
+	b, err := p.savedBucket(p.newTx(), string(bucket))
+	if err != nil {
+		return Proof{}, xerrors.Errorf("failed to read bucket: %w", err)
+	}
+
+	var tp TreeProof
+
+	switch b := b.(type) {
+	case *dpBucket:
+		tree := b.merkleTree()
+
+		tp = tree.prove(string(key), func(i int) []byte {
+			return b.Kv[tree.keys[i]]
+		})
+	case *pagedBucket:
+		tp, err = p.merkle.provePaged(b, string(key))
+		if err != nil {
+			return Proof{}, xerrors.Errorf("failed to read bucket: %w", err)
+		}
+	}
+
+	proof.Pairs = &tp
+
+	return proof, nil
+}
+
+// savedBucket returns the committed bucket with the given name, or nil when it
+// does not exist. The caller must hold the lock of the buckets.
+func (p *purbDB) savedBucket(tx *dpTx, name string) (Bucket, error) {
+	if p.pageSize > 0 {
+		b := tx.getPaged(name)
+		if tx.err != nil {
+			return nil, tx.err
+		}
+
+		if b == nil {
+			return nil, nil
+		}
+
+		return b, nil
+	}
+
+	b, found := p.bucketDb.Db[name]
+	if !found && p.cache != nil {
+		var err error
+
+		b, err = p.cache.get(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if b == nil {
+		return nil, nil
+	}
+
+	return b, nil
+}
+
+// merkleCache holds the roots of the committed buckets, so that Root and Prove
+// only hash again the buckets modified since they were last called. The leaves
+// of the saved pages of a paged database are kept as well, as a page never
+// changes once it is written, so that the root of a modified bucket only reads
+// the pages copied by the commits. This costs the hash of every pair that was
+// committed, but not the pairs themselves.
+type merkleCache struct {
+	sync.Mutex
+	// tree is the tree of the buckets, or nil when a bucket is modified
+	tree *merkleTree
+	// roots are the roots of the buckets, or nil before they are computed
+	roots map[string][]byte
+	// dirty are the buckets modified since their roots were computed
+	dirty map[string]struct{}
+	// pages are the leaf hashes of the saved pages of a paged database
+	pages map[pageRef][][]byte
+}
+
+// buckets returns the tree of the buckets and their roots, which are computed
+// again for the buckets that are modified. The caller must hold the lock of
+// the buckets.
+func (c *merkleCache) buckets(p *purbDB) (*merkleTree, map[string][]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.tree != nil {
+		return c.tree, c.roots, nil
+	}
+
+	if c.roots == nil {
+		roots := make(map[string][]byte)
+
+		err := p.forEachBucket(func(name string, b Bucket) error {
+			root, err := c.bucketRoot(b)
+			roots[name] = root
+
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c.roots = roots
+		c.dirty = nil
+	}
+
+	tx := p.newTx()
+
+	for name := range c.dirty {
+		b, err := p.savedBucket(tx, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if b == nil {
+			delete(c.roots, name)
+		} else {
+			c.roots[name], err = c.bucketRoot(b)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		delete(c.dirty, name)
+	}
+
+	names := maps.Keys(c.roots)
+	slices.Sort(names)
+
+	hashes := make([][]byte, len(names))
+	for i, name := range names {
+		hashes[i] = leafHash([]byte(name), c.roots[name])
+	}
+
+	c.tree = newMerkleTree(names, hashes)
+
+	return c.tree, c.roots, nil
+}
+
+// invalidate marks the buckets as modified by a commit. The caller must hold
+// the write lock of the buckets.
+func (c *merkleCache) invalidate(names []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.tree = nil
+
+	if c.roots == nil {
+		return
+	}
+
+	if c.dirty == nil {
+		c.dirty = make(map[string]struct{})
+	}
+
+	for _, name := range names {
+		c.dirty[name] = struct{}{}
+	}
+}
+
+// reset forgets the roots when the content of the database is replaced.
+func (c *merkleCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.tree = nil
+	c.roots = nil
+	c.dirty = nil
+	c.pages = nil
+}
+
+// dropPages forgets the leaves of the pages that are deleted.
+func (c *merkleCache) dropPages(refs []pageRef) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, ref := range refs {
+		delete(c.pages, ref)
+	}
+}
+
+// bucketRoot returns the root of the tree of the bucket, which is cached by the
+// bucket when it is not paged. The caller must hold the lock of the cache.
+func (c *merkleCache) bucketRoot(b Bucket) ([]byte, error) {
+	paged, ok := b.(*pagedBucket)
+	if !ok {
+		return b.(*dpBucket).merkleRoot(), nil
+	}
+
+	var leaves pageLeaves
+
+	err := c.appendLeaves(paged, paged.root, paged.level, &leaves)
+	if err != nil {
+		return nil, err
+	}
+
+	return merkleRoot(leaves.hashes), nil
+}
+
+// pageLeaves are the leaf hashes of a paged bucket, with the leaf pages they
+// come from.
+type pageLeaves struct {
+	hashes [][]byte
+	pages  []pageRef
+	// offsets are the indexes of the first leaves of the pages
+	offsets []int
+}
+
+// appendLeaves appends the leaf hashes of the pairs under the page, whose
+// leaves are only read when they are not saved or not cached. The caller must
+// hold the lock of the cache.
+func (c *merkleCache) appendLeaves(b *pagedBucket, ref pageRef, level int, leaves *pageLeaves) error {
+	cached, found := c.pages[ref]
+	if level == 0 && found {
+		leaves.pages = append(leaves.pages, ref)
+		leaves.offsets = append(leaves.offsets, len(leaves.hashes))
+		leaves.hashes = append(leaves.hashes, cached...)
+
+		return nil
+	}
+
+	page := b.tx.readPage(ref)
+	if b.tx.err != nil {
+		return b.tx.err
+	}
+
+	if level > 0 {
+		for _, k := range page.idx.keys() {
+			child, err := decodePageRef(page.Kv[k])
+			if err != nil {
+				return xerrors.Errorf("bucket %q: %w", b.name, err)
+			}
+
+			err = c.appendLeaves(b, child, level-1, leaves)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	hashes := make([][]byte, 0, page.idx.len())
+
+	page.idx.ascend("", func(k string) bool {
+		hashes = append(hashes, leafHash([]byte(k), page.Kv[k]))
+		return true
+	})
+
+	if ref.generation != 0 {
+		if c.pages == nil {
+			c.pages = make(map[pageRef][][]byte)
+		}
+
+		c.pages[ref] = hashes
+	}
+
+	leaves.pages = append(leaves.pages, ref)
+	leaves.offsets = append(leaves.offsets, len(leaves.hashes))
+	leaves.hashes = append(leaves.hashes, hashes...)
+
+	return nil
+}
+
+// provePaged creates the proof of a key of a paged bucket. The audit paths are
+// computed from the cached leaves, and only the leaves of the proof are read
+// with the pages on their path.
+func (c *merkleCache) provePaged(b *pagedBucket, key string) (TreeProof, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var leaves pageLeaves
+
+	err := c.appendLeaves(b, b.root, b.level, &leaves)
+	if err != nil {
+		return TreeProof{}, err
+	}
+
+	steps, err := b.descend(key)
+	if err != nil {
+		return TreeProof{}, err
+	}
+
+	leaf := steps[len(steps)-1]
+
+	i, found := slices.BinarySearch(leaf.page.idx.keys(), key)
+	i += leaves.offsets[slices.Index(leaves.pages, leaf.ref)]
+
+	var pairErr error
+
+	proof := proveLeaves(len(leaves.hashes), i, found, func(i int) Leaf {
+		k, v, err := leaves.pair(b, i)
+		if err != nil {
+			pairErr = err
+		}
+
+		return Leaf{
+			Key:   []byte(k),
+			Value: v,
+			Index: uint64(i),
+			Path:  auditPath(leaves.hashes, i),
+		}
+	})
+
+	return proof, pairErr
+}
+
+// pair returns the pair of the i-th leaf, which is read from its page.
+func (l pageLeaves) pair(b *pagedBucket, i int) (string, []byte, error) {
+	n, found := slices.BinarySearch(l.offsets, i)
+	if !found {
+		n--
+	}
+
+	page := b.tx.readPage(l.pages[n])
+	if b.tx.err != nil {
+		return "", nil, b.tx.err
+	}
+
+	k := page.idx.keys()[i-l.offsets[n]]
+
+	return k, page.Kv[k], nil
+}
+
+// merkleTree returns the tree of the bucket. It is cached until the bucket is
+// modified, so that a proof only costs its audit path.
+func (b *dpBucket) merkleTree() *merkleTree {
+	b.rootLock.Lock()
+	defer b.rootLock.Unlock()
+
+	if b.tree == nil {
+		keys := b.idx.keys()
+		hashes := make([][]byte, len(keys))
+
+		for i, k := range keys {
+			hashes[i] = leafHash([]byte(k), b.Kv[k])
+		}
+
+		b.tree = newMerkleTree(keys, hashes)
+		b.root = b.tree.root.hash
+	}
+
+	return b.tree
+}
+
+// merkleRoot returns the root of the tree of the bucket. It is cached until
+// the bucket is modified.
+func (b *dpBucket) merkleRoot() []byte {
+	b.rootLock.Lock()
+	defer b.rootLock.Unlock()
+
+	if b.root == nil {
+		hashes := make([][]byte, 0, b.idx.len())
+
+		b.idx.ascend("", func(k string) bool {
+			hashes = append(hashes, leafHash([]byte(k), b.Kv[k]))
+			return true
+		})
+
+		b.root = merkleRoot(hashes)
+	}
+
+	return b.root
+}
+
+// merkleTree is a tree of sorted keys with the hashes of all its nodes, so
+// that the audit path of a leaf is read instead of computed.
+type merkleTree struct {
+	keys []string
+	root *merkleNode
+}
+
+// merkleNode is a node of a tree, whose children are nil for a leaf.
+type merkleNode struct {
+	hash        []byte
+	left, right *merkleNode
+}
+
+func newMerkleTree(keys []string, hashes [][]byte) *merkleTree {
+	return &merkleTree{
+		keys: keys,
+		root: newMerkleNode(hashes),
+	}
+}
+
+// newMerkleNode returns the node of the tree of the leaf hashes, which is split
+// like in merkleRoot.
+func newMerkleNode(hashes [][]byte) *merkleNode {
+	switch len(hashes) {
+	case 0:
+		return &merkleNode{hash: emptyRoot()}
+	case 1:
+		return &merkleNode{hash: hashes[0]}
+	}
+
+	k := split(len(hashes))
+	left, right := newMerkleNode(hashes[:k]), newMerkleNode(hashes[k:])
+
+	return &merkleNode{
+		hash:  nodeHash(left.hash, right.hash),
+		left:  left,
+		right: right,
+	}
+}
+
+// path returns the sibling hashes from the leaf to the root, like auditPath.
+func (t *merkleTree) path(index int) [][]byte {
+	var path [][]byte
+
+	node, size := t.root, len(t.keys)
+
+	for size > 1 {
+		k := split(size)
+
+		if index < k {
+			path = append(path, node.right.hash)
+			node, size = node.left, k
+		} else {
+			path = append(path, node.left.hash)
+			node, index, size = node.right, index-k, size-k
+		}
+	}
+
+	slices.Reverse(path)
+
+	return path
+}
+
+// prove creates the proof of a key in the tree.
+func (t *merkleTree) prove(key string, value func(int) []byte) TreeProof {
+	i, found := slices.BinarySearch(t.keys, key)
+
+	return proveLeaves(len(t.keys), i, found, func(i int) Leaf {
+		return Leaf{
+			Key:   []byte(t.keys[i]),
+			Value: value(i),
+			Index: uint64(i),
+			Path:  t.path(i),
+		}
+	})
+}
+
+// proveLeaves creates the proof of a key in a tree of the given size, with the
+// leaf of the key when it is found at the index, or the leaves surrounding the
+// index otherwise.
+func proveLeaves(size, i int, found bool, leaf func(int) Leaf) TreeProof {
+	proof := TreeProof{Size: uint64(size)}
+
+	if found {
+		proof.Leaves = []Leaf{leaf(i)}
+		return proof
+	}
+
+	if i > 0 {
+		proof.Leaves = append(proof.Leaves, leaf(i-1))
+	}
+	if i < size {
+		proof.Leaves = append(proof.Leaves, leaf(i))
+	}
+
+	return proof
+}
+
+func emptyRoot() []byte {
+	h := sha256.Sum256(nil)
+	return h[:]
+}
+
+// leafHash returns the hash of a leaf made of a key and a value.
+func leafHash(key, value []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(binary.AppendUvarint(nil, uint64(len(key))))
+	h.Write(key)
+	h.Write(value)
+
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+
+	return h.Sum(nil)
+}
+
+// merkleRoot returns the root of the tree of the leaf hashes.
+func merkleRoot(hashes [][]byte) []byte {
+	switch len(hashes) {
+	case 0:
+		return emptyRoot()
+	case 1:
+		return hashes[0]
+	}
+
+	k := split(len(hashes))
+
+	return nodeHash(merkleRoot(hashes[:k]), merkleRoot(hashes[k:]))
+}
+
+// auditPath returns the sibling hashes from the leaf to the root.
+func auditPath(hashes [][]byte, index int) [][]byte {
+	if len(hashes) <= 1 {
+		return nil
+	}
+
+	k := split(len(hashes))
+
+	if index < k {
+		return append(auditPath(hashes[:k], index), merkleRoot(hashes[k:]))
+	}
+
+	return append(auditPath(hashes[k:], index-k), merkleRoot(hashes[:k]))
+}
+
+// verifyPath checks the audit path of the leaf hash against the root.
+func verifyPath(root, hash []byte, index, size uint64, path [][]byte) bool {
+	if index >= size {
+		return false
+	}
+
+	fn, sn := index, size-1
+	r := hash
+
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// split returns the largest power of two smaller than n.
+func split(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
@@ -0,0 +1,299 @@
+package purbkv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerkle_AuditPaths(t *testing.T) {
+	for n := 1; n <= 20; n++ {
+		hashes := make([][]byte, n)
+		for i := range hashes {
+			hashes[i] = leafHash([]byte{byte(i)}, nil)
+		}
+
+		root := merkleRoot(hashes)
+
+		for i := range hashes {
+			path := auditPath(hashes, i)
+			require.True(t, verifyPath(root, hashes[i], uint64(i), uint64(n), path), "%d/%d", i, n)
+			require.False(t, verifyPath(root, hashes[(i+1)%n], uint64(i), uint64(n), path) && n > 1)
+		}
+	}
+}
+
+func TestMerkle_TreePaths(t *testing.T) {
+	for n := 1; n <= 20; n++ {
+		keys := make([]string, n)
+		hashes := make([][]byte, n)
+		for i := range hashes {
+			keys[i] = string(rune('a' + i))
+			hashes[i] = leafHash([]byte{byte(i)}, nil)
+		}
+
+		tree := newMerkleTree(keys, hashes)
+		require.Equal(t, merkleRoot(hashes), tree.root.hash)
+
+		for i := range hashes {
+			require.Equal(t, auditPath(hashes, i), tree.path(i), "%d/%d", i, n)
+		}
+	}
+}
+
+func TestMerkle_CachedTree(t *testing.T) {
+	b := newFilledBucket(t, 100)
+
+	tree := b.merkleTree()
+	require.Same(t, tree, b.merkleTree())
+	require.Equal(t, tree.root.hash, b.merkleRoot())
+
+	// the tree is computed again once the bucket is modified
+	require.NoError(t, b.Set([]byte("key0042"), []byte("changed")))
+	require.Nil(t, b.tree)
+
+	proof := b.merkleTree().prove("key0042", func(i int) []byte {
+		return b.Kv[b.merkleTree().keys[i]]
+	})
+	require.Len(t, proof.Leaves, 1)
+
+	value, found, err := proof.verify(b.merkleRoot(), []byte("key0042"))
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("changed"), value)
+
+	require.NoError(t, b.Delete([]byte("key0042")))
+	require.Nil(t, b.tree)
+	require.NotEqual(t, tree.root.hash, b.merkleRoot())
+}
+
+func TestMerkle_Root(t *testing.T) {
+	first := newProverDB(t, false)
+	second := newProverDB(t, true)
+
+	require.Equal(t, emptyRoot(), first.(Prover).Root())
+
+	fillProverDB(t, first)
+	fillProverDB(t, second)
+
+	root := first.(Prover).Root()
+	require.NotEqual(t, emptyRoot(), root)
+	require.Equal(t, root, second.(Prover).Root())
+
+	err := first.Update(func(txn WritableTx) error {
+		b, err := txn.GetBucketOrCreate([]byte("B"))
+		require.NoError(t, err)
+
+		return b.Delete([]byte("2"))
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, root, first.(Prover).Root())
+
+	err = first.Update(func(txn WritableTx) error {
+		b, err := txn.GetBucketOrCreate([]byte("B"))
+		require.NoError(t, err)
+
+		return b.Set([]byte("2"), []byte("b"))
+	})
+	require.NoError(t, err)
+	require.Equal(t, root, first.(Prover).Root())
+}
+
+func TestMerkle_Prove(t *testing.T) {
+	db := newProverDB(t, false)
+	fillProverDB(t, db)
+
+	root := db.(Prover).Root()
+
+	cases := []struct {
+		bucket string
+		key    string
+		value  []byte
+	}{
+		{"A", "ping", []byte("pong")},
+		{"B", "1", []byte("a")},
+		{"B", "3", []byte("c")},
+		{"B", "0", nil},
+		{"B", "25", nil},
+		{"B", "4", nil},
+		{"C", "any", nil},
+		{"0", "any", nil},
+		{"Z", "any", nil},
+		{"E", "any", nil},
+	}
+
+	for _, c := range cases {
+		proof, err := db.(Prover).Prove([]byte(c.bucket), []byte(c.key))
+		require.NoError(t, err)
+
+		value, found, err := VerifyProof(root, proof)
+		require.NoError(t, err, "%s/%s", c.bucket, c.key)
+		require.Equal(t, c.value != nil, found, "%s/%s", c.bucket, c.key)
+		require.Equal(t, c.value, value)
+	}
+}
+
+func TestMerkle_ProveEmptyDB(t *testing.T) {
+	db := newProverDB(t, false)
+
+	proof, err := db.(Prover).Prove([]byte("A"), []byte("ping"))
+	require.NoError(t, err)
+
+	_, found, err := VerifyProof(db.(Prover).Root(), proof)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestMerkle_CachedRoots(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	other, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+
+	store := newCountingStore()
+
+	paged, err := NewDB(dir, false, WithBlobStore(store), WithShards(4), WithPaging(128), WithMemoryBudget(1024))
+	require.NoError(t, err)
+	defer paged.Close()
+
+	plain, err := NewDB(other, false)
+	require.NoError(t, err)
+	defer plain.Close()
+
+	for _, db := range []DB{paged, plain} {
+		setPairs(t, db, "a", 200)
+		setPairs(t, db, "b", 10)
+	}
+
+	p := paged.(*purbDB)
+	pages := len(readPages(t, p, "a"))
+
+	root := paged.(Prover).Root()
+	require.Equal(t, plain.(Prover).Root(), root)
+
+	// nothing is read again while the buckets are not modified
+	store.reset()
+	require.Equal(t, root, paged.(Prover).Root())
+	require.Empty(t, store.reads())
+
+	for _, db := range []DB{paged, plain} {
+		err = db.Update(func(txn WritableTx) error {
+			return txn.GetBucket([]byte("a")).Set([]byte("key042"), []byte("changed"))
+		})
+		require.NoError(t, err)
+	}
+
+	// only the leaves copied by the commit are read, with the inner pages
+	store.reset()
+	root = plain.(Prover).Root()
+	require.Equal(t, root, paged.(Prover).Root())
+
+	read := 0
+	for _, name := range store.reads() {
+		_, ok := parsePageName(kvFileName, name)
+		if ok {
+			read++
+		}
+	}
+
+	require.Less(t, read, pages/2)
+
+	// the proofs are made from the cached leaves
+	for _, key := range []string{"key000", "key042", "key0425", "key199", "a", "z"} {
+		proof, err := paged.(Prover).Prove([]byte("a"), []byte(key))
+		require.NoError(t, err)
+
+		expected, err := plain.(Prover).Prove([]byte("a"), []byte(key))
+		require.NoError(t, err)
+		require.Equal(t, expected, proof, key)
+
+		_, _, err = VerifyProof(root, proof)
+		require.NoError(t, err, key)
+	}
+}
+
+func TestMerkle_InvalidProofs(t *testing.T) {
+	db := newProverDB(t, false)
+	fillProverDB(t, db)
+
+	root := db.(Prover).Root()
+
+	proof, err := db.(Prover).Prove([]byte("B"), []byte("2"))
+	require.NoError(t, err)
+
+	proof.Pairs.Leaves[0].Value = []byte("tampered")
+	_, _, err = VerifyProof(root, proof)
+	require.ErrorContains(t, err, "invalid key proof: invalid path for leaf 1")
+
+	// a present key cannot be proven absent by skipping its leaf
+	absent, err := db.(Prover).Prove([]byte("B"), []byte("25"))
+	require.NoError(t, err)
+
+	absent.Key = []byte("2")
+	_, _, err = VerifyProof(root, absent)
+	require.ErrorContains(t, err, "leaves do not surround the key")
+
+	proof, err = db.(Prover).Prove([]byte("B"), []byte("1"))
+	require.NoError(t, err)
+
+	proof.Key = []byte("0")
+	proof.Pairs.Leaves[0].Index = 1
+	_, _, err = VerifyProof(root, proof)
+	require.ErrorContains(t, err, "invalid path for leaf 1")
+
+	proof, err = db.(Prover).Prove([]byte("C"), []byte("1"))
+	require.NoError(t, err)
+
+	proof.Pairs = &TreeProof{}
+	_, _, err = VerifyProof(root, proof)
+	require.EqualError(t, err, "unexpected key proof for a missing bucket")
+
+	proof, err = db.(Prover).Prove([]byte("A"), []byte("1"))
+	require.NoError(t, err)
+
+	proof.Pairs = nil
+	_, _, err = VerifyProof(root, proof)
+	require.EqualError(t, err, "missing key proof")
+
+	_, _, err = VerifyProof([]byte("root"), proof)
+	require.ErrorContains(t, err, "invalid bucket proof")
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func newProverDB(t *testing.T, purbIsOn bool) DB {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := NewDB(dir, purbIsOn)
+	require.NoError(t, err)
+
+	return db
+}
+
+func fillProverDB(t *testing.T, db DB) {
+	err := db.Update(func(txn WritableTx) error {
+		a, err := txn.GetBucketOrCreate([]byte("A"))
+		require.NoError(t, err)
+		require.NoError(t, a.Set([]byte("ping"), []byte("pong")))
+
+		b, err := txn.GetBucketOrCreate([]byte("B"))
+		require.NoError(t, err)
+		require.NoError(t, b.Set([]byte("3"), []byte("c")))
+		require.NoError(t, b.Set([]byte("1"), []byte("a")))
+		require.NoError(t, b.Set([]byte("2"), []byte("b")))
+
+		_, err = txn.GetBucketOrCreate([]byte("E"))
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
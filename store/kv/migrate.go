@@ -0,0 +1,167 @@
+package purbkv
+
+import (
+	"io/fs"
+
+	"golang.org/x/xerrors"
+)
+
+// Migrate converts the database in the directory at the given path to PURB if
+// purbIsOn is true, or to plaintext otherwise. The database must not be in use.
+// The options are the ones used to open it, and the blob options apply to both
+// formats. See Migrator for the details of the conversion. It fails when there
+// is no database in the other format, rather than creating one.
+func Migrate(path string, purbIsOn bool, opts ...Option) error {
+	exists, err := dbExists(path, !purbIsOn, opts)
+	if err != nil {
+		return xerrors.Errorf("failed to open DB: %v", err)
+	}
+	if !exists {
+		return xerrors.Errorf("failed to open DB: %w: %s", fs.ErrNotExist, dbFileName(!purbIsOn))
+	}
+
+	db, err := NewDB(path, !purbIsOn, opts...)
+	if err != nil {
+		return xerrors.Errorf("failed to open DB: %w", err)
+	}
+
+	err = db.(Migrator).Migrate(purbIsOn)
+	if err != nil {
+		db.Close()
+		return xerrors.Errorf("failed to migrate: %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		return xerrors.Errorf("failed to close DB: %v", err)
+	}
+
+	return nil
+}
+
+// Migrate implements purbkv.Migrator. It writes the content to a file in the
+// new format and then removes the old file, which is overwritten with zeros
+// first when the store is a directory as it may be in plaintext. The new file
+// is written at once, so that it is either complete or missing. A sharded
+// database writes every shard in the new format before its manifest, and its
+// old shards are removed after the old manifest. The keys are
+// loaded, or created, in the directory of the database when PURB is turned on,
+// and are kept when it is turned off.
+func (p *purbDB) Migrate(purbIsOn bool) error {
+	// a commit writes the files of the current format before it publishes
+	// them, and it must not be interleaved with the switch of the format
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+
+	p.bucketDb.Lock()
+	defer p.bucketDb.Unlock()
+
+	p.fileLock.Lock()
+	defer p.fileLock.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	if p.purbIsOn == purbIsOn {
+		return nil
+	}
+
+	if p.store == nil {
+		return xerrors.New("an in-memory database cannot be migrated")
+	}
+
+	target := dbFileName(purbIsOn)
+
+	exists, err := p.store.Exists(target)
+	if err != nil {
+		return xerrors.Errorf("failed to stat %s: %v", target, err)
+	}
+	if exists {
+		return xerrors.Errorf("refusing to overwrite %s", target)
+	}
+
+	next := &purbDB{
+		store:    p.store,
+		dbName:   target,
+		purbIsOn: purbIsOn,
+		blob:     p.blob,
+		blobOpts: p.blobOpts,
+
+		lockBuffers: p.lockBuffers,
+	}
+
+	if purbIsOn {
+		next.blob, err = NewBlob(p.path, p.blobOpts...)
+		if err != nil {
+			return xerrors.Errorf("failed to create blob: %v", err)
+		}
+	}
+
+	var files []string
+
+	if p.shards != nil {
+		files, err = p.migrateShards(next)
+		if err != nil {
+			return err
+		}
+	} else {
+		data, err := next.encode(p.bucketDb.Db)
+		if err != nil {
+			return xerrors.Errorf("failed to encode DB: %v", err)
+		}
+
+		err = p.store.Put(target, data)
+		wipe(data)
+		if err != nil {
+			return xerrors.Errorf("failed to write DB file: %v", err)
+		}
+	}
+
+	// the new file must survive a crash before the old one is removed
+	err = p.sync()
+	if err != nil {
+		return xerrors.Errorf("failed to write DB file: %v", err)
+	}
+
+	old := p.dbName
+
+	if !purbIsOn {
+		p.blob.Wipe()
+		next.blob = nil
+	}
+
+	p.dbName = next.dbName
+	p.purbIsOn = next.purbIsOn
+	p.blob = next.blob
+
+	// the cached shards are still the content of the new ones, and the changes
+	// that are not saved yet are written by the next save
+	if next.shards != nil {
+		p.shards = next.shards
+
+		if p.cache != nil {
+			p.cache.update(next.shards, nil, nil)
+		}
+	}
+
+	err = p.store.Delete(old)
+	if err != nil {
+		return xerrors.Errorf("failed to remove %s: %v", old, err)
+	}
+
+	// the old shards are useless once the old manifest is removed
+	for _, name := range files {
+		err = p.store.Delete(name)
+		if err != nil {
+			return xerrors.Errorf("failed to remove %s: %v", name, err)
+		}
+	}
+
+	err = p.sync()
+	if err != nil {
+		return xerrors.Errorf("failed to remove %s: %v", old, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package purbkv
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate_RefuseOtherFormat(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = NewDB(dir, true)
+	require.ErrorIs(t, err, ErrOtherFormat)
+	require.NoFileExists(t, filepath.Join(dir, purbFileName))
+	require.NoFileExists(t, filepath.Join(dir, keysFileName))
+}
+
+func TestMigrate_RoundTrip(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+
+	fillProverDB(t, db)
+	root := db.(Prover).Root()
+	require.NoError(t, db.Close())
+
+	err = Migrate(dir, true)
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(dir, kvFileName))
+
+	report, err := Verify(dir, true, WithExpectedRoot(root))
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.String())
+
+	_, err = NewDB(dir, false)
+	require.ErrorIs(t, err, ErrOtherFormat)
+
+	err = Migrate(dir, false)
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(dir, purbFileName))
+	require.FileExists(t, filepath.Join(dir, keysFileName))
+
+	report, err = Verify(dir, false, WithExpectedRoot(root))
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.String())
+}
+
+func TestMigrate_Online(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("before"), []byte("plaintext"))
+
+	require.NoError(t, db.(Migrator).Migrate(true))
+	require.NoError(t, db.(Migrator).Migrate(true))
+
+	setValue(t, db, []byte("after"), []byte("purb"))
+
+	headroom, err := db.(SizeReporter).Headroom()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, headroom, 0)
+
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, true)
+	require.NoError(t, err)
+	defer db.Close()
+
+	requireValue(t, db, "bucket", "before", "plaintext")
+	requireValue(t, db, "bucket", "after", "purb")
+}
+
+func TestMigrate_RefuseOverwrite(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, purbFileName), []byte("stale"), filePerm))
+
+	err = db.(Migrator).Migrate(true)
+	require.ErrorContains(t, err, "refusing to overwrite")
+	require.FileExists(t, filepath.Join(dir, kvFileName))
+
+	err = Migrate(filepath.Join(dir, "missing"), true)
+	require.Error(t, err)
+}
+
+func TestMigrate_MissingDB(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = Migrate(dir, true)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	err = Migrate(dir, false)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// nothing is created in the directory
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestMigrate_ConcurrentUpdates(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithShards(4)}} {
+		testMigrateConcurrentUpdates(t, opts)
+	}
+}
+
+func TestMigrate_Sync(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	fsys := &syncingFS{FileSystem: osFS{}}
+
+	db, err = NewDB(dir, false, WithFileSystem(fsys))
+	require.NoError(t, err)
+	defer db.Close()
+
+	fsys.reset()
+
+	err = db.(Migrator).Migrate(true)
+	require.NoError(t, err)
+
+	// the directory is synced once the new file is written, and again once the
+	// old one is removed
+	synced := fsys.synced()
+	require.GreaterOrEqual(t, len(synced), 2)
+	require.Equal(t, dir, synced[len(synced)-1])
+	require.Contains(t, synced[:len(synced)-1], dir)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func testMigrateConcurrentUpdates(t *testing.T, opts []Option) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newBlockingStore(NewFileStore(dir))
+	opts = append(opts, WithBlobStore(store))
+
+	db, err := NewDB(dir, false, opts...)
+	require.NoError(t, err)
+
+	setBuckets(t, db, "before")
+
+	// the commit waits while it writes its files, before it publishes them
+	store.block.Store(true)
+
+	updated := make(chan error, 1)
+	go func() {
+		updated <- db.Update(func(tx WritableTx) error {
+			bucket, err := tx.GetBucketOrCreate([]byte("during"))
+			if err != nil {
+				return err
+			}
+
+			return bucket.Set([]byte("key"), []byte("value"))
+		})
+	}()
+
+	<-store.entered
+	store.block.Store(false)
+
+	migrated := make(chan error, 1)
+	go func() {
+		migrated <- db.(Migrator).Migrate(true)
+	}()
+
+	// the migration must wait for the commit rather than for its files
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+
+	require.NoError(t, <-updated)
+	require.NoError(t, <-migrated)
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, true, opts...)
+	require.NoError(t, err)
+	defer db.Close()
+
+	requireValue(t, db, "during", "key", "value")
+}
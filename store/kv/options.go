@@ -0,0 +1,210 @@
+package purbkv
+
+import (
+	"slices"
+	"time"
+)
+
+// dbTemplate contains the parameters that can be tuned when opening a
+// database.
+type dbTemplate struct {
+	permissions PermissionPolicy
+	lockMemory  bool
+	lockBuffers bool
+	blobOpts    []BlobOption
+	store       BlobStore
+	fsys        FileSystem
+	shards      int
+	lazy        bool
+	pageSize    int
+
+	memoryBudget  int
+	durability    Durability
+	writeInterval time.Duration
+	batchSize     int
+	batchDelay    time.Duration
+
+	// expectedRoot is only used by Verify
+	expectedRoot []byte
+}
+
+func newDbTemplate(opts []Option) dbTemplate {
+	tmpl := dbTemplate{
+		permissions: PermissionsWarn,
+		fsys:        osFS{},
+		batchSize:   defaultBatchSize,
+		batchDelay:  defaultBatchDelay,
+	}
+
+	for _, opt := range opts {
+		opt(&tmpl)
+	}
+
+	if tmpl.durability == DurabilityPeriodic && tmpl.writeInterval <= 0 {
+		tmpl.writeInterval = defaultWriteInterval
+	}
+
+	return tmpl
+}
+
+// blobOptions returns the options of the blob of the database, which reads the
+// keys from the file system of the directory.
+func (tmpl dbTemplate) blobOptions() []BlobOption {
+	opts := append(slices.Clip(tmpl.blobOpts), withFileSystem(tmpl.fsys))
+	if tmpl.permissions != PermissionsEnforce {
+		opts = append(opts, withLooseKeys())
+	}
+
+	return opts
+}
+
+// Option is the type of option to set some fields when opening a database.
+type Option func(*dbTemplate)
+
+// WithPermissionPolicy is an option to choose what happens when the database
+// directory or its files can be accessed by someone else than the owner. The
+// default is PermissionsWarn, as the databases created by earlier versions are
+// readable by others until FixPermissions is run.
+func WithPermissionPolicy(policy PermissionPolicy) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.permissions = policy
+	}
+}
+
+// WithMemoryLock is an option to lock the memory of the process with mlockall
+// so that private keys and decrypted data are never swapped to disk. It locks
+// every current and future page of the whole process, and not only the memory
+// of the database, which the rest of the application may not expect. It is only
+// supported on Linux and requires either CAP_IPC_LOCK or a large enough
+// RLIMIT_MEMLOCK. WithLockedBuffers only locks the buffers of the database.
+func WithMemoryLock() Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.lockMemory = true
+	}
+}
+
+// WithLockedBuffers is an option to serialize the plaintext of the files of a
+// PURB database in buffers that are mapped apart from the heap, locked with
+// mlock and wiped when they are released, rather than locking the whole
+// process. The decrypted data and the keys are still in the heap. It is only
+// supported on Linux, and RLIMIT_MEMLOCK must allow the largest file, or shard,
+// to be locked.
+func WithLockedBuffers() Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.lockBuffers = true
+	}
+}
+
+// WithBlobOptions is an option to set the options of the blob used to encode
+// the database when PURB is on.
+func WithBlobOptions(opts ...BlobOption) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.blobOpts = append(tmpl.blobOpts, opts...)
+	}
+}
+
+// WithScheduledWrites is an option to write the database to disk at a fixed
+// interval instead of after every commit, which is DurabilityPeriodic. The file
+// is rewritten at every tick even when nothing changed so that its modification
+// time does not reveal activity. Commits are only in memory until the next
+// tick, and callers that need them on disk can use Flusher.Flush.
+func WithScheduledWrites(interval time.Duration) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.durability = DurabilityPeriodic
+		tmpl.writeInterval = interval
+	}
+}
+
+// WithDurability is an option to choose when the commits are written to disk,
+// which is after every commit by default. The periodic writes happen every
+// second unless an interval is set with WithScheduledWrites.
+func WithDurability(durability Durability) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.durability = durability
+	}
+}
+
+// WithBatchLimits is an option to set how many calls to Batcher.Batch a batch
+// takes at most, and how long it waits for other calls before it is committed.
+// They are 1000 calls and 10 milliseconds by default.
+func WithBatchLimits(size int, delay time.Duration) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.batchSize = size
+		tmpl.batchDelay = delay
+	}
+}
+
+// WithBlobStore is an option to keep the database file in the store instead of
+// the directory of the database, which still holds the keys when PURB is on.
+// The permission policy only applies to the directory.
+func WithBlobStore(store BlobStore) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.store = store
+	}
+}
+
+// WithFileSystem is an option to set the file system of the directory of the
+// database, which holds the keys and the database file unless a store is set.
+func WithFileSystem(fsys FileSystem) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.fsys = fsys
+	}
+}
+
+// WithShards is an option to create the database with its buckets spread over
+// the given number of shards, which are files encoded and encrypted
+// independently. A commit only rewrites the shards of the buckets it changed
+// instead of the whole database. The option only applies when the database is
+// created, and an existing database keeps its layout.
+func WithShards(count int) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.shards = count
+	}
+}
+
+// WithLazyLoading is an option to open a sharded database without reading its
+// shards, which are read and decrypted the first time one of their buckets is
+// accessed. A database in a single file is always read as a whole, as it is
+// encrypted as a whole. A shard that cannot be read fails the transaction that
+// accesses it instead of the opening of the database.
+func WithLazyLoading() Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.lazy = true
+	}
+}
+
+// WithMemoryBudget is an option to load a sharded database lazily, and to evict
+// the least recently used shards and pages from memory when their buckets take
+// more than the given number of bytes. The changes that are not written yet are always
+// kept, and a shard is read again when it is accessed after its eviction.
+func WithMemoryBudget(bytes int) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.memoryBudget = bytes
+	}
+}
+
+// WithPaging is an option to create a sharded database whose buckets are split
+// in pages of about the given number of bytes, so that a bucket does not have
+// to fit in memory. The pages of a bucket form a tree whose root is kept in the
+// shard of the bucket, and every page is encrypted in its own file next to the
+// shards. The database is loaded lazily, and a transaction only reads the pages
+// on the path of the keys it accesses and writes copies of the pages it
+// modifies. With a memory budget, the shards and pages that are decrypted are
+// bounded by the budget in addition to the pages modified by the running
+// transaction and the changes not written yet.
+// The layout of an existing database is kept, and its pages are split with the
+// given size or 64 KiB by default.
+func WithPaging(pageSize int) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.pageSize = pageSize
+	}
+}
+
+// WithExpectedRoot is an option of Verify to compare the Merkle root of the
+// content with a root obtained earlier, for instance from Prover.Root before a
+// migration.
+func WithExpectedRoot(root []byte) Option {
+	return func(tmpl *dbTemplate) {
+		tmpl.expectedRoot = root
+	}
+}
@@ -0,0 +1,368 @@
+package purbkv
+
+import (
+	"slices"
+	"strings"
+)
+
+// orderDegree is the minimum number of children of the inner nodes of the
+// ordered keys, except the root.
+const orderDegree = 32
+
+const (
+	maxOrderKeys = 2*orderDegree - 1
+	minOrderKeys = orderDegree - 1
+)
+
+// kOrder is the set of the keys of a bucket in order. It is a B-tree so that
+// a key is inserted or deleted in a logarithmic time, and its nodes are shared
+// by its clones until they are modified. The zero value is an empty set.
+type kOrder struct {
+	root   *orderNode
+	length int
+	// cow identifies the nodes that the set can modify, the others being
+	// shared with a clone
+	cow *orderCow
+}
+
+type orderNode struct {
+	keys     []string
+	children []*orderNode
+	cow      *orderCow
+}
+
+// orderCow is not empty so that every instance has a distinct address.
+type orderCow struct {
+	_ bool
+}
+
+// newOrder returns the set of the keys, which must be sorted and unique.
+func newOrder(keys []string) kOrder {
+	var o kOrder
+
+	for _, k := range keys {
+		o.insert(k)
+	}
+
+	return o
+}
+
+// len returns the number of keys.
+func (o *kOrder) len() int {
+	return o.length
+}
+
+// clone returns a copy of the set that shares its nodes, which are copied
+// before the copy modifies them. The set itself must not be modified afterwards,
+// which holds for the index of a saved bucket as a commit replaces it with the
+// copy of the transaction.
+func (o *kOrder) clone() kOrder {
+	return kOrder{
+		root:   o.root,
+		length: o.length,
+		cow:    new(orderCow),
+	}
+}
+
+// keys returns the keys in order.
+func (o *kOrder) keys() []string {
+	keys := make([]string, 0, o.length)
+
+	o.ascend("", func(k string) bool {
+		keys = append(keys, k)
+		return true
+	})
+
+	return keys
+}
+
+// prefixed returns the keys that start with the prefix in order. The keys are
+// copied so that the set can be modified while the caller goes through them.
+func (o *kOrder) prefixed(prefix string) []string {
+	var keys []string
+
+	// the keys with the prefix follow each other from the prefix itself
+	o.ascend(prefix, func(k string) bool {
+		if !strings.HasPrefix(k, prefix) {
+			return false
+		}
+
+		keys = append(keys, k)
+
+		return true
+	})
+
+	return keys
+}
+
+// ascend calls the function for the keys from the given one in order, until it
+// returns false.
+func (o *kOrder) ascend(from string, fn func(k string) bool) {
+	if o.root != nil {
+		o.root.ascend(from, fn)
+	}
+}
+
+// floor returns the greatest key that is not greater than the given one, and
+// false if there is none.
+func (o *kOrder) floor(key string) (string, bool) {
+	floor, found := "", false
+
+	for n := o.root; n != nil; {
+		i, exact := slices.BinarySearch(n.keys, key)
+		if exact {
+			return key, true
+		}
+
+		if i > 0 {
+			floor, found = n.keys[i-1], true
+		}
+
+		if len(n.children) == 0 {
+			break
+		}
+
+		n = n.children[i]
+	}
+
+	return floor, found
+}
+
+// insert adds the key, and returns false if it is already in the set.
+func (o *kOrder) insert(key string) bool {
+	if o.cow == nil {
+		o.cow = new(orderCow)
+	}
+
+	if o.root == nil {
+		o.root = &orderNode{keys: []string{key}, cow: o.cow}
+		o.length++
+
+		return true
+	}
+
+	o.root = o.root.mutableFor(o.cow)
+
+	if len(o.root.keys) >= maxOrderKeys {
+		mid, right := o.root.split(maxOrderKeys / 2)
+
+		o.root = &orderNode{
+			keys:     []string{mid},
+			children: []*orderNode{o.root, right},
+			cow:      o.cow,
+		}
+	}
+
+	added := o.root.insert(key)
+	if added {
+		o.length++
+	}
+
+	return added
+}
+
+// remove deletes the key, and returns false if it is not in the set.
+func (o *kOrder) remove(key string) bool {
+	if o.root == nil {
+		return false
+	}
+
+	if o.cow == nil {
+		o.cow = new(orderCow)
+	}
+
+	o.root = o.root.mutableFor(o.cow)
+
+	_, removed := o.root.remove(key, false)
+
+	// the root shrinks when its last key is moved to its only child
+	if len(o.root.keys) == 0 && len(o.root.children) > 0 {
+		o.root = o.root.children[0]
+	}
+
+	if removed {
+		o.length--
+	}
+
+	return removed
+}
+
+// mutableFor returns the node, or a copy of it if it is shared.
+func (n *orderNode) mutableFor(cow *orderCow) *orderNode {
+	if n.cow == cow {
+		return n
+	}
+
+	return &orderNode{
+		keys:     slices.Clone(n.keys),
+		children: slices.Clone(n.children),
+		cow:      cow,
+	}
+}
+
+func (n *orderNode) mutableChild(i int) *orderNode {
+	c := n.children[i].mutableFor(n.cow)
+	n.children[i] = c
+
+	return c
+}
+
+// split moves the keys and children after the i-th key to a new node, and
+// returns the i-th key that separates them.
+func (n *orderNode) split(i int) (string, *orderNode) {
+	mid := n.keys[i]
+
+	next := &orderNode{cow: n.cow}
+	next.keys = slices.Clone(n.keys[i+1:])
+	n.keys = slices.Clip(n.keys[:i])
+
+	if len(n.children) > 0 {
+		next.children = slices.Clone(n.children[i+1:])
+		n.children = slices.Clip(n.children[:i+1])
+	}
+
+	return mid, next
+}
+
+// insert adds the key to the node, which is not full.
+func (n *orderNode) insert(key string) bool {
+	i, found := slices.BinarySearch(n.keys, key)
+	if found {
+		return false
+	}
+
+	if len(n.children) == 0 {
+		n.keys = slices.Insert(n.keys, i, key)
+		return true
+	}
+
+	// a full child is split so that it can take the key
+	if len(n.children[i].keys) >= maxOrderKeys {
+		mid, next := n.mutableChild(i).split(maxOrderKeys / 2)
+
+		n.keys = slices.Insert(n.keys, i, mid)
+		n.children = slices.Insert(n.children, i+1, next)
+
+		switch {
+		case key == mid:
+			return false
+		case key > mid:
+			i++
+		}
+	}
+
+	return n.mutableChild(i).insert(key)
+}
+
+// remove deletes the key from the node, or its greatest key when max is true.
+// It returns the key that is deleted. The node has more than the minimum
+// number of keys unless it is the root.
+func (n *orderNode) remove(key string, max bool) (string, bool) {
+	var i int
+	var found bool
+
+	if max {
+		i = len(n.keys)
+	} else {
+		i, found = slices.BinarySearch(n.keys, key)
+	}
+
+	if len(n.children) == 0 {
+		switch {
+		case max:
+			i--
+		case !found:
+			return "", false
+		}
+
+		removed := n.keys[i]
+		n.keys = slices.Delete(n.keys, i, i+1)
+
+		return removed, true
+	}
+
+	// the child must be able to lose a key
+	if len(n.children[i].keys) <= minOrderKeys {
+		n.grow(i)
+		return n.remove(key, max)
+	}
+
+	child := n.mutableChild(i)
+
+	if found {
+		// the key is replaced by the greatest key before it
+		removed := n.keys[i]
+		n.keys[i], _ = child.remove("", true)
+
+		return removed, true
+	}
+
+	return child.remove(key, max)
+}
+
+// grow gives a key to the i-th child, from a sibling or by merging it with a
+// sibling.
+func (n *orderNode) grow(i int) {
+	switch {
+	case i > 0 && len(n.children[i-1].keys) > minOrderKeys:
+		child := n.mutableChild(i)
+		left := n.mutableChild(i - 1)
+
+		last := len(left.keys) - 1
+		child.keys = slices.Insert(child.keys, 0, n.keys[i-1])
+		n.keys[i-1] = left.keys[last]
+		left.keys = left.keys[:last]
+
+		if len(left.children) > 0 {
+			last = len(left.children) - 1
+			child.children = slices.Insert(child.children, 0, left.children[last])
+			left.children = left.children[:last]
+		}
+
+	case i < len(n.keys) && len(n.children[i+1].keys) > minOrderKeys:
+		child := n.mutableChild(i)
+		right := n.mutableChild(i + 1)
+
+		child.keys = append(child.keys, n.keys[i])
+		n.keys[i] = right.keys[0]
+		right.keys = slices.Delete(right.keys, 0, 1)
+
+		if len(right.children) > 0 {
+			child.children = append(child.children, right.children[0])
+			right.children = slices.Delete(right.children, 0, 1)
+		}
+
+	default:
+		if i >= len(n.keys) {
+			i--
+		}
+
+		child := n.mutableChild(i)
+		next := n.children[i+1]
+
+		child.keys = append(child.keys, n.keys[i])
+		child.keys = append(child.keys, next.keys...)
+		child.children = append(child.children, next.children...)
+
+		n.keys = slices.Delete(n.keys, i, i+1)
+		n.children = slices.Delete(n.children, i+1, i+2)
+	}
+}
+
+// ascend calls the function for the keys of the node from the given one, and
+// returns false when the function stops the iteration.
+func (n *orderNode) ascend(from string, fn func(k string) bool) bool {
+	i, _ := slices.BinarySearch(n.keys, from)
+
+	for ; i <= len(n.keys); i++ {
+		if len(n.children) > 0 && !n.children[i].ascend(from, fn) {
+			return false
+		}
+
+		if i < len(n.keys) && !fn(n.keys[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,198 @@
+package purbkv
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrder_InsertRemove(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+
+	var o kOrder
+	set := make(map[string]bool)
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("%04d", rnd.Intn(5000))
+
+		if rnd.Intn(3) == 0 {
+			require.Equal(t, set[key], o.remove(key))
+			delete(set, key)
+		} else {
+			require.Equal(t, !set[key], o.insert(key))
+			set[key] = true
+		}
+	}
+
+	requireOrder(t, &o, set)
+
+	// the set becomes empty and can be filled again
+	for key := range set {
+		require.True(t, o.remove(key))
+	}
+
+	require.Empty(t, o.keys())
+	require.True(t, o.insert("a"))
+	require.Equal(t, []string{"a"}, o.keys())
+}
+
+func TestOrder_Ascend(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%04d", i*2)
+	}
+
+	o := newOrder(keys)
+
+	var found []string
+
+	o.ascend("0101", func(k string) bool {
+		found = append(found, k)
+		return len(found) < 3
+	})
+
+	require.Equal(t, []string{"0102", "0104", "0106"}, found)
+
+	found = nil
+
+	o.ascend("1998", func(k string) bool {
+		found = append(found, k)
+		return true
+	})
+
+	require.Equal(t, []string{"1998"}, found)
+}
+
+func TestOrder_Floor(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%04d", i*2+2)
+	}
+
+	o := newOrder(keys)
+
+	for i := 0; i <= 2002; i++ {
+		key := fmt.Sprintf("%04d", i)
+
+		expected, found := "", i >= 2
+		if found {
+			expected = fmt.Sprintf("%04d", min(i-i%2, 2000))
+		}
+
+		floor, ok := o.floor(key)
+		require.Equal(t, found, ok, key)
+		require.Equal(t, expected, floor, key)
+	}
+
+	var empty kOrder
+
+	_, ok := empty.floor("a")
+	require.False(t, ok)
+}
+
+func TestOrder_Clone(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%04d", i)
+	}
+
+	o := newOrder(keys)
+	c := o.clone()
+
+	for i := 0; i < 1000; i += 2 {
+		require.True(t, c.remove(keys[i]))
+	}
+
+	require.True(t, c.insert("new"))
+
+	// the original keeps its keys
+	require.Equal(t, keys, o.keys())
+	require.Equal(t, 1000, o.len())
+	require.Equal(t, 501, c.len())
+	require.Equal(t, "0001", c.keys()[0])
+	require.Equal(t, "new", c.keys()[500])
+}
+
+func BenchmarkBucket_BulkLoad(b *testing.B) {
+	const count = 1_000_000
+
+	keys := make([][]byte, count)
+	for i, k := range rand.New(rand.NewSource(0)).Perm(count) {
+		keys[i] = []byte(fmt.Sprintf("key%07d", k))
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		bucket := &dpBucket{Kv: make(kv)}
+
+		for _, k := range keys {
+			err := bucket.Set(k, k)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkOrder_Clone(b *testing.B) {
+	const count = 1_000_000
+
+	bucket := &dpBucket{Kv: make(kv)}
+	for i := 0; i < count; i++ {
+		k := []byte(fmt.Sprintf("key%07d", i))
+		bucket.Kv[string(k)] = k
+	}
+
+	bucket.updateIndex()
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		c := bucket.idx.clone()
+		c.insert("key")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// requireOrder checks that the set holds the keys in order, and that its nodes
+// are balanced.
+func requireOrder(t *testing.T, o *kOrder, set map[string]bool) {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	require.Equal(t, keys, o.keys())
+	require.Equal(t, len(keys), o.len())
+
+	var depth func(n *orderNode, root bool) int
+	depth = func(n *orderNode, root bool) int {
+		require.LessOrEqual(t, len(n.keys), maxOrderKeys)
+		if !root {
+			require.GreaterOrEqual(t, len(n.keys), minOrderKeys)
+		}
+
+		if len(n.children) == 0 {
+			return 1
+		}
+
+		require.Len(t, n.children, len(n.keys)+1)
+
+		d := depth(n.children[0], false)
+		for _, c := range n.children[1:] {
+			require.Equal(t, d, depth(c, false))
+		}
+
+		return d + 1
+	}
+
+	depth(o.root, true)
+}
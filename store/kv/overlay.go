@@ -0,0 +1,185 @@
+package purbkv
+
+import (
+	"bytes"
+	"slices"
+
+	"golang.org/x/xerrors"
+)
+
+// txBucket is a bucket of a transaction. It holds the keys that the
+// transaction sets or deletes on top of the saved bucket, which is never
+// modified during the transaction, so that a transaction does not copy the
+// buckets it accesses. The changes are applied to the saved bucket when the
+// transaction is committed.
+//
+// - implements kv.Bucket
+type txBucket struct {
+	// base is the saved bucket, or nil for a bucket created by the transaction
+	base    *dpBucket
+	writes  kv
+	deletes map[string]struct{}
+	// idx holds the keys of the bucket with the changes, and shares its nodes
+	// with the index of the saved bucket
+	idx kOrder
+}
+
+func newTxBucket(base *dpBucket) *txBucket {
+	b := &txBucket{
+		base:    base,
+		writes:  make(kv),
+		deletes: make(map[string]struct{}),
+	}
+
+	if base != nil {
+		b.idx = base.idx.clone()
+	}
+
+	return b
+}
+
+// Get implements kv.Bucket. It returns the value associated to the key, or nil
+// if it does not exist.
+func (b *txBucket) Get(key []byte) ([]byte, error) {
+	v, found := b.get(string(key))
+	if found {
+		return v, nil
+	}
+
+	return nil, xerrors.Errorf("failed to find key %v in bucket", string(key))
+}
+
+// Set implements kv.Bucket. It sets the provided key to a copy of the value.
+// Setting the saved value of the key is not a change.
+func (b *txBucket) Set(key, value []byte) error {
+	b.idx.insert(string(key))
+	delete(b.deletes, string(key))
+
+	if b.base != nil {
+		saved, found := b.base.Kv[string(key)]
+		if found && bytes.Equal(saved, value) {
+			delete(b.writes, string(key))
+			return nil
+		}
+	}
+
+	b.writes[string(key)] = slices.Clone(value)
+
+	return nil
+}
+
+// Delete implements kv.Bucket. It deletes the key from the bucket.
+func (b *txBucket) Delete(key []byte) error {
+	_, found := b.get(string(key))
+	if !found {
+		return nil
+	}
+
+	b.idx.remove(string(key))
+	delete(b.writes, string(key))
+
+	if b.base != nil {
+		_, saved := b.base.Kv[string(key)]
+		if saved {
+			b.deletes[string(key)] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// ForEach implements kv.Bucket. It iterates over the whole bucket in the order
+// of the keys. The keys are those of the bucket when the iteration starts, less
+// the ones the callback deletes. If the callback returns an error, the
+// iteration is stopped and the error returned to the caller.
+func (b *txBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.iterate(b.idx.keys(), fn)
+}
+
+// Scan implements kv.Bucket. It iterates over the keys matching the prefix in a
+// sorted order. The keys are those of the bucket when the iteration starts,
+// less the ones the callback deletes. If the callback returns an error, the
+// iteration is stopped and the error returned to the caller.
+func (b *txBucket) Scan(prefix []byte, fn func(k, v []byte) error) error {
+	return b.iterate(b.idx.prefixed(string(prefix)), fn)
+}
+
+// iterate calls the function for the keys that are still in the bucket, as the
+// function may modify it.
+func (b *txBucket) iterate(keys []string, fn func(k, v []byte) error) error {
+	for _, k := range keys {
+		v, found := b.get(k)
+		if !found {
+			continue
+		}
+
+		// the error of the callback is returned as is so that the caller can
+		// compare it
+		err := fn([]byte(k), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dirty returns true when the bucket is created or modified by the
+// transaction. A key that is set and then deleted, or set back to its saved
+// value, is not a change.
+func (b *txBucket) dirty() bool {
+	return b.base == nil || len(b.writes) > 0 || len(b.deletes) > 0
+}
+
+func (b *txBucket) get(key string) ([]byte, bool) {
+	v, found := b.writes[key]
+	if found {
+		return v, true
+	}
+
+	_, deleted := b.deletes[key]
+	if deleted || b.base == nil {
+		return nil, false
+	}
+
+	v, found = b.base.Kv[key]
+
+	return v, found
+}
+
+// apply writes the changes to the saved bucket, or to a new bucket, which it
+// returns. The caller must hold the lock of the buckets, as the saved bucket is
+// modified in place.
+func (b *txBucket) apply() *dpBucket {
+	if b.base == nil {
+		return &dpBucket{Kv: b.writes, idx: b.idx}
+	}
+
+	base := b.base
+
+	for k, v := range b.writes {
+		base.Kv[k] = v
+	}
+
+	for k := range b.deletes {
+		delete(base.Kv, k)
+	}
+
+	base.idx = b.idx
+	base.root = nil
+	base.tree = nil
+
+	return base
+}
+
+// staged returns a bucket that reads the changes on top of the saved bucket,
+// which is not modified, so that it can still be read while the staged bucket
+// is written. The changes are applied to the saved bucket when the staged one
+// is settled.
+func (b *txBucket) staged() *dpBucket {
+	if b.base == nil {
+		return &dpBucket{Kv: b.writes, idx: b.idx}
+	}
+
+	return &dpBucket{idx: b.idx, pending: b}
+}
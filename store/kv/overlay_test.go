@@ -0,0 +1,501 @@
+package purbkv
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestOverlay_Commit(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithScheduledWrites(time.Hour)}} {
+		testOverlayCommit(t, opts)
+	}
+}
+
+func TestOverlay_Revert(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &failingStore{BlobStore: NewMemoryStore()}
+
+	db, err := NewDB(dir, true, WithBlobStore(store))
+	require.NoError(t, err)
+	defer db.Close()
+
+	keys := setPairs(t, db, "bucket", 100)
+	root := db.(Prover).Root()
+
+	store.fail.Store(true)
+
+	err = db.Update(func(txn WritableTx) error {
+		b := txn.GetBucket([]byte("bucket"))
+
+		require.NoError(t, b.Set([]byte("key000"), []byte("changed")))
+		require.NoError(t, b.Set([]byte("new"), []byte("value")))
+		require.NoError(t, b.Delete([]byte("key050")))
+
+		return nil
+	})
+	require.ErrorContains(t, err, errStoreFailure.Error())
+
+	// the commit is not applied when it cannot be written
+	requirePairs(t, db, "bucket", keys)
+	require.Equal(t, root, db.(Prover).Root())
+
+	store.fail.Store(false)
+
+	keys = setPairs(t, db, "bucket", 101)
+	requirePairs(t, db, "bucket", keys)
+}
+
+func TestOverlay_Clean(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithShards(4), WithPaging(64)}} {
+		dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		store := &failingStore{BlobStore: NewMemoryStore()}
+
+		db, err := NewDB(dir, false, append(opts, WithBlobStore(store))...)
+		require.NoError(t, err)
+		defer db.Close()
+
+		keys := setPairs(t, db, "bucket", 100)
+
+		// the store fails as soon as the database is written
+		store.fail.Store(true)
+
+		committed := false
+
+		err = db.Update(func(txn WritableTx) error {
+			txn.OnCommit(func() { committed = true })
+
+			b, err := txn.GetBucketOrCreate([]byte("bucket"))
+			require.NoError(t, err)
+
+			_, err = b.Get([]byte("key000"))
+			require.NoError(t, err)
+
+			// a page is written as soon as it is modified
+			if opts == nil {
+				require.NoError(t, b.Set([]byte("temporary"), []byte("value")))
+				require.NoError(t, b.Delete([]byte("temporary")))
+			}
+
+			require.NoError(t, b.Delete([]byte("missing")))
+
+			require.Nil(t, txn.GetBucket([]byte("missing")))
+
+			return nil
+		})
+		require.NoError(t, err)
+		require.True(t, committed)
+
+		requirePairs(t, db, "bucket", keys)
+
+		// a new bucket is a change even when it is empty
+		err = db.Update(func(txn WritableTx) error {
+			_, err := txn.GetBucketOrCreate([]byte("empty"))
+			return err
+		})
+		require.ErrorContains(t, err, errStoreFailure.Error())
+
+		err = db.Update(func(txn WritableTx) error {
+			return txn.GetBucket([]byte("bucket")).Delete([]byte("key000"))
+		})
+		require.ErrorContains(t, err, errStoreFailure.Error())
+
+		requirePairs(t, db, "bucket", keys)
+
+		store.fail.Store(false)
+	}
+}
+
+func TestOverlay_Unchanged(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithShards(4), WithPaging(64)}} {
+		dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		store := &failingStore{BlobStore: NewMemoryStore()}
+
+		db, err := NewDB(dir, false, append(opts, WithBlobStore(store))...)
+		require.NoError(t, err)
+		defer db.Close()
+
+		keys := setPairs(t, db, "bucket", 100)
+
+		store.puts.Store(0)
+
+		err = db.Update(func(txn WritableTx) error {
+			b := txn.GetBucket([]byte("bucket"))
+
+			// the saved value is set again
+			require.NoError(t, b.Set([]byte("key000"), []byte("value000")))
+
+			require.NoError(t, b.Delete([]byte("missing")))
+
+			return nil
+		})
+		require.NoError(t, err)
+		require.Zero(t, store.puts.Load())
+
+		if opts == nil {
+			err = db.Update(func(txn WritableTx) error {
+				b := txn.GetBucket([]byte("bucket"))
+
+				// the key is modified and then restored
+				require.NoError(t, b.Set([]byte("key001"), []byte("other")))
+				require.NoError(t, b.Set([]byte("key001"), []byte("value001")))
+
+				// the key is deleted and then restored
+				require.NoError(t, b.Delete([]byte("key002")))
+				require.NoError(t, b.Set([]byte("key002"), []byte("value002")))
+
+				return nil
+			})
+			require.NoError(t, err)
+			require.Zero(t, store.puts.Load())
+		}
+
+		requirePairs(t, db, "bucket", keys)
+
+		setValue(t, db, []byte("key000"), []byte("changed"))
+		require.NotZero(t, store.puts.Load())
+	}
+}
+
+func TestOverlay_Forget(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newBlockingStore(NewMemoryStore())
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithShards(4), WithLazyLoading(),
+		WithScheduledWrites(time.Hour))
+	require.NoError(t, err)
+	defer db.Close()
+
+	p := db.(*purbDB)
+
+	setBuckets(t, db, "a", "b")
+
+	store.block.Store(true)
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- db.(Flusher).Flush() }()
+
+	<-store.entered
+
+	updated := make(chan error, 1)
+	go func() {
+		updated <- db.Update(func(txn WritableTx) error {
+			return txn.GetBucket([]byte("a")).Set([]byte("key"), []byte("changed"))
+		})
+	}()
+
+	// the commit waits for the flush, but not the transactions that read
+	require.Never(t, func() bool { return len(updated) > 0 }, 50*time.Millisecond, time.Millisecond)
+	requireValue(t, db, "a", "key", "a")
+
+	store.block.Store(false)
+	close(store.release)
+
+	require.NoError(t, <-flushed)
+	require.NoError(t, <-updated)
+
+	// the bucket modified after the flush is still pending
+	p.bucketDb.RLock()
+	require.Contains(t, p.bucketDb.Db, "a")
+	require.NotContains(t, p.bucketDb.Db, "b")
+	p.bucketDb.RUnlock()
+
+	requireValue(t, db, "a", "key", "changed")
+}
+
+func TestOverlay_Snapshot(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithShards(4), WithLazyLoading(), WithMemoryBudget(1)}} {
+		dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		store := newBlockingStore(NewMemoryStore())
+
+		db, err := NewDB(dir, true, append(opts, WithBlobStore(store))...)
+		require.NoError(t, err)
+		defer db.Close()
+
+		setBuckets(t, db, "a", "b")
+
+		store.block.Store(true)
+
+		updated := make(chan error, 1)
+		go func() {
+			updated <- db.Update(func(txn WritableTx) error {
+				return txn.GetBucket([]byte("a")).Set([]byte("key"), []byte("changed"))
+			})
+		}()
+
+		<-store.entered
+
+		// the transactions that read do not wait for the commit to be written,
+		// and they do not see its changes
+		requireValue(t, db, "a", "key", "a")
+		requireValue(t, db, "b", "key", "b")
+
+		store.block.Store(false)
+		close(store.release)
+
+		require.NoError(t, <-updated)
+
+		requireValue(t, db, "a", "key", "changed")
+		requireValue(t, db, "b", "key", "b")
+	}
+}
+
+func TestOverlay_ScanDelete(t *testing.T) {
+	db, err := NewMemoryDB(false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	setPairs(t, db, "saved", 500)
+
+	counts := make(map[string]int)
+
+	// the nodes of the keys set in the transaction belong to it, and they are
+	// modified in place by the deletions
+	err = db.Update(func(txn WritableTx) error {
+		for _, name := range []string{"saved", "new"} {
+			b, err := txn.GetBucketOrCreate([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			for i := 0; i < 1000; i++ {
+				err = b.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("value"))
+				if err != nil {
+					return err
+				}
+			}
+
+			err = b.Scan([]byte("key"), func(k, v []byte) error {
+				counts[name]++
+				return b.Delete(k)
+			})
+			if err != nil {
+				return err
+			}
+
+			err = b.ForEach(func(k, v []byte) error {
+				return xerrors.Errorf("key %s is not deleted", k)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 1500, counts["saved"])
+	require.Equal(t, 1000, counts["new"])
+
+	requirePairs(t, db, "saved", nil)
+	requirePairs(t, db, "new", nil)
+}
+
+func BenchmarkOverlay_Update(b *testing.B) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithScheduledWrites(time.Hour))
+	require.NoError(b, err)
+	defer db.Close()
+
+	err = db.Update(func(txn WritableTx) error {
+		bucket, err := txn.GetBucketOrCreate([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 1_000_000; i++ {
+			err = bucket.Set([]byte(fmt.Sprintf("key%07d", i)), []byte("value"))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(b, err)
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		err = db.Update(func(txn WritableTx) error {
+			return txn.GetBucket([]byte("bucket")).Set([]byte("key"), []byte("value"))
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// the database is written when it is closed
+	b.StopTimer()
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func testOverlayCommit(t *testing.T, opts []Option) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, opts...)
+	require.NoError(t, err)
+	defer db.Close()
+
+	setPairs(t, db, "bucket", 100)
+
+	p := db.(*purbDB)
+	saved := p.bucketDb.Db["bucket"]
+	root := db.(Prover).Root()
+
+	err = db.Update(func(txn WritableTx) error {
+		b := txn.GetBucket([]byte("bucket"))
+
+		require.NoError(t, b.Set([]byte("key000"), []byte("changed")))
+		require.NoError(t, b.Set([]byte("key100"), []byte("value100")))
+		require.NoError(t, b.Delete([]byte("key050")))
+		require.NoError(t, b.Delete([]byte("missing")))
+
+		// the saved bucket is not copied nor modified by the transaction
+		require.Len(t, saved.Kv, 100)
+		require.Equal(t, []byte("value000"), saved.Kv["key000"])
+		require.Len(t, b.(*txBucket).writes, 2)
+
+		var scanned []string
+
+		err := b.Scan([]byte("key0"), func(k, v []byte) error {
+			scanned = append(scanned, string(k))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, scanned, 99)
+		require.NotContains(t, scanned, "key050")
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	if p.durability == DurabilitySync {
+		// the saved bucket can be read while the commit is written, and the
+		// changes are applied to its keys once it is written rather than to
+		// a copy
+		require.NotSame(t, saved, p.bucketDb.Db["bucket"])
+		require.Equal(t, reflect.ValueOf(saved.Kv).Pointer(),
+			reflect.ValueOf(p.bucketDb.Db["bucket"].Kv).Pointer())
+	} else {
+		// the changes are applied to the saved bucket
+		require.Same(t, saved, p.bucketDb.Db["bucket"])
+	}
+
+	saved = p.bucketDb.Db["bucket"]
+
+	require.Equal(t, []byte("changed"), saved.Kv["key000"])
+	require.NotContains(t, saved.Kv, "key050")
+	require.Equal(t, 100, saved.idx.len())
+	require.NotEqual(t, root, db.(Prover).Root())
+
+	err = db.Update(func(txn WritableTx) error {
+		b := txn.GetBucket([]byte("bucket"))
+
+		require.NoError(t, b.Set([]byte("key000"), []byte("value000")))
+		require.NoError(t, b.Set([]byte("key050"), []byte("value050")))
+		require.NoError(t, b.Delete([]byte("key100")))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	keys := setPairs(t, db, "other", 100)
+	requirePairs(t, db, "bucket", keys)
+	require.Equal(t, keys, p.bucketDb.Db["bucket"].idx.keys())
+
+	// the cached root is computed again
+	other, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+
+	fresh, err := NewDB(other, false)
+	require.NoError(t, err)
+	defer fresh.Close()
+
+	setPairs(t, fresh, "bucket", 100)
+	setPairs(t, fresh, "other", 100)
+
+	require.Equal(t, fresh.(Prover).Root(), db.(Prover).Root())
+}
+
+var errStoreFailure = xerrors.New("store failure")
+
+// failingStore is a store that counts the writes, and fails them when it is
+// told to.
+type failingStore struct {
+	BlobStore
+
+	fail atomic.Bool
+	puts atomic.Int64
+}
+
+func (s *failingStore) Put(name string, data []byte) error {
+	if s.fail.Load() {
+		return errStoreFailure
+	}
+
+	s.puts.Add(1)
+
+	return s.BlobStore.Put(name, data)
+}
+
+// blockingStore is a store whose writes wait to be released once it is
+// blocked.
+type blockingStore struct {
+	BlobStore
+
+	block   atomic.Bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingStore(store BlobStore) *blockingStore {
+	return &blockingStore{
+		BlobStore: store,
+		entered:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+}
+
+func (s *blockingStore) Put(name string, data []byte) error {
+	if s.block.Load() {
+		select {
+		case s.entered <- struct{}{}:
+		default:
+		}
+
+		<-s.release
+	}
+
+	return s.BlobStore.Put(name, data)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package purbkv
+
+import "os"
+
+// fileOwner is not supported on this platform and never reports an owner.
+func fileOwner(info os.FileInfo) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,99 @@
+package purbkv
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// ErrSizeExceeded is returned when the payload does not fit in a fixed size
+// padding that is not allowed to grow.
+var ErrSizeExceeded = errors.New("payload exceeds the fixed size")
+
+// Padding defines how much a payload is padded before it is encrypted into a
+// PURB. The PURB itself always applies Padmé on top of it.
+type Padding interface {
+	// PaddedLength returns the length of a payload of n bytes once padded, or
+	// an error if the payload cannot be padded.
+	PaddedLength(n int) (int, error)
+}
+
+// PadmePadding returns the default policy that leaves the padding to libpurb,
+// which uses Padmé and leaks O(log log n) bits of the size.
+func PadmePadding() Padding {
+	return padme{}
+}
+
+// BucketPadding returns a policy that pads the payload to the next multiple of
+// the given size, so that only the number of buckets is leaked.
+func BucketPadding(size int) Padding {
+	return bucket{size: size}
+}
+
+// PowerOfTwoPadding returns a policy that pads the payload to the next power
+// of two, so that only O(log log n) bits of the size are leaked, at the cost of
+// up to twice the storage.
+func PowerOfTwoPadding() Padding {
+	return powerOfTwo{}
+}
+
+// FixedSizePadding returns a policy that pads the payload to the given size so
+// that the size of the file does not depend on the content. When the payload
+// exceeds the size, the size is increased by the given step, or
+// ErrSizeExceeded is returned if the step is zero.
+func FixedSizePadding(size, step int) Padding {
+	return fixedSize{size: size, step: step}
+}
+
+type padme struct{}
+
+// PaddedLength implements purbkv.Padding.
+func (padme) PaddedLength(n int) (int, error) {
+	return n, nil
+}
+
+type bucket struct {
+	size int
+}
+
+// PaddedLength implements purbkv.Padding.
+func (b bucket) PaddedLength(n int) (int, error) {
+	if b.size <= 0 || n == 0 {
+		return n, nil
+	}
+
+	return roundUp(n, b.size), nil
+}
+
+type powerOfTwo struct{}
+
+// PaddedLength implements purbkv.Padding.
+func (powerOfTwo) PaddedLength(n int) (int, error) {
+	if n <= 1 {
+		return n, nil
+	}
+
+	return 1 << bits.Len(uint(n-1)), nil
+}
+
+type fixedSize struct {
+	size int
+	step int
+}
+
+// PaddedLength implements purbkv.Padding.
+func (f fixedSize) PaddedLength(n int) (int, error) {
+	if n <= f.size {
+		return f.size, nil
+	}
+
+	if f.step <= 0 {
+		return 0, ErrSizeExceeded
+	}
+
+	return f.size + roundUp(n-f.size, f.step), nil
+}
+
+// roundUp returns the smallest multiple of m greater or equal to n.
+func roundUp(n, m int) int {
+	return (n + m - 1) / m * m
+}
@@ -0,0 +1,61 @@
+package purbkv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPadding_Padme(t *testing.T) {
+	p := PadmePadding()
+
+	requirePadded(t, 0, p, 0)
+	requirePadded(t, 1000, p, 1000)
+}
+
+func TestPadding_Bucket(t *testing.T) {
+	p := BucketPadding(4096)
+
+	requirePadded(t, 0, p, 0)
+	requirePadded(t, 4096, p, 1)
+	requirePadded(t, 4096, p, 4096)
+	requirePadded(t, 8192, p, 4097)
+
+	requirePadded(t, 10, BucketPadding(0), 10)
+}
+
+func TestPadding_PowerOfTwo(t *testing.T) {
+	p := PowerOfTwoPadding()
+
+	requirePadded(t, 0, p, 0)
+	requirePadded(t, 1, p, 1)
+	requirePadded(t, 2, p, 2)
+	requirePadded(t, 1024, p, 513)
+	requirePadded(t, 1024, p, 1024)
+	requirePadded(t, 2048, p, 1025)
+}
+
+func TestPadding_FixedSize(t *testing.T) {
+	p := FixedSizePadding(1000, 0)
+
+	requirePadded(t, 1000, p, 0)
+	requirePadded(t, 1000, p, 1000)
+
+	_, err := p.PaddedLength(1001)
+	require.ErrorIs(t, err, ErrSizeExceeded)
+
+	p = FixedSizePadding(1000, 500)
+
+	requirePadded(t, 1000, p, 10)
+	requirePadded(t, 1500, p, 1001)
+	requirePadded(t, 2000, p, 1501)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func requirePadded(t *testing.T, expected int, p Padding, n int) {
+	size, err := p.PaddedLength(n)
+	require.NoError(t, err)
+	require.Equal(t, expected, size)
+}
@@ -0,0 +1,1124 @@
+package purbkv
+
+// This file implements the paged layout, which splits the buckets of a sharded
+// database in pages so that a bucket does not have to fit in memory. The pages
+// of a bucket form a B+ tree: the leaves hold ranges of its pairs, and the
+// inner pages map the first key of each of their children to the page of the
+// child. Every page is a file of its own, encoded and encrypted like a shard
+// that holds a single bucket with the empty name, and the shards only hold the
+// root of every bucket, in a bucket with its name:
+//
+//	root = level (uvarint) | page
+//	page = generation (uvarint) | index (uvarint)
+//
+// The leaves are at level zero, and a key belongs to the child with the
+// greatest first key that is not greater than the key, or to the first child
+// when there is none. A page is split in two when it grows over the page size,
+// and it is removed when it becomes empty unless it is the root, which is
+// replaced by its child when it only has one.
+//
+// A page is never modified once it is written. A transaction copies the pages
+// it modifies with the pages on their path to the root, and the commit writes
+// the copies before the manifest. A page is named after the database file, the
+// generation of the commit that wrote it and its index among the pages of the
+// commit, for instance purb.db.page.17.3, and the pages that are not written
+// yet have the generation zero. The pages that a commit replaces are listed as
+// stale in the manifest, and deleted after it like the shards.
+//
+// The pages that are read are held by the cache of the shards, so that the
+// memory budget bounds both of them.
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.dedis.ch/dela"
+	"golang.org/x/exp/maps"
+	"golang.org/x/xerrors"
+)
+
+// defaultPageSize is the size of the pages when a paged database is opened
+// without a page size.
+const defaultPageSize = 64 << 10
+
+// maxLevels bounds the height of the tree of a bucket read from a shard.
+const maxLevels = 64
+
+// pageRef is a page of a paged database.
+type pageRef struct {
+	// generation is the one of the commit that wrote the page, or zero when
+	// it is not written yet
+	generation uint64
+	// index is the index of the page among the pages of its generation
+	index uint64
+}
+
+// pageName returns the name of the file of the page.
+func pageName(dbName string, ref pageRef) string {
+	return fmt.Sprintf("%s.page.%d.%d", dbName, ref.generation, ref.index)
+}
+
+// parsePageName returns the page of the file with the given name, or false
+// when it is not the file of a page of the database file.
+func parsePageName(dbName, name string) (pageRef, bool) {
+	var ref pageRef
+
+	_, err := fmt.Sscanf(name, dbName+".page.%d.%d", &ref.generation, &ref.index)
+	if err != nil || pageName(dbName, ref) != name {
+		return pageRef{}, false
+	}
+
+	return ref, true
+}
+
+func encodePageRef(ref pageRef) []byte {
+	buf := new(bytes.Buffer)
+
+	writeUvarint(buf, ref.generation)
+	writeUvarint(buf, ref.index)
+
+	return buf.Bytes()
+}
+
+// decodePageRef returns the page of a value of an inner page. Errors wrap
+// ErrCorrupted.
+func decodePageRef(data []byte) (pageRef, error) {
+	r := bytes.NewReader(data)
+
+	ref, err := readPageRef(r)
+	if err != nil {
+		return pageRef{}, err
+	}
+
+	if r.Len() > 0 {
+		return pageRef{}, xerrors.Errorf("%w: unexpected length of page", ErrCorrupted)
+	}
+
+	return ref, nil
+}
+
+func encodeRoot(level int, ref pageRef) []byte {
+	buf := new(bytes.Buffer)
+
+	writeUvarint(buf, uint64(level))
+	buf.Write(encodePageRef(ref))
+
+	return buf.Bytes()
+}
+
+// decodeRoot returns the level and the page of the root of a bucket. Errors
+// wrap ErrCorrupted.
+func decodeRoot(data []byte) (int, pageRef, error) {
+	r := bytes.NewReader(data)
+
+	level, err := readUvarint(r)
+	if err != nil {
+		return 0, pageRef{}, xerrors.Errorf("%w: failed to read level: %v", ErrCorrupted, err)
+	}
+
+	if level >= maxLevels {
+		return 0, pageRef{}, xerrors.Errorf("%w: invalid level %d", ErrCorrupted, level)
+	}
+
+	ref, err := readPageRef(r)
+	if err != nil {
+		return 0, pageRef{}, err
+	}
+
+	if r.Len() > 0 {
+		return 0, pageRef{}, xerrors.Errorf("%w: unexpected length of root", ErrCorrupted)
+	}
+
+	return int(level), ref, nil
+}
+
+func readPageRef(r *bytes.Reader) (pageRef, error) {
+	var ref pageRef
+	var err error
+
+	ref.generation, err = readUvarint(r)
+	if err == nil {
+		ref.index, err = readUvarint(r)
+	}
+	if err != nil {
+		return pageRef{}, xerrors.Errorf("%w: failed to read page: %v", ErrCorrupted, err)
+	}
+
+	return ref, nil
+}
+
+// pageSize returns the number of bytes of the keys and values of the page.
+func pageSize(page *dpBucket) int {
+	return bucketsSize(map[string]*dpBucket{"": page})
+}
+
+// pageSet is the pages of a paged database that are not saved yet.
+type pageSet struct {
+	// added are the pages of the generation zero, and a nil page is a page of
+	// the state that a transaction removes
+	added map[pageRef]*dpBucket
+	// stale are the saved pages that are replaced
+	stale []pageRef
+	// count is the number of pages of the generation zero that were added
+	count uint64
+}
+
+// merge returns the pages with the changes of a transaction.
+func (s pageSet) merge(changes pageSet) pageSet {
+	next := pageSet{
+		added: make(map[pageRef]*dpBucket, len(s.added)+len(changes.added)),
+		stale: append(slices.Clip(s.stale), changes.stale...),
+		count: max(s.count, changes.count),
+	}
+
+	maps.Copy(next.added, s.added)
+
+	for ref, page := range changes.added {
+		if page == nil {
+			delete(next.added, ref)
+		} else {
+			next.added[ref] = page
+		}
+	}
+
+	return next
+}
+
+// joinPages returns the buckets of a paged database from their roots, for the
+// tools that do not open it. The pages are read with the function, which
+// reports their own problems and returns nil when a page cannot be read. The
+// pairs of a bucket that can be read are kept when some of its pages are
+// damaged or missing, and the problems of the trees are passed to the function
+// with errors that wrap ErrCorrupted.
+func joinPages(roots map[string]*dpBucket, read func(bucket string, ref pageRef) *dpBucket,
+	problem func(bucket string, err error)) map[string]*dpBucket {
+
+	buckets := make(map[string]*dpBucket)
+
+	for name, root := range roots {
+		bucket := &dpBucket{Kv: make(kv)}
+
+		ok := walkPages(name, root, read, problem, func(leaf *dpBucket) {
+			maps.Copy(bucket.Kv, leaf.Kv)
+		})
+		if !ok {
+			continue
+		}
+
+		bucket.updateIndex()
+		buckets[name] = bucket
+	}
+
+	return buckets
+}
+
+// walkPages reads the pages of the tree of a bucket from its root, like
+// joinPages, and calls the function with its leaves in order. It returns false
+// when the root cannot be decoded.
+func walkPages(name string, root *dpBucket, read func(bucket string, ref pageRef) *dpBucket,
+	problem func(bucket string, err error), leaf func(page *dpBucket)) bool {
+
+	level, ref, err := decodeRoot(root.Kv[""])
+	if err != nil {
+		problem(name, err)
+		return false
+	}
+
+	w := pageWalker{
+		name:    name,
+		read:    read,
+		problem: problem,
+		leaf:    leaf,
+	}
+
+	w.walk(ref, level, "", "", false)
+
+	return true
+}
+
+// pageWalker reads the pages of the tree of a bucket.
+type pageWalker struct {
+	name    string
+	read    func(bucket string, ref pageRef) *dpBucket
+	problem func(bucket string, err error)
+	leaf    func(page *dpBucket)
+}
+
+// walk reads the page and its children, whose keys must be in the range from
+// the lower key to the upper one, excluded, when it is bounded.
+func (w *pageWalker) walk(ref pageRef, level int, lower, upper string, bounded bool) {
+	if ref.generation == 0 {
+		w.problem(w.name, xerrors.Errorf("%w: page %d is not saved", ErrCorrupted, ref.index))
+		return
+	}
+
+	page := w.read(w.name, ref)
+	if page == nil {
+		return
+	}
+
+	keys := page.idx.keys()
+
+	for _, k := range keys {
+		if k < lower || bounded && k >= upper {
+			w.problem(w.name, xerrors.Errorf("%w: key %q is out of page %d.%d",
+				ErrCorrupted, k, ref.generation, ref.index))
+		}
+	}
+
+	if level == 0 {
+		w.leaf(page)
+		return
+	}
+
+	if len(keys) == 0 {
+		w.problem(w.name, xerrors.Errorf("%w: inner page %d.%d is empty",
+			ErrCorrupted, ref.generation, ref.index))
+	}
+
+	for i, k := range keys {
+		child, err := decodePageRef(page.Kv[k])
+		if err != nil {
+			w.problem(w.name, err)
+			continue
+		}
+
+		// the first child also holds the keys before its first key
+		from := k
+		if i == 0 {
+			from = lower
+		}
+
+		if i+1 < len(keys) {
+			w.walk(child, level-1, from, keys[i+1], true)
+		} else {
+			w.walk(child, level-1, from, upper, bounded)
+		}
+	}
+}
+
+// pageWriter writes the pages that are not saved yet under the generation of
+// a commit.
+type pageWriter struct {
+	p          *purbDB
+	pages      pageSet
+	generation uint64
+	// written are the pages written in order, with their content
+	written []pageRef
+	saved   map[pageRef]*dpBucket
+}
+
+// writePages writes the pages of the buckets that are not saved yet, and
+// returns the buckets with the roots of the pages written, and the content of
+// the pages. The pages that are written are deleted when one of them fails.
+func (p *purbDB) writePages(db map[string]*dpBucket, pages pageSet,
+	generation uint64) (map[string]*dpBucket, map[pageRef]*dpBucket, error) {
+
+	w := pageWriter{
+		p:          p,
+		pages:      pages,
+		generation: generation,
+		saved:      make(map[pageRef]*dpBucket),
+	}
+
+	next := maps.Clone(db)
+
+	// the buckets are written in order so that the same state gives the same
+	// pages
+	names := maps.Keys(db)
+	slices.Sort(names)
+
+	for _, name := range names {
+		level, ref, err := decodeRoot(db[name].Kv[""])
+		if err == nil && ref.generation != 0 {
+			continue
+		}
+
+		if err == nil {
+			ref, err = w.write(ref, level)
+		}
+		if err != nil {
+			p.deletePages(w.written)
+			return nil, nil, xerrors.Errorf("bucket %q: %v", name, err)
+		}
+
+		root := &dpBucket{Kv: make(kv)}
+		root.Set(nil, encodeRoot(level, ref))
+
+		next[name] = root
+	}
+
+	return next, w.saved, nil
+}
+
+// write writes the page, after its children when it is an inner page, and
+// returns its new reference. A page that is saved is not written again.
+func (w *pageWriter) write(ref pageRef, level int) (pageRef, error) {
+	if ref.generation != 0 {
+		return ref, nil
+	}
+
+	page := w.pages.added[ref]
+	if page == nil {
+		return pageRef{}, xerrors.Errorf("page %d is missing", ref.index)
+	}
+
+	if level > 0 {
+		inner := &dpBucket{Kv: make(kv, len(page.Kv)), idx: page.idx.clone()}
+
+		for _, k := range page.idx.keys() {
+			child, err := decodePageRef(page.Kv[k])
+			if err == nil {
+				child, err = w.write(child, level-1)
+			}
+			if err != nil {
+				return pageRef{}, err
+			}
+
+			inner.Kv[k] = encodePageRef(child)
+		}
+
+		page = inner
+	}
+
+	ref = pageRef{generation: w.generation, index: uint64(len(w.written))}
+
+	data, err := w.p.encode(map[string]*dpBucket{"": page})
+	if err == nil {
+		err = w.p.store.Put(pageName(w.p.dbName, ref), data)
+		wipe(data)
+	}
+	if err != nil {
+		return pageRef{}, xerrors.Errorf("failed to save page: %v", err)
+	}
+
+	w.written = append(w.written, ref)
+	w.saved[ref] = page
+
+	return ref, nil
+}
+
+// deletePages deletes the pages, the last written first so that the pages of
+// a generation that are left behind always start at the index zero. A failure
+// is only logged as the pages are not used anymore.
+func (p *purbDB) deletePages(refs []pageRef) {
+	for i := len(refs) - 1; i >= 0; i-- {
+		name := pageName(p.dbName, refs[i])
+
+		err := p.store.Delete(name)
+		if err != nil {
+			dela.Logger.Warn().Err(err).Msgf("failed to delete page %s", name)
+		}
+	}
+}
+
+// deleteOrphanPages deletes the pages of a generation that has no manifest,
+// which are left behind by a commit interrupted before its manifest.
+func (p *purbDB) deleteOrphanPages(generation uint64) {
+	var orphans []pageRef
+
+	for {
+		ref := pageRef{generation: generation, index: uint64(len(orphans))}
+
+		exists, err := p.store.Exists(pageName(p.dbName, ref))
+		if err != nil {
+			dela.Logger.Warn().Err(err).Msg("failed to look for orphan pages")
+			break
+		}
+
+		if !exists {
+			break
+		}
+
+		orphans = append(orphans, ref)
+	}
+
+	p.deletePages(orphans)
+}
+
+// migratePages writes the pages of the buckets whose roots are given in the
+// format of the other database, and adds them to the pages written. A page is
+// read from the cache, and its children are written after it.
+func (p *purbDB) migratePages(next *purbDB, roots map[string]*dpBucket, written *[]pageRef) error {
+	for name, root := range roots {
+		level, ref, err := decodeRoot(root.Kv[""])
+		if err == nil {
+			err = p.migratePage(next, ref, level, written)
+		}
+		if err != nil {
+			return xerrors.Errorf("bucket %q: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *purbDB) migratePage(next *purbDB, ref pageRef, level int, written *[]pageRef) error {
+	page, err := p.cache.page(ref)
+	if err != nil {
+		return xerrors.Errorf("failed to read page: %v", err)
+	}
+
+	data, err := next.encode(map[string]*dpBucket{"": page})
+	if err == nil {
+		err = p.store.Put(pageName(next.dbName, ref), data)
+		wipe(data)
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to write page: %v", err)
+	}
+
+	*written = append(*written, ref)
+
+	if level == 0 {
+		return nil
+	}
+
+	for _, k := range page.idx.keys() {
+		child, err := decodePageRef(page.Kv[k])
+		if err == nil {
+			err = p.migratePage(next, child, level-1, written)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readPage reads a page of a paged database.
+func (p *purbDB) readPage(ref pageRef) (map[string]*dpBucket, error) {
+	name := pageName(p.dbName, ref)
+
+	buckets, err := p.readBuckets(name)
+	if err != nil {
+		return nil, xerrors.Errorf("page %s: %w", name, err)
+	}
+
+	if len(buckets) != 1 || buckets[""] == nil {
+		return nil, xerrors.Errorf("%w: page %s holds %d bucket(s)", ErrCorrupted, name, len(buckets))
+	}
+
+	return buckets, nil
+}
+
+// pagedBucket is a bucket of a paged database in a transaction.
+//
+// - implements kv.Bucket
+type pagedBucket struct {
+	tx   *dpTx
+	name string
+	// level is the level of the root, which is a leaf at the level zero
+	level int
+	root  pageRef
+	// sizes are the sizes of the pages copied by the transaction
+	sizes map[pageRef]int
+	// inserted are the keys added while the bucket is iterated, which are not
+	// visited by the iteration
+	inserted map[string]struct{}
+	// changes counts the modifications of the bucket, so that an iteration
+	// knows when the leaf it reads is outdated
+	changes int
+}
+
+// pageStep is a page on the path from the root of a bucket to a leaf.
+type pageStep struct {
+	ref  pageRef
+	page *dpBucket
+	// first is the key of the page in its parent
+	first string
+	// upper is the first key after the keys of the page when bounded is true
+	upper   string
+	bounded bool
+}
+
+// getPaged returns the bucket of a paged database, or nil if it does not exist.
+func (tx *dpTx) getPaged(name string) *pagedBucket {
+	b, found := tx.buckets[name]
+	if found {
+		return b
+	}
+
+	root := tx.read(name)
+	if root == nil {
+		return nil
+	}
+
+	level, ref, err := decodeRoot(root.Kv[""])
+	if err != nil {
+		tx.fail(xerrors.Errorf("bucket %q: %w", name, err))
+		return nil
+	}
+
+	return tx.addPaged(name, level, ref)
+}
+
+// createPaged creates a bucket with a single empty page.
+func (tx *dpTx) createPaged(name string) *pagedBucket {
+	b := tx.addPaged(name, 0, tx.addPage(&dpBucket{Kv: make(kv)}))
+	b.saveRoot()
+
+	return b
+}
+
+func (tx *dpTx) addPaged(name string, level int, root pageRef) *pagedBucket {
+	if tx.buckets == nil {
+		tx.buckets = make(map[string]*pagedBucket)
+	}
+
+	b := &pagedBucket{
+		tx:    tx,
+		name:  name,
+		level: level,
+		root:  root,
+		sizes: make(map[pageRef]int),
+	}
+
+	tx.buckets[name] = b
+
+	return b
+}
+
+// read returns a bucket of the state of the database without copying it, or
+// nil if it does not exist.
+func (tx *dpTx) read(name string) *dpBucket {
+	b, found := tx.new.Db[name]
+	if found {
+		return b
+	}
+
+	b, found = tx.db.Db[name]
+	if found {
+		return b
+	}
+
+	b, _ = tx.load(name)
+
+	return b
+}
+
+// readPage returns a page without copying it, or nil when it cannot be read,
+// which fails the transaction.
+func (tx *dpTx) readPage(ref pageRef) *dpBucket {
+	if tx.err != nil {
+		return nil
+	}
+
+	page, found := tx.new.pages.added[ref]
+	if !found {
+		page, found = tx.db.pages.added[ref]
+	}
+
+	if found && page != nil {
+		return page
+	}
+
+	if ref.generation == 0 {
+		tx.fail(xerrors.Errorf("page %d is missing", ref.index))
+		return nil
+	}
+
+	page, err := tx.cache.page(ref)
+	if err != nil {
+		tx.fail(xerrors.Errorf("failed to load page: %w", err))
+		return nil
+	}
+
+	return page
+}
+
+// addPage adds a page to the transaction, and returns its reference.
+func (tx *dpTx) addPage(page *dpBucket) pageRef {
+	pages := tx.pages()
+
+	ref := pageRef{index: pages.count}
+	pages.count++
+	pages.added[ref] = page
+
+	return ref
+}
+
+// dropPage removes a page that the transaction replaces or empties.
+func (tx *dpTx) dropPage(ref pageRef) {
+	pages := tx.pages()
+
+	switch {
+	case ref.generation != 0:
+		pages.stale = append(pages.stale, ref)
+	case pages.added[ref] != nil:
+		delete(pages.added, ref)
+	default:
+		pages.added[ref] = nil
+	}
+}
+
+// owns returns true if the page is a copy of the transaction.
+func (tx *dpTx) owns(ref pageRef) bool {
+	return ref.generation == 0 && tx.new.pages.added[ref] != nil
+}
+
+// pages returns the pages of the transaction, whose references follow the
+// ones of the state.
+func (tx *dpTx) pages() *pageSet {
+	if tx.new.pages.added == nil {
+		tx.new.pages.added = make(map[pageRef]*dpBucket)
+		tx.new.pages.count = tx.db.pages.count
+	}
+
+	return &tx.new.pages
+}
+
+// Get implements kv.Bucket. It returns the value associated to the key, or nil
+// if it does not exist.
+func (b *pagedBucket) Get(key []byte) ([]byte, error) {
+	v, found, err := b.lookup(string(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		return v, nil
+	}
+
+	return nil, xerrors.Errorf("failed to find key %v in bucket", string(key))
+}
+
+// Set implements kv.Bucket. It sets the provided key to a copy of the value,
+// and splits the pages that grow over the page size.
+func (b *pagedBucket) Set(key, value []byte) error {
+	// the pages are not copied when the value does not change
+	old, found, err := b.lookup(string(key))
+	if err != nil {
+		return err
+	}
+	if found && bytes.Equal(old, value) {
+		return nil
+	}
+
+	if !found && b.inserted != nil {
+		b.inserted[string(key)] = struct{}{}
+	}
+
+	b.changes++
+
+	steps, err := b.copyPath(string(key))
+	if err != nil {
+		return err
+	}
+
+	leaf := len(steps) - 1
+
+	err = b.put(steps[leaf], string(key), value)
+	if err != nil {
+		return err
+	}
+
+	return b.split(steps, leaf)
+}
+
+// Delete implements kv.Bucket. It deletes the key from the bucket, and removes
+// the pages that become empty.
+func (b *pagedBucket) Delete(key []byte) error {
+	_, found, err := b.lookup(string(key))
+	if err != nil || !found {
+		return err
+	}
+
+	b.changes++
+
+	steps, err := b.copyPath(string(key))
+	if err != nil {
+		return err
+	}
+
+	i := len(steps) - 1
+
+	err = b.remove(steps[i], string(key))
+	if err != nil {
+		return err
+	}
+
+	for ; i > 0 && steps[i].page.idx.len() == 0; i-- {
+		err = b.remove(steps[i-1], steps[i].first)
+		if err != nil {
+			return err
+		}
+
+		b.tx.dropPage(steps[i].ref)
+		delete(b.sizes, steps[i].ref)
+	}
+
+	// the bucket is left with an empty leaf when all its pages are removed
+	if b.level > 0 && steps[0].page.idx.len() == 0 {
+		b.tx.dropPage(b.root)
+		delete(b.sizes, b.root)
+
+		b.level = 0
+		b.root = b.tx.addPage(&dpBucket{Kv: make(kv)})
+		b.saveRoot()
+	}
+
+	return b.shrink()
+}
+
+// ForEach implements kv.Bucket. It iterates over the whole bucket in the order
+// of the keys. The keys are those of the bucket when the iteration starts, less
+// the ones the callback deletes. If the callback returns an error, the
+// iteration is stopped and the error returned to the caller.
+func (b *pagedBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.iterate("", func(k string, v []byte) (bool, error) {
+		return true, fn([]byte(k), v)
+	})
+}
+
+// Scan implements kv.Bucket. It iterates over the keys matching the prefix in a
+// sorted order. The keys are those of the bucket when the iteration starts,
+// less the ones the callback deletes. If the callback returns an error, the
+// iteration is stopped and the error returned to the caller.
+func (b *pagedBucket) Scan(prefix []byte, fn func(k, v []byte) error) error {
+	return b.iterate(string(prefix), func(k string, v []byte) (bool, error) {
+		if !strings.HasPrefix(k, string(prefix)) {
+			return false, nil
+		}
+
+		return true, fn([]byte(k), v)
+	})
+}
+
+// iterate calls the function for the keys from the given one in order, until
+// it returns false or an error. The function may modify the bucket, so the
+// keys of a leaf are copied before it is called, a key is looked up again
+// after a modification in case it is deleted or moved to another page, the
+// keys it adds are skipped, and the next leaf is looked up from the first key
+// after the previous one. The pages of the path that hold the next leaf are
+// kept when the bucket is not modified, so that they are not read again.
+func (b *pagedBucket) iterate(from string, fn func(k string, v []byte) (bool, error)) error {
+	// a nested iteration shares the keys added by the outer one
+	if b.inserted == nil {
+		b.inserted = make(map[string]struct{})
+		defer func() { b.inserted = nil }()
+	}
+
+	steps, err := b.descend(from)
+
+	for {
+		if err != nil {
+			return err
+		}
+
+		leaf := steps[len(steps)-1]
+		changes := b.changes
+
+		var keys []string
+
+		leaf.page.idx.ascend(from, func(k string) bool {
+			keys = append(keys, k)
+			return true
+		})
+
+		for _, k := range keys {
+			_, added := b.inserted[k]
+			if added {
+				continue
+			}
+
+			v, found := leaf.page.Kv[k]
+
+			if b.changes != changes {
+				v, found, err = b.lookup(k)
+				if err != nil {
+					return err
+				}
+			}
+
+			if !found {
+				continue
+			}
+
+			more, err := fn(k, v)
+			if err != nil {
+				// the error of the callback is returned as is so that the
+				// caller can compare it
+				return err
+			}
+
+			if !more {
+				return nil
+			}
+		}
+
+		if !leaf.bounded {
+			return nil
+		}
+
+		from = leaf.upper
+
+		if b.changes != changes {
+			steps, err = b.descend(from)
+			continue
+		}
+
+		i := len(steps) - 2
+		for i > 0 && steps[i].bounded && from >= steps[i].upper {
+			i--
+		}
+
+		steps, err = b.descendFrom(steps[:i+1], from)
+	}
+}
+
+// lookup returns the value of the key in its leaf.
+func (b *pagedBucket) lookup(key string) ([]byte, bool, error) {
+	steps, err := b.descend(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	v, found := steps[len(steps)-1].page.Kv[key]
+
+	return v, found, nil
+}
+
+// descend returns the pages from the root to the leaf of the key.
+func (b *pagedBucket) descend(key string) ([]pageStep, error) {
+	steps := make([]pageStep, 1, b.level+1)
+	steps[0] = pageStep{ref: b.root}
+
+	return b.descendFrom(steps, key)
+}
+
+// descendFrom completes the path from the root to the leaf of the key, whose
+// last page holds the key and may not be read yet.
+func (b *pagedBucket) descendFrom(steps []pageStep, key string) ([]pageStep, error) {
+	for {
+		step := &steps[len(steps)-1]
+
+		if step.page == nil {
+			step.page = b.tx.readPage(step.ref)
+			if b.tx.err != nil {
+				return nil, b.tx.err
+			}
+		}
+
+		if len(steps) > b.level {
+			return steps, nil
+		}
+
+		next, err := childOf(*step, key)
+		if err != nil {
+			b.tx.fail(xerrors.Errorf("bucket %q: %w", b.name, err))
+			return nil, b.tx.err
+		}
+
+		steps = append(steps, next)
+	}
+}
+
+// childOf returns the child of the inner page that holds the key.
+func childOf(parent pageStep, key string) (pageStep, error) {
+	first, found := parent.page.idx.floor(key)
+	if !found {
+		parent.page.idx.ascend("", func(k string) bool {
+			first, found = k, true
+			return false
+		})
+	}
+
+	if !found {
+		return pageStep{}, xerrors.Errorf("%w: inner page is empty", ErrCorrupted)
+	}
+
+	ref, err := decodePageRef(parent.page.Kv[first])
+	if err != nil {
+		return pageStep{}, err
+	}
+
+	child := pageStep{
+		ref:     ref,
+		first:   first,
+		upper:   parent.upper,
+		bounded: parent.bounded,
+	}
+
+	parent.page.idx.ascend(first, func(k string) bool {
+		if k == first {
+			return true
+		}
+
+		child.upper, child.bounded = k, true
+
+		return false
+	})
+
+	return child, nil
+}
+
+// copyPath returns the pages from the root to the leaf of the key, after the
+// ones that are not copies of the transaction are copied.
+func (b *pagedBucket) copyPath(key string) ([]pageStep, error) {
+	steps, err := b.descend(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range steps {
+		step := &steps[i]
+
+		if b.tx.owns(step.ref) {
+			continue
+		}
+
+		page := &dpBucket{Kv: maps.Clone(step.page.Kv), idx: step.page.idx.clone()}
+
+		ref := b.tx.addPage(page)
+		b.tx.dropPage(step.ref)
+		b.sizes[ref] = pageSize(page)
+
+		step.ref = ref
+		step.page = page
+
+		if i == 0 {
+			b.root = ref
+			b.saveRoot()
+
+			continue
+		}
+
+		err = b.put(steps[i-1], step.first, encodePageRef(ref))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return steps, nil
+}
+
+// put sets the key of a page copied by the transaction.
+func (b *pagedBucket) put(step pageStep, key string, value []byte) error {
+	old, found := step.page.Kv[key]
+	if found {
+		b.sizes[step.ref] += len(value) - len(old)
+	} else {
+		b.sizes[step.ref] += len(key) + len(value)
+	}
+
+	return step.page.Set([]byte(key), value)
+}
+
+// remove deletes the key of a page copied by the transaction.
+func (b *pagedBucket) remove(step pageStep, key string) error {
+	old, found := step.page.Kv[key]
+	if !found {
+		return nil
+	}
+
+	b.sizes[step.ref] -= len(key) + len(old)
+
+	return step.page.Delete([]byte(key))
+}
+
+// split moves the upper half of the keys of the i-th page of the path to a new
+// page when the page is over the page size, and adds the new page to the
+// parent, which may then be split in turn. An inner page keeps at least two
+// children on each side so that the height of the tree stays logarithmic when
+// the pages are small.
+func (b *pagedBucket) split(steps []pageStep, i int) error {
+	step := steps[i]
+
+	minKeys := 2
+	if i < len(steps)-1 {
+		minKeys = 4
+	}
+
+	if b.sizes[step.ref] <= b.tx.pageSize || step.page.idx.len() < minKeys {
+		return nil
+	}
+
+	keys := step.page.idx.keys()
+	mid := len(keys) / 2
+
+	upper := &dpBucket{Kv: make(kv)}
+	for _, k := range keys[mid:] {
+		upper.Kv[k] = step.page.Kv[k]
+		delete(step.page.Kv, k)
+	}
+
+	upper.idx = newOrder(keys[mid:])
+	step.page.idx = newOrder(keys[:mid])
+	step.page.root = nil
+	step.page.tree = nil
+
+	ref := b.tx.addPage(upper)
+
+	b.sizes[ref] = pageSize(upper)
+	b.sizes[step.ref] -= b.sizes[ref]
+
+	if i > 0 {
+		err := b.put(steps[i-1], keys[mid], encodePageRef(ref))
+		if err != nil {
+			return err
+		}
+
+		return b.split(steps, i-1)
+	}
+
+	// the root is split under a new root
+	root := pageStep{page: &dpBucket{Kv: make(kv)}}
+	root.ref = b.tx.addPage(root.page)
+
+	err := b.put(root, "", encodePageRef(step.ref))
+	if err != nil {
+		return err
+	}
+
+	err = b.put(root, keys[mid], encodePageRef(ref))
+	if err != nil {
+		return err
+	}
+
+	b.level++
+	b.root = root.ref
+	b.saveRoot()
+
+	return nil
+}
+
+// shrink replaces the root by its child as long as it only has one.
+func (b *pagedBucket) shrink() error {
+	for b.level > 0 {
+		root := b.tx.readPage(b.root)
+		if b.tx.err != nil {
+			return b.tx.err
+		}
+
+		if root.idx.len() != 1 {
+			return nil
+		}
+
+		child, err := childOf(pageStep{page: root}, "")
+		if err != nil {
+			b.tx.fail(xerrors.Errorf("bucket %q: %w", b.name, err))
+			return b.tx.err
+		}
+
+		b.tx.dropPage(b.root)
+		delete(b.sizes, b.root)
+
+		b.level--
+		b.root = child.ref
+		b.saveRoot()
+	}
+
+	return nil
+}
+
+// saveRoot writes the root of the bucket in its shard.
+func (b *pagedBucket) saveRoot() {
+	root := &dpBucket{Kv: make(kv)}
+	root.Set(nil, encodeRoot(b.level, b.root))
+
+	b.tx.new.Db[b.name] = root
+}
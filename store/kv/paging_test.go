@@ -0,0 +1,590 @@
+package purbkv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaging_Split(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithShards(4), WithPaging(256))
+	require.NoError(t, err)
+
+	keys := setPairs(t, db, "bucket", 200)
+
+	p := db.(*purbDB)
+	pages := readPages(t, p, "bucket")
+	require.Greater(t, len(pages), 4)
+
+	// a page is split when it grows over the page size
+	for _, page := range pages {
+		require.LessOrEqual(t, pageSize(page), 256+16)
+	}
+
+	requirePairs(t, db, "bucket", keys)
+	require.NoError(t, db.Close())
+
+	// the pages are read from the shards
+	db, err = NewDB(dir, true)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the page size only applies to the next splits
+	require.Equal(t, defaultPageSize, db.(*purbDB).pageSize)
+	requirePairs(t, db, "bucket", keys)
+
+	err = db.View(func(txn ReadableTx) error {
+		var scanned []string
+
+		err := txn.GetBucket([]byte("bucket")).Scan([]byte("key01"), func(k, v []byte) error {
+			scanned = append(scanned, string(k))
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.Len(t, scanned, 10)
+		require.Equal(t, "key010", scanned[0])
+		require.Equal(t, "key019", scanned[9])
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestPaging_SmallPages(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithShards(4), WithPaging(16))
+	require.NoError(t, err)
+	defer db.Close()
+
+	keys := setPairs(t, db, "bucket", 200)
+
+	// the inner pages keep two children on each side when they are split, so
+	// the height of the tree does not follow the number of keys
+	levels := readLevels(t, db.(*purbDB), "bucket")
+	require.LessOrEqual(t, len(levels), 8)
+	require.Len(t, levels[len(levels)-1], 200)
+
+	requirePairs(t, db, "bucket", keys)
+}
+
+func TestPaging_Delete(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithShards(4), WithPaging(256))
+	require.NoError(t, err)
+	defer db.Close()
+
+	keys := setPairs(t, db, "bucket", 100)
+
+	p := db.(*purbDB)
+	before := readPages(t, p, "bucket")
+
+	err = db.Update(func(txn WritableTx) error {
+		b := txn.GetBucket([]byte("bucket"))
+
+		for _, key := range keys[:90] {
+			require.NoError(t, b.Delete([]byte(key)))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	requirePairs(t, db, "bucket", keys[90:])
+
+	// the emptied pages are removed from the tree and their files deleted
+	after := readPages(t, p, "bucket")
+	require.Less(t, len(after), len(before))
+	require.Len(t, pageFiles(t, dir), len(after))
+
+	err = db.Update(func(txn WritableTx) error {
+		b := txn.GetBucket([]byte("bucket"))
+
+		for _, key := range keys[90:] {
+			require.NoError(t, b.Delete([]byte(key)))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// the last page is kept
+	requirePairs(t, db, "bucket", nil)
+	require.Len(t, readPages(t, p, "bucket"), 1)
+	require.Len(t, pageFiles(t, dir), 1)
+}
+
+func TestPaging_ScanDelete(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithShards(4), WithPaging(256))
+	require.NoError(t, err)
+	defer db.Close()
+
+	keys := setPairs(t, db, "bucket", 1000)
+
+	p := db.(*purbDB)
+	require.Greater(t, len(readPages(t, p, "bucket")), 10)
+
+	visited := 0
+
+	// the callback splits the pages that it goes through
+	err = db.Update(func(txn WritableTx) error {
+		b := txn.GetBucket([]byte("bucket"))
+
+		return b.ForEach(func(k, v []byte) error {
+			visited++
+			return b.Set(append(k, '+'), v)
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1000, visited)
+
+	visited = 0
+
+	// the callback empties and removes the pages that it goes through, which
+	// belong to the transaction once they are modified
+	err = db.Update(func(txn WritableTx) error {
+		b := txn.GetBucket([]byte("bucket"))
+
+		for _, key := range keys {
+			err := b.Set([]byte(key+"-"), []byte("value"))
+			if err != nil {
+				return err
+			}
+		}
+
+		return b.Scan([]byte("key"), func(k, v []byte) error {
+			visited++
+			return b.Delete(k)
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3000, visited)
+
+	requirePairs(t, db, "bucket", nil)
+	require.Len(t, readPages(t, p, "bucket"), 1)
+
+	setPairs(t, db, "bucket", 1000)
+	requirePairs(t, db, "bucket", keys)
+}
+
+func TestPaging_MemoryBudget(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newCountingStore()
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithShards(16), WithPaging(128))
+	require.NoError(t, err)
+
+	keys := setPairs(t, db, "bucket", 500)
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, false, WithBlobStore(store), WithMemoryBudget(1024))
+	require.NoError(t, err)
+	defer db.Close()
+
+	p := db.(*purbDB)
+
+	// the bucket is iterated without keeping every page in memory
+	err = db.View(func(txn ReadableTx) error {
+		count := 0
+
+		err := txn.GetBucket([]byte("bucket")).ForEach(func(k, v []byte) error {
+			count++
+
+			p.cache.Lock()
+			defer p.cache.Unlock()
+
+			require.True(t, p.cache.size <= 1024 || len(p.cache.shards)+len(p.cache.pages) == 1)
+
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, len(keys), count)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Less(t, len(p.cache.shards), 16)
+}
+
+func TestPaging_OnlyDirty(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewMemoryStore().(*memoryStore)
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithShards(16), WithPaging(128))
+	require.NoError(t, err)
+	defer db.Close()
+
+	setPairs(t, db, "bucket", 500)
+
+	p := db.(*purbDB)
+	before := p.shards.shards
+	levels := len(readLevels(t, p, "bucket"))
+
+	err = db.Update(func(txn WritableTx) error {
+		return txn.GetBucket([]byte("bucket")).Set([]byte("key250"), []byte("value"))
+	})
+	require.NoError(t, err)
+
+	// only the shard of the root of the bucket is written, with the pages from
+	// the root to the leaf of the key
+	written := 0
+	for i, gen := range p.shards.shards {
+		if gen != before[i] {
+			written++
+		}
+	}
+
+	require.Equal(t, 1, written)
+	require.Len(t, p.shards.stalePages, levels)
+	requireValue(t, db, "bucket", "key250", "value")
+}
+
+func TestPaging_Budget(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newCountingStore()
+	opts := []Option{WithBlobStore(store), WithShards(2), WithPaging(1024), WithMemoryBudget(4096)}
+
+	db, err := NewDB(dir, false, opts...)
+	require.NoError(t, err)
+
+	// about 2 MB in two buckets
+	for _, name := range []string{"a", "b"} {
+		err = db.Update(func(txn WritableTx) error {
+			b, err := txn.GetBucketOrCreate([]byte(name))
+			require.NoError(t, err)
+
+			for i := 0; i < 10000; i++ {
+				require.NoError(t, b.Set([]byte(fmt.Sprintf("key%05d", i)), make([]byte, 100)))
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, false, opts...)
+	require.NoError(t, err)
+	defer db.Close()
+
+	p := db.(*purbDB)
+
+	// a key is read with the pages on its path, which are bounded by the
+	// budget rather than the size of the bucket
+	store.reset()
+	requireValue(t, db, "a", "key04242", string(make([]byte, 100)))
+
+	require.Less(t, store.bytesRead(), 4096)
+	require.LessOrEqual(t, p.cache.size, 4096)
+
+	store.reset()
+
+	err = db.Update(func(txn WritableTx) error {
+		return txn.GetBucket([]byte("a")).Set([]byte("key04242"), []byte("value"))
+	})
+	require.NoError(t, err)
+
+	// the update only writes the copies of the pages on the path of the key,
+	// the shard of the root and the manifest
+	require.Less(t, store.bytesWritten(), 2*4096)
+	require.LessOrEqual(t, p.cache.size, 4096)
+
+	// the bucket is iterated within the budget
+	err = db.View(func(txn ReadableTx) error {
+		count := 0
+
+		err := txn.GetBucket([]byte("b")).ForEach(func(k, v []byte) error {
+			count++
+
+			p.cache.Lock()
+			defer p.cache.Unlock()
+
+			require.LessOrEqual(t, p.cache.size, 4096)
+
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 10000, count)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestPaging_LeftoverPages(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithShards(4), WithPaging(128))
+	require.NoError(t, err)
+
+	setPairs(t, db, "bucket", 100)
+
+	p := db.(*purbDB)
+	pages := len(pageFiles(t, dir))
+	generation := p.shards.generation
+
+	require.NoError(t, db.Close())
+
+	// the pages of a commit interrupted before its manifest, and the stale
+	// ones that could not be deleted
+	for i := 0; i < 3; i++ {
+		name := pageName(kvFileName, pageRef{generation: generation + 1, index: uint64(i)})
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("orphan"), filePerm))
+	}
+
+	stale := pageName(kvFileName, pageRef{generation: generation, index: 1000})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, stale), []byte("stale"), filePerm))
+
+	data, err := os.ReadFile(filepath.Join(dir, kvFileName))
+	require.NoError(t, err)
+
+	hdr, body, err := parseHeader(data)
+	require.NoError(t, err)
+
+	m, err := decodeManifest(body, hdr.flags)
+	require.NoError(t, err)
+
+	m.stalePages = append(m.stalePages, pageRef{generation: generation, index: 1000})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), encodeManifest(m, flagChecksums).Bytes(), filePerm))
+
+	db, err = NewDB(dir, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Len(t, pageFiles(t, dir), pages)
+	requirePairs(t, db, "bucket", setPairs(t, db, "bucket", 100))
+}
+
+func TestPaging_Root(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	other, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+
+	paged, err := NewDB(dir, false, WithShards(4), WithPaging(128))
+	require.NoError(t, err)
+	defer paged.Close()
+
+	plain, err := NewDB(other, false)
+	require.NoError(t, err)
+	defer plain.Close()
+
+	for _, db := range []DB{paged, plain} {
+		setPairs(t, db, "a", 100)
+		setPairs(t, db, "b", 10)
+	}
+
+	// the root does not depend on the layout
+	require.Equal(t, plain.(Prover).Root(), paged.(Prover).Root())
+
+	proof, err := paged.(Prover).Prove([]byte("a"), []byte("key042"))
+	require.NoError(t, err)
+
+	value, found, err := VerifyProof(plain.(Prover).Root(), proof)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("value042"), value)
+
+	require.NoError(t, paged.Close())
+
+	report, err := ExportBolt(dir, false, filepath.Join(other, "export.db"))
+	require.NoError(t, err)
+	require.Equal(t, TransferReport{Buckets: 2, Pairs: 110}, report)
+}
+
+func TestPaging_Unsupported(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewDB(dir, false, WithPaging(128))
+	require.EqualError(t, err, "paging requires a sharded database")
+}
+
+func TestPaging_Decode(t *testing.T) {
+	ref := pageRef{generation: 17, index: 3}
+
+	level, decoded, err := decodeRoot(encodeRoot(2, ref))
+	require.NoError(t, err)
+	require.Equal(t, 2, level)
+	require.Equal(t, ref, decoded)
+
+	decoded, err = decodePageRef(encodePageRef(ref))
+	require.NoError(t, err)
+	require.Equal(t, ref, decoded)
+
+	data := encodeRoot(2, ref)
+
+	_, _, err = decodeRoot(data[:len(data)-1])
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	_, _, err = decodeRoot(append(data, 0))
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	_, _, err = decodeRoot(encodeRoot(maxLevels, ref))
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	_, err = decodePageRef(append(encodePageRef(ref), 0))
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	name := pageName(purbFileName, ref)
+	require.Equal(t, "purb.db.page.17.3", name)
+
+	parsed, ok := parsePageName(purbFileName, name)
+	require.True(t, ok)
+	require.Equal(t, ref, parsed)
+
+	for _, name := range []string{"purb.db.17.3", "kv.db.page.17.3", "purb.db.page.17.03", "purb.db.page.17"} {
+		_, ok = parsePageName(purbFileName, name)
+		require.False(t, ok, name)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// setPairs sets the given number of keys in the bucket, and returns them in
+// order.
+func setPairs(t *testing.T, db DB, bucket string, n int) []string {
+	keys := make([]string, n)
+
+	err := db.Update(func(txn WritableTx) error {
+		b, err := txn.GetBucketOrCreate([]byte(bucket))
+		require.NoError(t, err)
+
+		for i := range keys {
+			keys[i] = fmt.Sprintf("key%03d", i)
+			value := strings.Replace(keys[i], "key", "value", 1)
+
+			require.NoError(t, b.Set([]byte(keys[i]), []byte(value)))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	return keys
+}
+
+// requirePairs checks that the bucket holds exactly the keys set by setPairs.
+func requirePairs(t *testing.T, db DB, bucket string, keys []string) {
+	err := db.View(func(txn ReadableTx) error {
+		b := txn.GetBucket([]byte(bucket))
+		require.NotNil(t, b)
+
+		var found []string
+
+		err := b.ForEach(func(k, v []byte) error {
+			found = append(found, string(k))
+			require.Equal(t, strings.Replace(string(k), "key", "value", 1), string(v))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, keys, found)
+
+		for _, key := range keys {
+			_, err := b.Get([]byte(key))
+			require.NoError(t, err)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// readPages returns the pages of the tree of the bucket, level by level from
+// the root.
+func readPages(t *testing.T, p *purbDB, bucket string) []*dpBucket {
+	var pages []*dpBucket
+
+	for _, level := range readLevels(t, p, bucket) {
+		pages = append(pages, level...)
+	}
+
+	return pages
+}
+
+// readLevels returns the pages of every level of the tree of the bucket, from
+// the root to the leaves.
+func readLevels(t *testing.T, p *purbDB, bucket string) [][]*dpBucket {
+	p.bucketDb.RLock()
+	defer p.bucketDb.RUnlock()
+
+	tx := p.newTx()
+
+	b := tx.getPaged(bucket)
+	require.NoError(t, tx.err)
+	require.NotNil(t, b)
+
+	levels := [][]*dpBucket{{tx.readPage(b.root)}}
+	require.NoError(t, tx.err)
+
+	for level := b.level; level > 0; level-- {
+		var next []*dpBucket
+
+		for _, page := range levels[len(levels)-1] {
+			for _, k := range page.idx.keys() {
+				ref, err := decodePageRef(page.Kv[k])
+				require.NoError(t, err)
+
+				next = append(next, tx.readPage(ref))
+				require.NoError(t, tx.err)
+			}
+		}
+
+		levels = append(levels, next)
+	}
+
+	return levels
+}
+
+// pageFiles returns the names of the files of the pages in the directory.
+func pageFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+
+	for _, entry := range entries {
+		_, ok := parsePageName(kvFileName, entry.Name())
+		if ok {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,146 @@
+package purbkv
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"go.dedis.ch/dela"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// dirPerm is the mode of a database directory.
+	dirPerm = 0700
+	// filePerm is the mode of the database and key files.
+	filePerm = 0600
+	// privateMask flags the permission bits that must not be set on a file
+	// holding private data.
+	privateMask = 0077
+)
+
+// PermissionPolicy defines how the database reacts when its directory or files
+// are accessible by another user than the owner.
+type PermissionPolicy int
+
+const (
+	// PermissionsEnforce refuses to open a database with loose permissions.
+	PermissionsEnforce PermissionPolicy = iota
+	// PermissionsWarn logs a warning but opens the database anyway. It is the
+	// default policy.
+	PermissionsWarn
+	// PermissionsIgnore skips the verification.
+	PermissionsIgnore
+)
+
+// checkPermissions verifies the directory of the database and the files of the
+// database present in it, shards included, and applies the policy to the first
+// problem found.
+func checkPermissions(fsys FileSystem, path string, policy PermissionPolicy) error {
+	if policy == PermissionsIgnore {
+		return nil
+	}
+
+	dir := filepath.Clean(path)
+
+	err := verifyPrivate(dir, fsys.Stat)
+	if err == nil {
+		var names []string
+
+		names, err = databaseFiles(dir)
+		for _, name := range names {
+			err = verifyPrivate(filepath.Join(dir, name), fsys.Stat)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	if policy == PermissionsWarn {
+		dela.Logger.Warn().Msgf("insecure database: %v", err)
+		return nil
+	}
+
+	return err
+}
+
+// verifyPrivate returns an error if the file exists and is either readable by
+// group or others, or owned by another user. A missing file is not an error.
+func verifyPrivate(path string, statFn func(string) (os.FileInfo, error)) error {
+	info, err := statFn(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to stat %s: %v", path, err)
+	}
+
+	if info.Mode().Perm()&privateMask != 0 {
+		return xerrors.Errorf("%s has permissions %v, expected no access for group and others",
+			path, info.Mode().Perm())
+	}
+
+	uid, ok := fileOwner(info)
+	if ok && uid != os.Getuid() {
+		return xerrors.Errorf("%s is owned by uid %d, expected %d", path, uid, os.Getuid())
+	}
+
+	return nil
+}
+
+// databaseFiles returns the names of the database, key, shard and page files
+// that may be in the directory. The files that are listed are not all present.
+func databaseFiles(dir string) ([]string, error) {
+	names := []string{purbFileName, kvFileName, keysFileName}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		for _, dbName := range []string{purbFileName, kvFileName} {
+			_, _, isShard := parseShardName(dbName, entry.Name())
+			_, isPage := parsePageName(dbName, entry.Name())
+			if isShard || isPage {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// FixPermissions tightens the permissions of the database directory at the
+// given path and of the database, key, shard and page files it contains, so that
+// only the owner can access them.
+func FixPermissions(path string) error {
+	dir := filepath.Clean(path)
+
+	err := os.Chmod(dir, dirPerm)
+	if err != nil {
+		return xerrors.Errorf("failed to chmod directory: %v", err)
+	}
+
+	names, err := databaseFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = os.Chmod(filepath.Join(dir, name), filePerm)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return xerrors.Errorf("failed to chmod %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
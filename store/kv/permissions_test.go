@@ -0,0 +1,185 @@
+package purbkv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissions_NewDBCreatesPrivateFiles(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true)
+	require.NoError(t, err)
+
+	err = db.Update(func(txn WritableTx) error {
+		b, err := txn.GetBucketOrCreate([]byte("bucket"))
+		require.NoError(t, err)
+
+		return b.Set([]byte("ping"), []byte("pong"))
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{purbFileName, keysFileName} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(filePerm), info.Mode().Perm())
+	}
+}
+
+func TestPermissions_EnforceRefusesOpenDirectory(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Chmod(dir, 0755))
+
+	_, err = NewDB(dir, false, WithPermissionPolicy(PermissionsEnforce))
+	require.ErrorContains(t, err, "expected no access for group and others")
+
+	_, err = NewDB(dir, false, WithPermissionPolicy(PermissionsWarn))
+	require.NoError(t, err)
+
+	_, err = NewDB(dir, false, WithPermissionPolicy(PermissionsIgnore))
+	require.NoError(t, err)
+}
+
+func TestPermissions_EnforceRefusesOpenKeyFile(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewDB(dir, true)
+	require.NoError(t, err)
+
+	keysPath := filepath.Join(dir, keysFileName)
+	require.NoError(t, os.Chmod(keysPath, 0644))
+
+	_, err = NewDB(dir, true, WithPermissionPolicy(PermissionsEnforce))
+	require.ErrorContains(t, err, keysPath)
+
+	err = NewKeysLoader(keysPath).Verify()
+	require.Error(t, err)
+
+	// the existing keys must be reused and not replaced
+	before, err := os.ReadFile(keysPath)
+	require.NoError(t, err)
+
+	_, err = NewDB(dir, true, WithPermissionPolicy(PermissionsWarn))
+	require.NoError(t, err)
+
+	after, err := os.ReadFile(keysPath)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestPermissions_FixPermissions(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewDB(dir, true)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Chmod(dir, 0755))
+	require.NoError(t, os.Chmod(filepath.Join(dir, keysFileName), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(dir, purbFileName), 0755))
+
+	err = FixPermissions(dir)
+	require.NoError(t, err)
+
+	_, err = NewDB(dir, true, WithPermissionPolicy(PermissionsEnforce))
+	require.NoError(t, err)
+}
+
+func TestPermissions_Shards(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithShards(4))
+	require.NoError(t, err)
+
+	setBuckets(t, db, "a")
+
+	shard := shardName(purbFileName, db.(*purbDB).shards.shardOf("a"), db.(*purbDB).shards.generation)
+	require.NoError(t, db.Close())
+
+	path := filepath.Join(dir, shard)
+	require.NoError(t, os.Chmod(path, 0644))
+
+	_, err = NewDB(dir, true, WithShards(4), WithPermissionPolicy(PermissionsEnforce))
+	require.ErrorContains(t, err, path)
+
+	require.NoError(t, FixPermissions(dir))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(filePerm), info.Mode().Perm())
+
+	db, err = NewDB(dir, true, WithShards(4), WithPermissionPolicy(PermissionsEnforce))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestPermissions_DefaultWarns(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// the modes of the databases created by earlier versions
+	require.NoError(t, os.Chmod(dir, 0755))
+	require.NoError(t, os.Chmod(filepath.Join(dir, keysFileName), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(dir, purbFileName), 0644))
+
+	db, err = NewDB(dir, true)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestPermissions_VerifyPrivateOwner(t *testing.T) {
+	statFn := func(string) (os.FileInfo, error) {
+		return fakeFileInfo{mode: 0600}, nil
+	}
+
+	// the fake info does not carry an owner
+	err := verifyPrivate("fake", statFn)
+	require.NoError(t, err)
+
+	statFn = func(string) (os.FileInfo, error) {
+		return fakeFileInfo{mode: 0640}, nil
+	}
+
+	err = verifyPrivate("fake", statFn)
+	require.EqualError(t, err,
+		"fake has permissions -rw-r-----, expected no access for group and others")
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+type fakeFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (i fakeFileInfo) Mode() os.FileMode {
+	return i.mode
+}
+
+func (i fakeFileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (i fakeFileInfo) Sys() any {
+	return nil
+}
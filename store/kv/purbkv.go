@@ -6,27 +6,39 @@
 // Documentation Last Review: 08.10.2020
 package purbkv
 
-import "go.dedis.ch/dela/core/store"
+import (
+	"io"
+	"io/fs"
+
+	"go.dedis.ch/dela/core/store"
+)
 
 // Bucket is a general interface to operate on a database bucket.
+//
+// A bucket is only valid during the transaction it was obtained from. The
+// slices it returns must not be modified, and the ones it receives can be
+// reused by the caller once the call returns.
 type Bucket interface {
-	// Get reads the key from the bucket and returns the value, or nil if the
-	// key does not exist.
+	// Get reads the key from the bucket and returns the value, or nil and an
+	// error if the key does not exist.
 	Get(key []byte) ([]byte, error)
 
-	// Set assigns the value to the provided key.
+	// Set assigns the value to the provided key. The change is visible right
+	// away in the transaction, and to others once it is committed.
 	Set(key, value []byte) error
 
-	// Delete deletes the key from the bucket.
+	// Delete deletes the key from the bucket. Deleting a missing key is not an
+	// error.
 	Delete(key []byte) error
 
-	// ForEach iterates over all the items in the bucket in a unspecified order.
-	// The iteration stops when the callback returns an error.
+	// ForEach iterates over all the items in the bucket in the byte order of
+	// the keys. The iteration stops when the callback returns an error, which
+	// is returned as is.
 	ForEach(func(k, v []byte) error) error
 
-	// Scan iterates over every key that matches the prefix in an order
-	// determined by the implementation. The iteration stops when the callback
-	// returns an error.
+	// Scan iterates over every key that matches the prefix in the byte order of
+	// the keys. The iteration stops when the callback returns an error, which
+	// is returned as is.
 	Scan(prefix []byte, fn func(k, v []byte) error) error
 }
 
@@ -44,20 +56,132 @@ type WritableTx interface {
 	ReadableTx
 
 	// GetBucketOrCreate returns the bucket of the given name if it exists, or
-	// it creates it.
+	// it creates it. An empty name is an error.
 	GetBucketOrCreate(name []byte) (Bucket, error)
 }
 
 // DB is a general interface to operate over a key/value database.
+//
+// The semantics are checked by the conformance suite of the kvtest package.
 type DB interface {
 	// View executes the provided read-only transaction in the context of the
-	// database.
+	// database. It sees the state of the last committed update, and changes
+	// made to its buckets are never applied. The error of the transaction is
+	// returned as is.
 	View(fn func(ReadableTx) error) error
 
 	// Update executes the provided writable transaction in the context of the
-	// database.
+	// database. The changes are committed atomically when the transaction
+	// returns no error, which makes them visible to the next transactions and
+	// durable according to the implementation, and the OnCommit callbacks are
+	// then called in the order they were registered. Otherwise, the changes are
+	// discarded and the error is returned as is. Updates do not overwrite each
+	// other's changes.
 	Update(fn func(WritableTx) error) error
 
-	// Close closes the database and free the resources.
+	// Close closes the database and free the resources. View and Update return
+	// an error afterwards.
 	Close() error
 }
+
+// SizeReporter is implemented by databases that hide their size on disk.
+type SizeReporter interface {
+	// Headroom returns the number of bytes the database can still grow before
+	// its file grows.
+	Headroom() (int, error)
+}
+
+// Flusher is implemented by databases that can delay writes to disk.
+type Flusher interface {
+	// Flush writes the pending changes to disk and returns once they are saved.
+	Flush() error
+}
+
+// Batcher is implemented by databases that can commit the updates of
+// concurrent goroutines together.
+type Batcher interface {
+	// Batch executes the writable transaction with the ones of other calls in
+	// a single update. The function may be called more than once.
+	Batch(fn func(WritableTx) error) error
+}
+
+// Prover is implemented by databases that commit to their content with a
+// Merkle root.
+type Prover interface {
+	// Root returns the Merkle root of the committed content.
+	Root() []byte
+
+	// Prove returns a proof of the value of the key in the bucket, or of its
+	// absence, that can be checked with VerifyProof against the root.
+	Prove(bucket, key []byte) (Proof, error)
+}
+
+// Migrator is implemented by databases that can change the format of their
+// file while they are open.
+type Migrator interface {
+	// Migrate converts the database to PURB if purbIsOn is true, or to
+	// plaintext otherwise.
+	Migrate(purbIsOn bool) error
+}
+
+// BlobStore is where a database keeps its encoded content, as objects that
+// are read and written whole. The content is encoded as a PURB when PURB is
+// on, so that it can be kept on storage that is not trusted, but it is in
+// plaintext otherwise. The keys never go through the store.
+type BlobStore interface {
+	// Get returns the content of the object, or an error wrapping
+	// fs.ErrNotExist if it does not exist.
+	Get(name string) ([]byte, error)
+
+	// Put creates the object or replaces its content at once, so that it is
+	// either the previous content or the new one.
+	Put(name string, data []byte) error
+
+	// Exists returns true if the object exists.
+	Exists(name string) (bool, error)
+
+	// Delete removes the object. Removing a missing object is not an error.
+	Delete(name string) error
+}
+
+// FileSystem is the interface of the file operations of a database and of its
+// keys, so that they can be replaced, for instance to inject faults in tests.
+type FileSystem interface {
+	// OpenFile opens the file with the flags and the mode of os.OpenFile.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+
+	// CreateTemp creates a new temporary file in the directory as
+	// os.CreateTemp does, which is only accessible by the owner.
+	CreateTemp(dir, pattern string) (File, error)
+
+	// ReadFile returns the content of the file.
+	ReadFile(name string) ([]byte, error)
+
+	// Stat returns the description of the file.
+	Stat(name string) (fs.FileInfo, error)
+
+	// Rename replaces the new path by the old one.
+	Rename(oldpath, newpath string) error
+
+	// Remove removes the file.
+	Remove(name string) error
+}
+
+// File is the interface of a file opened by a FileSystem.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	// Name returns the name the file was opened with.
+	Name() string
+
+	// Stat returns the description of the file.
+	Stat() (fs.FileInfo, error)
+
+	// Sync commits the content of the file to the disk.
+	Sync() error
+
+	// Chmod changes the mode of the file.
+	Chmod(mode fs.FileMode) error
+}
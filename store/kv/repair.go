@@ -0,0 +1,525 @@
+package purbkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// RepairReport is the result of the repair of a database file.
+type RepairReport struct {
+	// File is the path of the damaged file.
+	File string
+	// Output is the path of the file written with what was recovered.
+	Output string
+	// Buckets is the number of buckets recovered.
+	Buckets int
+	// Pairs is the number of pairs recovered.
+	Pairs int
+	// Skipped is the number of bytes that were skipped to find the next
+	// readable bucket.
+	Skipped int
+	// Problems lists what could not be recovered, or was recovered but might
+	// be damaged.
+	Problems []Problem
+}
+
+// String returns a human-readable summary of the report.
+func (r RepairReport) String() string {
+	out := new(strings.Builder)
+
+	fmt.Fprintf(out, "file: %s\n", r.File)
+	fmt.Fprintf(out, "output: %s\n", r.Output)
+	fmt.Fprintf(out, "buckets: %d\n", r.Buckets)
+	fmt.Fprintf(out, "pairs: %d\n", r.Pairs)
+	fmt.Fprintf(out, "skipped: %d byte(s)\n", r.Skipped)
+	fmt.Fprintf(out, "problems: %d", len(r.Problems))
+
+	for _, p := range r.Problems {
+		fmt.Fprintf(out, "\n- %s", p)
+	}
+
+	return out.String()
+}
+
+// Repair recovers what can be read of the plaintext database in the directory
+// at the given path and writes it to a fresh database in the output directory,
+// which must not contain one already. The options are used to open the fresh
+// database. The original file is left untouched.
+//
+// Every bucket that can be read is recovered, as well as the pairs read before
+// the damage in a bucket that cannot be read fully. When the buckets have
+// checksums, the damaged part is skipped until the next bucket with a valid
+// checksum, otherwise the rest of the file is lost. A bucket whose checksum
+// does not match is recovered but reported. Legacy files encoded with gob are
+// either fully recovered or not at all. The shards of a sharded database are
+// recovered one by one, from the latest version of each shard found in the
+// directory when its manifest is damaged, and the output has the layout given
+// by the options.
+func Repair(path, output string, opts ...Option) (RepairReport, error) {
+	report := RepairReport{
+		File:   filepath.Join(path, kvFileName),
+		Output: filepath.Join(output, kvFileName),
+	}
+
+	data, err := os.ReadFile(report.File)
+	if err != nil {
+		return report, xerrors.Errorf("failed to read DB file: %v", err)
+	}
+
+	_, err = os.Stat(report.Output)
+	if err == nil {
+		return report, xerrors.Errorf("refusing to overwrite %s", report.Output)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return report, xerrors.Errorf("failed to stat output: %v", err)
+	}
+
+	var db map[string]*dpBucket
+
+	if isManifest(data) {
+		db = report.salvageShards(path, data)
+	} else {
+		db = report.salvage(data)
+	}
+
+	for name, bucket := range db {
+		if name == "" {
+			report.addProblem("", xerrors.Errorf("%w: dropped a bucket without a name", ErrCorrupted))
+			delete(db, name)
+			continue
+		}
+
+		report.Buckets++
+		report.Pairs += len(bucket.Kv)
+	}
+
+	err = os.MkdirAll(output, dirPerm)
+	if err != nil {
+		return report, xerrors.Errorf("failed to create output directory: %v", err)
+	}
+
+	fresh, err := NewDB(output, false, opts...)
+	if err != nil {
+		return report, xerrors.Errorf("failed to create DB: %v", err)
+	}
+
+	err = fresh.(*purbDB).replace(db)
+	if err != nil {
+		fresh.Close()
+		return report, xerrors.Errorf("failed to write DB: %v", err)
+	}
+
+	err = fresh.Close()
+	if err != nil {
+		return report, xerrors.Errorf("failed to close DB: %v", err)
+	}
+
+	return report, nil
+}
+
+// salvage decodes as much as possible of the data.
+func (r *RepairReport) salvage(data []byte) map[string]*dpBucket {
+	hdr, body, err := parseHeader(data)
+	if errors.Is(err, ErrEmpty) {
+		r.addProblem("", err)
+		return nil
+	}
+	if err != nil {
+		// the header cannot be trusted, but the body may still be there
+		r.addProblem("", err)
+
+		hdr, body = guessBody(data)
+		if body == nil {
+			return nil
+		}
+	}
+
+	if hdr.version == 0 {
+		return r.salvageLegacy(body)
+	}
+
+	return r.salvageBody(body, hdr.flags)
+}
+
+// salvageLegacy decodes the buckets of a legacy file until the damage. The gob
+// decoder reads a whole message before it decodes it, so the length of a
+// message that is truncated is reduced to the data that is left, and the
+// buckets decoded before the end are kept.
+func (r *RepairReport) salvageLegacy(body []byte) map[string]*dpBucket {
+	data := body
+
+	for offset := 0; offset < len(body); {
+		length, n := readGobUint(body[offset:])
+		if n == 0 {
+			break
+		}
+
+		end := offset + n + int(min(length, uint64(len(body))))
+		if end <= len(body) {
+			offset = end
+			continue
+		}
+
+		data = append(slices.Clone(body[:offset]), appendGobUint(nil, uint64(len(body)-offset-n))...)
+		data = append(data, body[offset+n:]...)
+
+		break
+	}
+
+	db := make(map[string]*dpBucket)
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&db)
+	if err != nil {
+		r.addProblem("", xerrors.Errorf("%w: failed to decode gob after %d buckets: %v",
+			ErrCorrupted, len(db), err))
+	}
+
+	for _, bucket := range db {
+		if bucket.Kv == nil {
+			bucket.Kv = make(kv)
+		}
+
+		bucket.updateIndex()
+	}
+
+	return db
+}
+
+// salvageBody reads the buckets of the body until the end, and tries to find
+// the next readable bucket after any damage when checksums are present.
+func (r *RepairReport) salvageBody(body []byte, flags uint16) map[string]*dpBucket {
+	db := make(map[string]*dpBucket)
+	checksums := flags&flagChecksums != 0
+
+	rd := bytes.NewReader(body)
+
+	count, err := readUvarint(rd)
+	if err != nil {
+		r.addProblem("", xerrors.Errorf("%w: failed to read number of buckets: %v", ErrCorrupted, err))
+		return db
+	}
+
+	// after skipping damaged bytes, the number of buckets left is unknown and
+	// the reading goes on until the end of the body
+	resynced := false
+
+	for i := uint64(0); rd.Len() > 0 && (resynced || i < count); i++ {
+		start := len(body) - rd.Len()
+
+		name, bucket, _, err := readBucket(rd)
+		if err == nil && checksums {
+			err = verifyChecksum(body[start:len(body)-rd.Len()], rd)
+			if errors.Is(err, errChecksum) {
+				r.addProblem(name, xerrors.Errorf("%w: %v, its pairs may be damaged", ErrCorrupted, err))
+				err = nil
+			}
+		}
+
+		pairs := 0
+		if bucket != nil {
+			pairs = len(bucket.Kv)
+			merge(db, name, bucket)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		r.addProblem(name, xerrors.Errorf("%w: bucket is damaged after %d pair(s): %v",
+			ErrCorrupted, pairs, err))
+
+		if !checksums {
+			r.addProblem("", xerrors.Errorf("%w: the rest of the file cannot be read without checksums",
+				ErrCorrupted))
+			return db
+		}
+
+		next := findBucket(body, start+1)
+		r.Skipped += next - start
+
+		rd.Seek(int64(next), io.SeekStart)
+		resynced = true
+	}
+
+	return db
+}
+
+// salvageShards recovers the buckets of the shards listed by the manifest in the
+// data, and joins the pages of a paged database.
+func (r *RepairReport) salvageShards(path string, data []byte) map[string]*dpBucket {
+	hdr, body, _ := parseHeader(data)
+
+	var names []string
+
+	m, err := decodeManifest(body, hdr.flags)
+	if err == nil {
+		for i, gen := range m.shards {
+			if gen != 0 {
+				names = append(names, shardName(kvFileName, i, gen))
+			}
+		}
+	} else {
+		r.addProblem("", xerrors.Errorf("%w, using the latest shards found", err))
+
+		names, err = latestShards(path)
+		if err != nil {
+			r.addProblem("", xerrors.Errorf("%w: failed to list shards: %v", ErrCorrupted, err))
+			return nil
+		}
+	}
+
+	db := make(map[string]*dpBucket)
+
+	for _, name := range names {
+		shard, err := os.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			r.addProblem("", xerrors.Errorf("%w: shard %s: %v", ErrCorrupted, name, err))
+			continue
+		}
+
+		sub := RepairReport{}
+
+		for bucket, content := range sub.salvage(shard) {
+			merge(db, bucket, content)
+		}
+
+		r.Skipped += sub.Skipped
+
+		for _, p := range sub.Problems {
+			if p.Bucket == "" {
+				p.Err = xerrors.Errorf("shard %s: %w", name, p.Err)
+			}
+
+			r.Problems = append(r.Problems, p)
+		}
+	}
+
+	if hdr.flags&flagPaged != 0 {
+		db = joinPages(db, func(bucket string, ref pageRef) *dpBucket {
+			return r.salvagePage(path, bucket, pageName(kvFileName, ref))
+		}, r.addProblem)
+	}
+
+	return db
+}
+
+// salvagePage recovers what can be read of the file of a page of the bucket,
+// and returns the content of the page or nil when nothing can be read.
+func (r *RepairReport) salvagePage(path, bucket, name string) *dpBucket {
+	data, err := os.ReadFile(filepath.Join(path, name))
+	if err != nil {
+		r.addProblem(bucket, xerrors.Errorf("%w: page %s: %v", ErrCorrupted, name, err))
+		return nil
+	}
+
+	sub := RepairReport{}
+	buckets := sub.salvage(data)
+
+	r.Skipped += sub.Skipped
+
+	for _, p := range sub.Problems {
+		r.addProblem(bucket, xerrors.Errorf("page %s: %w", name, p.Err))
+	}
+
+	return buckets[""]
+}
+
+// latestShards returns the names of the latest version of every shard in the
+// directory.
+func latestShards(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[int]uint64)
+
+	for _, entry := range entries {
+		shard, gen, ok := parseShardName(kvFileName, entry.Name())
+		if !ok {
+			continue
+		}
+
+		if gen > latest[shard] {
+			latest[shard] = gen
+		}
+	}
+
+	names := make([]string, 0, len(latest))
+	for shard, gen := range latest {
+		names = append(names, shardName(kvFileName, shard, gen))
+	}
+
+	slices.Sort(names)
+
+	return names, nil
+}
+
+// guessBody returns the body of the data assuming a damaged header is still
+// at its place.
+func guessBody(data []byte) (header, []byte) {
+	var hdr header
+
+	if len(data) < headerLengthV1 {
+		return hdr, nil
+	}
+
+	hdr.version = binary.BigEndian.Uint16(data[4:6])
+	hdr.flags = binary.BigEndian.Uint16(data[6:8])
+
+	switch {
+	case hdr.version == 1:
+		return hdr, data[headerLengthV1:]
+	case len(data) > headerLength:
+		// a damaged version is assumed to be the current one
+		hdr.version = formatVersion
+		return hdr, data[headerLength:]
+	default:
+		return hdr, nil
+	}
+}
+
+// findBucket returns the offset of the first bucket at or after the given one
+// that can be framed and matches its checksum, or the length of the body if
+// there is none. The framing of an offset that is not the start of a bucket
+// usually fails after a few fields, as the lengths must fit and the keys must
+// be sorted, so that the body is scanned in about one pass rather than decoded
+// from every offset.
+func findBucket(body []byte, from int) int {
+	for offset := from; offset < len(body); offset++ {
+		end, ok := frameBucket(body, offset)
+		if !ok || len(body)-end < checksumLength {
+			continue
+		}
+
+		sum := binary.BigEndian.Uint32(body[end : end+checksumLength])
+		if crc32.Checksum(body[offset:end], castagnoli) == sum {
+			return offset
+		}
+	}
+
+	return len(body)
+}
+
+// frameBucket returns the end of the bucket at the offset by only reading the
+// lengths of its fields and comparing its keys, or false when they do not fit
+// in the body or are not sorted.
+func frameBucket(body []byte, offset int) (int, bool) {
+	pos := offset
+
+	// field returns the next field of bytes
+	field := func() ([]byte, bool) {
+		length, n := binary.Uvarint(body[pos:])
+		if n <= 0 || length > uint64(len(body)-pos-n) {
+			return nil, false
+		}
+
+		data := body[pos+n : pos+n+int(length)]
+		pos += n + int(length)
+
+		return data, true
+	}
+
+	_, ok := field()
+	if !ok {
+		return 0, false
+	}
+
+	count, n := binary.Uvarint(body[pos:])
+	// a pair takes at least the two bytes of its lengths
+	if n <= 0 || count > uint64(len(body)-pos-n)/2 {
+		return 0, false
+	}
+
+	pos += n
+
+	var prev []byte
+
+	for i := uint64(0); i < count; i++ {
+		key, ok := field()
+		if !ok || i > 0 && bytes.Compare(prev, key) >= 0 {
+			return 0, false
+		}
+
+		_, ok = field()
+		if !ok {
+			return 0, false
+		}
+
+		prev = key
+	}
+
+	return pos, true
+}
+
+// merge adds the pairs of the bucket to the bucket of the same name.
+func merge(db map[string]*dpBucket, name string, bucket *dpBucket) {
+	existing, found := db[name]
+	if !found {
+		db[name] = bucket
+		return
+	}
+
+	for k, v := range bucket.Kv {
+		existing.Kv[k] = v
+	}
+
+	existing.updateIndex()
+}
+
+// readGobUint reads an unsigned integer in the encoding of gob, which is either
+// a byte lower than 128, or the negated number of bytes that follow in big
+// endian. It returns the number of bytes read, or 0 when it is truncated.
+func readGobUint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+
+	if data[0] < 0x80 {
+		return uint64(data[0]), 1
+	}
+
+	n := int(-int8(data[0]))
+	if n > 8 || len(data) < 1+n {
+		return 0, 0
+	}
+
+	var v uint64
+	for _, b := range data[1 : 1+n] {
+		v = v<<8 | uint64(b)
+	}
+
+	return v, 1 + n
+}
+
+// appendGobUint appends an unsigned integer in the encoding of gob.
+func appendGobUint(buf []byte, v uint64) []byte {
+	if v < 0x80 {
+		return append(buf, byte(v))
+	}
+
+	be := binary.BigEndian.AppendUint64(nil, v)
+	for be[0] == 0 {
+		be = be[1:]
+	}
+
+	buf = append(buf, byte(-int8(len(be))))
+
+	return append(buf, be...)
+}
+
+func (r *RepairReport) addProblem(bucket string, err error) {
+	r.Problems = append(r.Problems, Problem{Bucket: bucket, Err: err})
+}
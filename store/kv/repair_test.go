@@ -0,0 +1,236 @@
+package purbkv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepair_SkipDamagedBucket(t *testing.T) {
+	dir, out := newRepairDirs(t)
+
+	data := encodeBuckets(map[string]*dpBucket{
+		"A": makeBucket("ping", "pong"),
+		"B": makeBucket("1", "a"),
+		"C": makeBucket("x", "y", "z", "w"),
+	}, flagChecksums).Bytes()
+
+	// the length of the first key of B now exceeds the file
+	data[headerLength+1+17+3] = 0x7f
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), data, filePerm))
+
+	report, err := Repair(dir, out)
+	require.NoError(t, err)
+	// B is recovered without any pair
+	require.Equal(t, 3, report.Buckets)
+	require.Equal(t, 3, report.Pairs)
+	require.Greater(t, report.Skipped, 0)
+	require.Len(t, report.Problems, 1)
+	require.Equal(t, "B", report.Problems[0].Bucket)
+	require.ErrorIs(t, report.Problems[0].Err, ErrCorrupted)
+	require.Contains(t, report.String(), "problems: 1")
+
+	db, err := NewDB(out, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	requireValue(t, db, "A", "ping", "pong")
+	requireValue(t, db, "C", "z", "w")
+}
+
+func TestRepair_TruncatedLegacy(t *testing.T) {
+	dir, out := newRepairDirs(t)
+
+	legacy := make(map[string]*dpBucket)
+	for i := 0; i < 10; i++ {
+		legacy[fmt.Sprintf("bucket%d", i)] = makeBucket("ping", fmt.Sprintf("pong%d", i))
+	}
+
+	var data bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&data).Encode(legacy))
+
+	// the last bucket is cut
+	truncated := data.Bytes()[:data.Len()-5]
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), truncated, filePerm))
+
+	report, err := Repair(dir, out)
+	require.NoError(t, err)
+	require.Equal(t, 9, report.Buckets)
+	require.Equal(t, 9, report.Pairs)
+	require.Len(t, report.Problems, 1)
+	require.ErrorIs(t, report.Problems[0].Err, ErrCorrupted)
+	require.ErrorContains(t, report.Problems[0].Err, "after 9 buckets")
+
+	db, err := NewDB(out, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(txn ReadableTx) error {
+		recovered := 0
+
+		for i := 0; i < 10; i++ {
+			b := txn.GetBucket([]byte(fmt.Sprintf("bucket%d", i)))
+			if b == nil {
+				continue
+			}
+
+			value, err := b.Get([]byte("ping"))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("pong%d", i)), value)
+
+			recovered++
+		}
+
+		require.Equal(t, 9, recovered)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestRepair_SkipLargeBucket(t *testing.T) {
+	dir, out := newRepairDirs(t)
+
+	large := &dpBucket{Kv: make(kv)}
+	for i := 0; i < 20000; i++ {
+		large.Kv[fmt.Sprintf("key%05d", i)] = []byte(fmt.Sprintf("value%05d", i))
+	}
+
+	data := encodeBuckets(map[string]*dpBucket{
+		"A": large,
+		"B": makeBucket("1", "a"),
+	}, flagChecksums).Bytes()
+
+	// the length of the name of A now exceeds the file, so that the scan goes
+	// through all of its pairs to find B
+	data[headerLength+1] = 0xff
+	data[headerLength+2] = 0xff
+	data[headerLength+3] = 0x7f
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), data, filePerm))
+
+	body := data[headerLength:]
+	end, ok := frameBucket(body, len(body)-checksumLength-7)
+	require.True(t, ok)
+	require.Equal(t, len(body)-checksumLength, end)
+
+	report, err := Repair(dir, out)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Buckets)
+	require.Equal(t, 1, report.Pairs)
+	require.Greater(t, report.Skipped, 20000*20)
+
+	db, err := NewDB(out, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	requireValue(t, db, "B", "1", "a")
+}
+
+func TestRepair_ChecksumMismatch(t *testing.T) {
+	dir, out := newRepairDirs(t)
+
+	data := encodeBuckets(map[string]*dpBucket{
+		"A": makeBucket("ping", "pong"),
+	}, flagChecksums).Bytes()
+
+	data[headerLength+1+12] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), data, filePerm))
+
+	report, err := Repair(dir, out)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Pairs)
+	require.Len(t, report.Problems, 1)
+	require.ErrorContains(t, report.Problems[0].Err, "its pairs may be damaged")
+
+	verified, err := Verify(out, false)
+	require.NoError(t, err)
+	require.True(t, verified.OK())
+}
+
+func TestRepair_TruncatedWithoutChecksums(t *testing.T) {
+	dir, out := newRepairDirs(t)
+
+	// version 1 with a bucket cut in the middle of its second value
+	data := []byte("PKVD\x00\x01\x00\x00\x01\x01A\x02\x011\x01a\x012\x05bb")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), data, filePerm))
+
+	report, err := Repair(dir, out)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Buckets)
+	require.Equal(t, 1, report.Pairs)
+	require.Len(t, report.Problems, 2)
+	require.ErrorContains(t, report.Problems[0].Err, "damaged after 1 pair(s)")
+
+	db, err := NewDB(out, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	requireValue(t, db, "A", "1", "a")
+}
+
+func TestRepair_DamagedHeader(t *testing.T) {
+	dir, out := newRepairDirs(t)
+
+	data := encodeBuckets(map[string]*dpBucket{
+		"A": makeBucket("ping", "pong"),
+	}, flagChecksums).Bytes()
+
+	data[10] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), data, filePerm))
+
+	report, err := Repair(dir, out)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Pairs)
+	require.Len(t, report.Problems, 1)
+	require.ErrorContains(t, report.Problems[0].Err, "header checksum mismatch")
+}
+
+func TestRepair_Errors(t *testing.T) {
+	dir, out := newRepairDirs(t)
+
+	_, err := Repair(dir, out)
+	require.ErrorContains(t, err, "failed to read DB file")
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = Repair(dir, dir)
+	require.ErrorContains(t, err, "refusing to overwrite")
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// newRepairDirs creates the directory of a damaged database and the output
+// directory of its repair, which does not exist yet.
+func newRepairDirs(t *testing.T) (string, string) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	damaged := filepath.Join(dir, "damaged")
+	require.NoError(t, os.Mkdir(damaged, dirPerm))
+
+	return damaged, filepath.Join(dir, "repaired")
+}
+
+func requireValue(t *testing.T, db DB, bucket, key, value string) {
+	err := db.View(func(txn ReadableTx) error {
+		b := txn.GetBucket([]byte(bucket))
+		require.NotNil(t, b)
+
+		v, err := b.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), v)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
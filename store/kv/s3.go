@@ -0,0 +1,402 @@
+package purbkv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// s3Timeout bounds every request to the object store.
+	s3Timeout = 30 * time.Second
+	// s3ErrorLimit is the maximum number of bytes read from an error response.
+	s3ErrorLimit = 4096
+
+	amzDateFormat = "20060102T150405Z"
+	amzAlgorithm  = "AWS4-HMAC-SHA256"
+)
+
+// s3Template contains the parameters of an S3 store.
+type s3Template struct {
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// S3Option is the type of option to set some fields of an S3 store.
+type S3Option func(*s3Template)
+
+// WithS3Credentials is an option to sign the requests with the access key. The
+// requests are anonymous otherwise.
+func WithS3Credentials(accessKey, secretKey string) S3Option {
+	return func(tmpl *s3Template) {
+		tmpl.accessKey = accessKey
+		tmpl.secretKey = secretKey
+	}
+}
+
+// WithS3Region is an option to set the region the requests are signed for. The
+// default is us-east-1, which most S3-compatible servers accept.
+func WithS3Region(region string) S3Option {
+	return func(tmpl *s3Template) {
+		tmpl.region = region
+	}
+}
+
+// WithS3Prefix is an option to prepend a prefix to the name of every object, so
+// that several databases can share a bucket.
+func WithS3Prefix(prefix string) S3Option {
+	return func(tmpl *s3Template) {
+		tmpl.prefix = prefix
+	}
+}
+
+// WithS3Client is an option to set the HTTP client of the requests.
+func WithS3Client(client *http.Client) S3Option {
+	return func(tmpl *s3Template) {
+		tmpl.client = client
+	}
+}
+
+// s3Store keeps the objects in a bucket of an S3-compatible object store, which
+// is addressed in the path style.
+//
+// - implements purbkv.BlobStore
+type s3Store struct {
+	endpoint *url.URL
+	bucket   string
+	tmpl     s3Template
+}
+
+// NewS3Store returns a store that keeps the objects in the bucket of the
+// S3-compatible object store at the endpoint, for instance
+// https://s3.example.com. The bucket must exist. Without PURB, the content of
+// the database is sent and stored in plaintext.
+func NewS3Store(endpoint, bucket string, opts ...S3Option) (BlobStore, error) {
+	tmpl := s3Template{
+		region: "us-east-1",
+		client: &http.Client{Timeout: s3Timeout},
+		now:    time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(&tmpl)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid endpoint: %v", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, xerrors.Errorf("invalid endpoint %q: expected http(s)://host", endpoint)
+	}
+
+	if bucket == "" {
+		return nil, xerrors.New("missing bucket")
+	}
+
+	s := &s3Store{
+		endpoint: u,
+		bucket:   bucket,
+		tmpl:     tmpl,
+	}
+
+	return s, nil
+}
+
+// Get implements purbkv.BlobStore. It downloads the object.
+func (s *s3Store) Get(name string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		missing, e := isMissingObject(resp)
+		if missing {
+			return nil, xerrors.Errorf("object %q: %w", name, fs.ErrNotExist)
+		}
+
+		return nil, xerrors.Errorf("failed to get object %q: %v", name, e)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read object %q: %v", name, err)
+	}
+
+	return data, nil
+}
+
+// Put implements purbkv.BlobStore. It uploads the object, which replaces the
+// previous one at once.
+func (s *s3Store) Put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return xerrors.Errorf("failed to put object %q: %v", name, readS3Error(resp))
+	}
+
+	return nil
+}
+
+// Exists implements purbkv.BlobStore. It returns true if the object exists.
+func (s *s3Store) Exists(name string) (bool, error) {
+	resp, err := s.do(http.MethodHead, name, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, xerrors.Errorf("failed to stat object %q: %s", name, resp.Status)
+	}
+}
+
+// Delete implements purbkv.BlobStore. It deletes the object.
+func (s *s3Store) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	missing, e := isMissingObject(resp)
+	if missing {
+		return nil
+	}
+
+	return xerrors.Errorf("failed to delete object %q: %v", name, e)
+}
+
+// do sends a signed request for the object.
+func (s *s3Store) do(method, name string, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + s.tmpl.prefix + name
+	u.RawPath = uriEncode(u.Path, false)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create request: %v", err)
+	}
+
+	if s.tmpl.accessKey != "" {
+		signer := s3Signer{
+			accessKey: s.tmpl.accessKey,
+			secretKey: s.tmpl.secretKey,
+			region:    s.tmpl.region,
+		}
+
+		signer.sign(req, body, s.tmpl.now())
+	}
+
+	resp, err := s.tmpl.client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to send request: %v", err)
+	}
+
+	return resp, nil
+}
+
+// s3Error is the error document of an S3 response.
+type s3Error struct {
+	Status  string `xml:"-"`
+	Code    string
+	Message string
+}
+
+// Error implements error. It returns the status and the code of the response.
+func (e s3Error) Error() string {
+	if e.Code == "" {
+		return "unexpected response " + e.Status
+	}
+
+	return e.Status + ": " + e.Code + ": " + e.Message
+}
+
+// readS3Error returns the error described by the response.
+func readS3Error(resp *http.Response) s3Error {
+	var e s3Error
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, s3ErrorLimit))
+
+	err := xml.Unmarshal(data, &e)
+	if err != nil {
+		e = s3Error{}
+	}
+
+	e.Status = resp.Status
+
+	return e
+}
+
+// isMissingObject returns true if the response is for an object that does not
+// exist, and not for a bucket that does not exist.
+func isMissingObject(resp *http.Response) (bool, s3Error) {
+	if resp.StatusCode != http.StatusNotFound {
+		return false, readS3Error(resp)
+	}
+
+	e := readS3Error(resp)
+
+	return e.Code != "NoSuchBucket", e
+}
+
+// s3Signer signs the requests with the version 4 of the AWS signature.
+type s3Signer struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+// sign adds the headers that authenticate the request. Every header already
+// set is signed, with the host.
+func (s s3Signer) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", now.UTC().Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	signed := []string{"host"}
+	for name := range req.Header {
+		signed = append(signed, strings.ToLower(name))
+	}
+
+	slices.Sort(signed)
+
+	req.Header.Set("Authorization", amzAlgorithm+
+		" Credential="+s.accessKey+"/"+s.scope(now)+
+		", SignedHeaders="+strings.Join(signed, ";")+
+		", Signature="+s.signature(req, signed, now))
+}
+
+// signature returns the signature of the request for the signed headers, which
+// must be sorted. The path must be encoded as expected by the signature, and
+// the payload hash is the one of the X-Amz-Content-Sha256 header.
+func (s s3Signer) signature(req *http.Request, signed []string, now time.Time) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	var headers strings.Builder
+
+	for _, name := range signed {
+		value := host
+		if name != "host" {
+			value = strings.Join(strings.Fields(strings.Join(req.Header.Values(name), ",")), " ")
+		}
+
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		headers.String(),
+		strings.Join(signed, ";"),
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonical))
+
+	toSign := strings.Join([]string{
+		amzAlgorithm,
+		now.UTC().Format(amzDateFormat),
+		s.scope(now),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.UTC().Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// scope returns the credential scope of the day.
+func (s s3Signer) scope(now time.Time) string {
+	return now.UTC().Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted by name with every part encoded.
+func canonicalQuery(query url.Values) string {
+	names := maps.Keys(query)
+	slices.Sort(names)
+
+	var parts []string
+
+	for _, name := range names {
+		values := slices.Clone(query[name])
+		slices.Sort(values)
+
+		for _, value := range values {
+			parts = append(parts, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// uriEncode encodes every byte but the unreserved characters, and the slashes
+// unless it is asked to, as expected by the signature.
+func uriEncode(s string, slash bool) string {
+	var b strings.Builder
+
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+
+	return b.String()
+}
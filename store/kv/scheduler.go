@@ -0,0 +1,104 @@
+package purbkv
+
+import (
+	"sync"
+	"time"
+
+	"go.dedis.ch/dela"
+	"golang.org/x/xerrors"
+)
+
+// scheduler rewrites the database file at a fixed interval, whether something
+// changed or not, so that the modification time of the file does not reveal
+// when transactions are committed. As the PURB encoding is randomized, every
+// rewrite produces a different file.
+type scheduler struct {
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newScheduler(interval time.Duration) *scheduler {
+	return &scheduler{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start runs the write function at every tick until the scheduler is stopped.
+func (s *scheduler) start(write func() error) {
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := write()
+				if err != nil {
+					dela.Logger.Err(err).Msg("scheduled write failed")
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// halt stops the background writes and waits for the current one to finish.
+// It can be called multiple times.
+func (s *scheduler) halt() {
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+}
+
+// Flush implements purbkv.Flusher. It writes the current state of the database
+// to disk and returns once it is saved and synced. With DurabilitySync, every
+// commit is already saved and it does nothing.
+func (p *purbDB) Flush() error {
+	if p.durability == DurabilitySync {
+		return nil
+	}
+
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+
+	err := p.flush()
+	if err != nil {
+		return xerrors.Errorf("failed to flush: %v", err)
+	}
+
+	return nil
+}
+
+// flush saves the state of the database. The caller must hold the lock of the
+// updates, so that no commit modifies the buckets while they are written, and
+// the transactions that read are not held until the state is written.
+func (p *purbDB) flush() error {
+	p.bucketDb.RLock()
+
+	if p.closed {
+		p.bucketDb.RUnlock()
+		return ErrClosed
+	}
+
+	err := p.save(p.bucketDb.Db, p.bucketDb.pages, nil)
+	p.bucketDb.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	// the cache of a lazily loaded database now holds the changes
+	if p.cache != nil {
+		p.forget()
+	}
+
+	return p.sync()
+}
@@ -0,0 +1,119 @@
+package purbkv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler_DelaysWrites(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithScheduledWrites(time.Hour))
+	require.NoError(t, err)
+
+	before, err := os.ReadFile(filepath.Join(dir, purbFileName))
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("ping"), []byte("pong"))
+
+	// nothing is written before the next tick
+	after, err := os.ReadFile(filepath.Join(dir, purbFileName))
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	err = db.View(func(txn ReadableTx) error {
+		value, err := txn.GetBucket([]byte("bucket")).Get([]byte("ping"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("pong"), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.(Flusher).Flush()
+	require.NoError(t, err)
+	require.NotEqual(t, before, readFile(t, dir))
+
+	require.NoError(t, db.Close())
+	require.NoError(t, db.Close())
+}
+
+func TestScheduler_CoverWrites(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithScheduledWrites(10*time.Millisecond))
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("ping"), []byte("pong"))
+
+	first := waitForChange(t, dir, readFile(t, dir))
+
+	// the file is rewritten with new random bytes even without changes
+	waitForChange(t, dir, first)
+
+	require.NoError(t, db.Close())
+}
+
+func TestScheduler_CloseWritesPending(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithScheduledWrites(time.Hour))
+	require.NoError(t, err)
+
+	setValue(t, db, []byte("ping"), []byte("pong"))
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, false)
+	require.NoError(t, err)
+
+	err = db.View(func(txn ReadableTx) error {
+		value, err := txn.GetBucket([]byte("bucket")).Get([]byte("ping"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("pong"), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.(Flusher).Flush())
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+// waitForChange waits until the content of the database file differs from the
+// previous one and returns it.
+func waitForChange(t *testing.T, dir string, previous []byte) []byte {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		data := readFile(t, dir)
+
+		if len(data) > 0 && string(data) != string(previous) {
+			return data
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func readFile(t *testing.T, dir string) []byte {
+	data, err := os.ReadFile(filepath.Join(dir, purbFileName))
+	require.NoError(t, err)
+
+	return data
+}
@@ -0,0 +1,621 @@
+package purbkv
+
+// This file implements the sharded layout, where the buckets are spread over
+// several shards that are encoded, and encrypted with PURB, independently. The
+// database file is then a manifest that lists the shards:
+//
+//	manifest = key (bytes) | generation (uvarint) | count (uvarint) |
+//	           shard generation (uvarint)* | stale count (uvarint) | stale* |
+//	           [stale page count (uvarint) | page*]
+//	stale    = shard (uvarint) | generation (uvarint)
+//
+// The manifest has the header of the format with flagManifest, and flagPaged
+// when the buckets are split in pages, in which case it also lists the pages
+// replaced by the last commit as described in paging.go. It is followed by its
+// CRC32C with flagChecksums. Each shard is a database file of
+// its own that is named after the database file, its index and the generation
+// of the commit that wrote it, for instance purb.db.3.17. A bucket belongs to
+// the shard given by a keyed hash of its name, so that the layout does not tell
+// which bucket is in which shard without the key of the manifest.
+//
+// A commit writes the shards it changed under the new generation, then the
+// manifest, and finally deletes the shards it replaced, which are listed as
+// stale in the manifest. A database interrupted in the middle of a commit is
+// either at the old or at the new generation, and the shards left behind are
+// deleted when it is opened again.
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"slices"
+
+	"go.dedis.ch/dela"
+	"golang.org/x/exp/maps"
+	"golang.org/x/xerrors"
+)
+
+// shardKeyLength is the length of the key that assigns buckets to shards.
+const shardKeyLength = 32
+
+// maxShards bounds the number of shards read from a manifest.
+const maxShards = 1 << 16
+
+// manifest is the content of the database file of a sharded database.
+type manifest struct {
+	key        []byte
+	generation uint64
+	// shards are the generations of the shards
+	shards []uint64
+	// stale are the shards replaced by the last commit
+	stale []shardRef
+	// paged is true when the shards hold the roots of the pages of the
+	// buckets
+	paged bool
+	// stalePages are the pages replaced by the last commit
+	stalePages []pageRef
+}
+
+// shardRef is a version of a shard.
+type shardRef struct {
+	shard      int
+	generation uint64
+}
+
+// newManifest returns the manifest of a new database with the given number of
+// shards, none of which is written yet.
+func newManifest(count int) (*manifest, error) {
+	key := make([]byte, shardKeyLength)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to generate key: %v", err)
+	}
+
+	m := &manifest{
+		key:    key,
+		shards: make([]uint64, count),
+	}
+
+	return m, nil
+}
+
+// shardOf returns the shard of the bucket.
+func (m *manifest) shardOf(name string) int {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(name))
+
+	return int(binary.BigEndian.Uint64(mac.Sum(nil)) % uint64(len(m.shards)))
+}
+
+// split returns the buckets of every shard.
+func (m *manifest) split(db map[string]*dpBucket) []map[string]*dpBucket {
+	groups := make([]map[string]*dpBucket, len(m.shards))
+	for i := range groups {
+		groups[i] = make(map[string]*dpBucket)
+	}
+
+	for name, bucket := range db {
+		groups[m.shardOf(name)][name] = bucket
+	}
+
+	return groups
+}
+
+// next returns the manifest of the next commit, which replaces the shards.
+func (m *manifest) next(shards []int) *manifest {
+	next := &manifest{
+		key:        m.key,
+		generation: m.generation + 1,
+		shards:     slices.Clone(m.shards),
+		paged:      m.paged,
+	}
+
+	for _, i := range shards {
+		if m.shards[i] != 0 {
+			next.stale = append(next.stale, shardRef{shard: i, generation: m.shards[i]})
+		}
+
+		next.shards[i] = next.generation
+	}
+
+	return next
+}
+
+// encodeManifest serializes the manifest in the current format.
+func encodeManifest(m *manifest, flags uint16) *bytes.Buffer {
+	body := new(bytes.Buffer)
+
+	writeBytes(body, m.key)
+	writeUvarint(body, m.generation)
+	writeUvarint(body, uint64(len(m.shards)))
+
+	for _, gen := range m.shards {
+		writeUvarint(body, gen)
+	}
+
+	writeUvarint(body, uint64(len(m.stale)))
+
+	for _, ref := range m.stale {
+		writeUvarint(body, uint64(ref.shard))
+		writeUvarint(body, ref.generation)
+	}
+
+	if m.paged {
+		writeUvarint(body, uint64(len(m.stalePages)))
+
+		for _, ref := range m.stalePages {
+			body.Write(encodePageRef(ref))
+		}
+	}
+
+	if flags&flagChecksums != 0 {
+		body.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(body.Bytes(), castagnoli)))
+	}
+
+	flags |= flagManifest
+	if m.paged {
+		flags |= flagPaged
+	}
+
+	buf := bytes.NewBuffer(encodeHeader(flags, body.Len()))
+	buf.Write(body.Bytes())
+
+	return buf
+}
+
+// decodeManifest deserializes the body of a manifest. Errors wrap
+// ErrCorrupted.
+func decodeManifest(body []byte, flags uint16) (*manifest, error) {
+	if flags&flagChecksums != 0 {
+		if len(body) < checksumLength {
+			return nil, xerrors.Errorf("%w: manifest is too short", ErrCorrupted)
+		}
+
+		end := len(body) - checksumLength
+
+		err := verifyChecksum(body[:end], bytes.NewReader(body[end:]))
+		if err != nil {
+			return nil, xerrors.Errorf("%w: manifest: %v", ErrCorrupted, err)
+		}
+
+		body = body[:end]
+	}
+
+	m, err := readManifest(bytes.NewReader(body), flags&flagPaged != 0)
+	if err != nil {
+		return nil, xerrors.Errorf("%w: manifest: %v", ErrCorrupted, err)
+	}
+
+	return m, nil
+}
+
+func readManifest(r *bytes.Reader, paged bool) (*manifest, error) {
+	m := &manifest{paged: paged}
+
+	key, err := readBytes(r)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read key: %v", err)
+	}
+
+	if len(key) != shardKeyLength {
+		return nil, xerrors.Errorf("key has %d bytes", len(key))
+	}
+
+	m.key = slices.Clone(key)
+
+	m.generation, err = readUvarint(r)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read generation: %v", err)
+	}
+
+	count, err := readUvarint(r)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read number of shards: %v", err)
+	}
+
+	if count == 0 || count > maxShards {
+		return nil, xerrors.Errorf("invalid number of shards %d", count)
+	}
+
+	m.shards = make([]uint64, count)
+
+	for i := range m.shards {
+		m.shards[i], err = readUvarint(r)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read shard #%d: %v", i, err)
+		}
+
+		if m.shards[i] > m.generation {
+			return nil, xerrors.Errorf("shard #%d is from a later generation", i)
+		}
+	}
+
+	count, err = readUvarint(r)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read number of stale shards: %v", err)
+	}
+
+	for i := uint64(0); i < count && r.Len() > 0; i++ {
+		shard, err := readUvarint(r)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read stale shard: %v", err)
+		}
+
+		gen, err := readUvarint(r)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read stale shard: %v", err)
+		}
+
+		if shard >= uint64(len(m.shards)) {
+			return nil, xerrors.Errorf("stale shard #%d does not exist", shard)
+		}
+
+		m.stale = append(m.stale, shardRef{shard: int(shard), generation: gen})
+	}
+
+	if uint64(len(m.stale)) != count {
+		return nil, xerrors.New("unexpected length")
+	}
+
+	if paged {
+		count, err = readUvarint(r)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read number of stale pages: %v", err)
+		}
+
+		for i := uint64(0); i < count && r.Len() > 0; i++ {
+			ref, err := readPageRef(r)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to read stale page: %v", err)
+			}
+
+			m.stalePages = append(m.stalePages, ref)
+		}
+
+		if uint64(len(m.stalePages)) != count {
+			return nil, xerrors.New("unexpected length")
+		}
+	}
+
+	if r.Len() > 0 {
+		return nil, xerrors.New("unexpected length")
+	}
+
+	return m, nil
+}
+
+// isManifest returns true if the data is the manifest of a sharded database.
+func isManifest(data []byte) bool {
+	hdr, _, err := parseHeader(data)
+
+	return err == nil && hdr.flags&flagManifest != 0
+}
+
+// shardName returns the name of the file of a version of a shard.
+func shardName(dbName string, shard int, generation uint64) string {
+	return fmt.Sprintf("%s.%d.%d", dbName, shard, generation)
+}
+
+// parseShardName returns the shard and the generation of the file with the
+// given name, or false when it is not the file of a shard of the database file.
+func parseShardName(dbName, name string) (int, uint64, bool) {
+	var shard int
+	var gen uint64
+
+	_, err := fmt.Sscanf(name, dbName+".%d.%d", &shard, &gen)
+	if err != nil || shardName(dbName, shard, gen) != name {
+		return 0, 0, false
+	}
+
+	return shard, gen, true
+}
+
+// loadShards reads every shard of the manifest, unless the database is loaded
+// lazily, and deletes the ones left behind by the last commit.
+func (p *purbDB) loadShards(m *manifest) error {
+	// the pages are always read on demand
+	if p.cache == nil && m.paged {
+		p.cache = newShardCache(nil, 0, p.readShard, p.readPage)
+	}
+
+	if p.cache != nil {
+		p.cache.manifest = m
+	} else {
+		db := make(map[string]*dpBucket)
+
+		for i := range m.shards {
+			buckets, err := p.readShard(m, i)
+			if err != nil {
+				return err
+			}
+
+			for bucket, content := range buckets {
+				db[bucket] = content
+			}
+		}
+
+		p.bucketDb.Db = db
+	}
+
+	p.shards = m
+
+	p.deleteShards(m.stale)
+
+	// a commit interrupted before its manifest leaves its shards behind
+	orphans := make([]shardRef, len(m.shards))
+	for i := range orphans {
+		orphans[i] = shardRef{shard: i, generation: m.generation + 1}
+	}
+
+	p.deleteShards(orphans)
+
+	if m.paged {
+		p.deletePages(m.stalePages)
+		p.deleteOrphanPages(m.generation + 1)
+	}
+
+	return nil
+}
+
+// writeShards writes the pages that are not saved yet, the shards of the
+// buckets that changed, or every shard if dirty is nil, and then the manifest.
+// It returns the function that makes them the shards and the pages of the
+// database, and deletes the previous ones.
+func (p *purbDB) writeShards(db map[string]*dpBucket, pages pageSet, dirty []string) (func(), error) {
+	var shards []int
+
+	if dirty == nil {
+		for i := range p.shards.shards {
+			shards = append(shards, i)
+		}
+	} else {
+		for _, name := range dirty {
+			shards = append(shards, p.shards.shardOf(name))
+		}
+
+		slices.Sort(shards)
+		shards = slices.Compact(shards)
+	}
+
+	if len(shards) == 0 {
+		return func() {}, nil
+	}
+
+	next := p.shards.next(shards)
+
+	var saved map[pageRef]*dpBucket
+
+	// the roots refer to the pages once they are written
+	if next.paged {
+		var err error
+
+		db, saved, err = p.writePages(db, pages, next.generation)
+		if err != nil {
+			return nil, err
+		}
+
+		next.stalePages = pages.stale
+	}
+
+	// discard removes what is written when the commit fails
+	discard := func(written []shardRef) {
+		refs := maps.Keys(saved)
+		slices.SortFunc(refs, func(a, b pageRef) int {
+			return cmp.Compare(a.index, b.index)
+		})
+
+		p.deleteShards(written)
+		p.deletePages(refs)
+	}
+
+	groups, err := p.shardGroups(db, shards)
+	if err != nil {
+		discard(nil)
+		return nil, xerrors.Errorf("failed to read shards: %v", err)
+	}
+
+	written := make([]shardRef, 0, len(shards))
+
+	for _, i := range shards {
+		data, err := p.encode(groups[i])
+		if err == nil {
+			err = p.store.Put(shardName(p.dbName, i, next.generation), data)
+			wipe(data)
+		}
+		if err != nil {
+			discard(written)
+			return nil, xerrors.Errorf("failed to save shard: %v", err)
+		}
+
+		written = append(written, shardRef{shard: i, generation: next.generation})
+	}
+
+	data, err := p.seal(encodeManifest(next, p.flags()))
+	if err == nil {
+		err = p.store.Put(p.dbName, data)
+	}
+	if err != nil {
+		discard(written)
+		return nil, xerrors.Errorf("failed to save manifest: %v", err)
+	}
+
+	publish := func() {
+		p.fileLock.Lock()
+		defer p.fileLock.Unlock()
+
+		p.shards = next
+
+		if p.cache != nil {
+			p.cache.update(next, groups, saved)
+		}
+
+		p.deleteShards(next.stale)
+		p.deletePages(next.stalePages)
+		p.merkle.dropPages(next.stalePages)
+	}
+
+	return publish, nil
+}
+
+// migrateShards writes every shard, and then the manifest, in the format of the
+// other database. The shards and the pages are read and written one at a time
+// so that a paged database does not have to fit in memory. It returns the names
+// of the files of the shards and the pages it replaces. The caller must hold the
+// locks of the buckets and of the file.
+func (p *purbDB) migrateShards(next *purbDB) ([]string, error) {
+	var files []string
+	var pages []pageRef
+
+	shards := make([]int, len(p.shards.shards))
+
+	for i, gen := range p.shards.shards {
+		shards[i] = i
+
+		if gen != 0 {
+			files = append(files, shardName(p.dbName, i, gen))
+		}
+	}
+
+	m := p.shards.next(shards)
+
+	// the files of the other format are removed by the migration
+	m.stale = nil
+
+	written := make([]shardRef, 0, len(shards))
+
+	discard := func() {
+		next.deleteShards(written)
+		next.deletePages(pages)
+	}
+
+	db := p.bucketDb.Db
+
+	// the pages that are not saved yet are written by the next save, with the
+	// roots that refer to them
+	if p.shards.paged {
+		db = nil
+	}
+
+	for _, i := range shards {
+		groups, err := p.shardGroups(db, []int{i})
+		if err != nil {
+			discard()
+			return nil, xerrors.Errorf("failed to read shards: %v", err)
+		}
+
+		if p.shards.paged {
+			err = p.migratePages(next, groups[i], &pages)
+			if err != nil {
+				discard()
+				return nil, err
+			}
+		}
+
+		data, err := next.encode(groups[i])
+		if err == nil {
+			err = p.store.Put(shardName(next.dbName, i, m.generation), data)
+			wipe(data)
+		}
+		if err != nil {
+			discard()
+			return nil, xerrors.Errorf("failed to write shard: %v", err)
+		}
+
+		written = append(written, shardRef{shard: i, generation: m.generation})
+	}
+
+	data, err := next.seal(encodeManifest(m, next.flags()))
+	if err == nil {
+		err = p.store.Put(next.dbName, data)
+	}
+	if err != nil {
+		discard()
+		return nil, xerrors.Errorf("failed to write manifest: %v", err)
+	}
+
+	next.shards = m
+
+	for _, ref := range pages {
+		files = append(files, pageName(p.dbName, ref))
+	}
+
+	return files, nil
+}
+
+// shardGroups returns the buckets of the shards in the state. The state of a
+// lazily loaded database only holds the changes that are not saved, and the
+// other buckets are read from the cache.
+func (p *purbDB) shardGroups(db map[string]*dpBucket, shards []int) (map[int]map[string]*dpBucket, error) {
+	split := p.shards.split(db)
+	groups := make(map[int]map[string]*dpBucket, len(shards))
+
+	for _, i := range shards {
+		groups[i] = split[i]
+
+		if p.cache == nil {
+			continue
+		}
+
+		saved, err := p.cache.shard(i)
+		if err != nil {
+			return nil, err
+		}
+
+		groups[i] = maps.Clone(saved)
+		maps.Copy(groups[i], split[i])
+	}
+
+	return groups, nil
+}
+
+// deleteShards deletes the versions of the shards. A failure is only logged as
+// the shards are not used anymore, and they are deleted again at the next open
+// when they are stale.
+func (p *purbDB) deleteShards(refs []shardRef) {
+	for _, ref := range refs {
+		name := shardName(p.dbName, ref.shard, ref.generation)
+
+		err := p.store.Delete(name)
+		if err != nil {
+			dela.Logger.Warn().Err(err).Msgf("failed to delete shard %s", name)
+		}
+	}
+}
+
+// shardsHeadroom returns the smallest headroom of the shards.
+func (p *purbDB) shardsHeadroom(db map[string]*dpBucket) (int, error) {
+	shards := make([]int, len(p.shards.shards))
+	for i := range shards {
+		shards[i] = i
+	}
+
+	groups, err := p.shardGroups(db, shards)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to read shards: %v", err)
+	}
+
+	headroom := -1
+
+	for _, group := range groups {
+		data := p.serialize(group)
+		size := data.Len()
+		wipe(data.Bytes())
+
+		n, err := p.blob.Headroom(size)
+		if err != nil {
+			return 0, err
+		}
+
+		if headroom < 0 || n < headroom {
+			headroom = n
+		}
+	}
+
+	return headroom, nil
+}
@@ -0,0 +1,396 @@
+package purbkv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShards_Reopen(t *testing.T) {
+	for _, purbIsOn := range []bool{false, true} {
+		dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		db, err := NewDB(dir, purbIsOn, WithShards(4))
+		require.NoError(t, err)
+
+		setBuckets(t, db, "a", "b", "c", "d", "e")
+		require.NoError(t, db.Close())
+
+		// the layout is read from the manifest
+		db, err = NewDB(dir, purbIsOn)
+		require.NoError(t, err)
+
+		require.NotNil(t, db.(*purbDB).shards)
+
+		for _, name := range []string{"a", "b", "c", "d", "e"} {
+			requireValue(t, db, name, "key", name)
+		}
+
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestShards_OnlyDirty(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewMemoryStore().(*memoryStore)
+
+	db, err := NewDB(dir, true, WithBlobStore(store), WithShards(8))
+	require.NoError(t, err)
+	defer db.Close()
+
+	p := db.(*purbDB)
+
+	// every shard is written when the database is created
+	require.Len(t, store.objects, 9)
+
+	setBuckets(t, db, "a", "b", "c")
+	before := make(map[string][]byte)
+	for name, data := range store.objects {
+		before[name] = bytes.Clone(data)
+	}
+
+	err = db.Update(func(txn WritableTx) error {
+		return txn.GetBucket([]byte("a")).Set([]byte("key"), []byte("changed"))
+	})
+	require.NoError(t, err)
+
+	shard := p.shards.shardOf("a")
+	gen := p.shards.generation
+
+	for name, data := range store.objects {
+		if name == purbFileName {
+			require.NotEqual(t, before[name], data)
+			continue
+		}
+
+		if name == shardName(purbFileName, shard, gen) {
+			require.NotContains(t, before, name)
+			continue
+		}
+
+		// the other shards are neither written nor deleted
+		require.Equal(t, before[name], data, name)
+	}
+
+	require.Len(t, store.objects, 9)
+	require.NotContains(t, store.objects, shardName(purbFileName, shard, gen-1))
+}
+
+func TestShards_HideNames(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true, WithShards(4))
+	require.NoError(t, err)
+
+	setBuckets(t, db, "secret-bucket")
+	require.NoError(t, db.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, purbFileName+"*"))
+	require.NoError(t, err)
+	require.Len(t, files, 5)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, []byte("secret-bucket")), file)
+	}
+}
+
+func TestShards_Cleanup(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewMemoryStore().(*memoryStore)
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithShards(2))
+	require.NoError(t, err)
+
+	setBuckets(t, db, "a")
+
+	m := db.(*purbDB).shards
+	require.NoError(t, db.Close())
+
+	// an interrupted commit leaves its shards behind, and a failed deletion the
+	// shards it replaced
+	orphan := shardName(kvFileName, 1, m.generation+1)
+	stale := shardName(kvFileName, m.stale[0].shard, m.stale[0].generation)
+
+	require.NoError(t, store.Put(orphan, []byte("orphan")))
+	require.NoError(t, store.Put(stale, []byte("stale")))
+
+	db, err = NewDB(dir, false, WithBlobStore(store))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NotContains(t, store.objects, orphan)
+	require.NotContains(t, store.objects, stale)
+
+	requireValue(t, db, "a", "key", "a")
+}
+
+func TestShards_WrongShard(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewMemoryStore().(*memoryStore)
+
+	db, err := NewDB(dir, false, WithBlobStore(store), WithShards(2))
+	require.NoError(t, err)
+
+	setBuckets(t, db, "a")
+
+	m := db.(*purbDB).shards
+	require.NoError(t, db.Close())
+
+	// the bucket is moved to the other shard
+	other := 1 - m.shardOf("a")
+	data := encodeBuckets(map[string]*dpBucket{"a": makeBucket("key", "a")}, flagChecksums)
+
+	require.NoError(t, store.Put(shardName(kvFileName, other, m.shards[other]), data.Bytes()))
+
+	_, err = NewDB(dir, false, WithBlobStore(store))
+	require.ErrorIs(t, err, ErrCorrupted)
+	require.ErrorContains(t, err, `bucket "a" is in the wrong shard`)
+}
+
+func TestShards_Tools(t *testing.T) {
+	layouts := [][]Option{
+		{WithShards(4)},
+		{WithShards(4), WithPaging(128)},
+		{WithShards(4), WithLazyLoading(), WithMemoryBudget(1)},
+	}
+
+	for _, opts := range layouts {
+		dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		db, err := NewDB(dir, false, opts...)
+		require.NoError(t, err)
+
+		keys := setPairs(t, db, "a", 100)
+		setPairs(t, db, "b", 10)
+		setBuckets(t, db, "c")
+
+		root := db.(Prover).Root()
+		require.NoError(t, db.Close())
+
+		// the shards are verified against the root of the buckets
+		report, err := Verify(dir, false, WithExpectedRoot(root))
+		require.NoError(t, err)
+		require.True(t, report.OK(), report.String())
+		require.Equal(t, 3, report.Buckets)
+		require.Equal(t, 111, report.Pairs)
+
+		err = Migrate(dir, true, opts...)
+		require.NoError(t, err)
+		requireNoFiles(t, dir, kvFileName+"*")
+
+		report, err = Verify(dir, true, WithExpectedRoot(root))
+		require.NoError(t, err)
+		require.True(t, report.OK(), report.String())
+
+		err = Migrate(dir, false, opts...)
+		require.NoError(t, err)
+		requireNoFiles(t, dir, purbFileName+"*")
+
+		report, err = Verify(dir, false, WithExpectedRoot(root))
+		require.NoError(t, err)
+		require.True(t, report.OK(), report.String())
+
+		// the output of a repair has the layout of the options
+		repaired, err := Repair(dir, filepath.Join(dir, "repaired"))
+		require.NoError(t, err)
+		require.Empty(t, repaired.Problems)
+		require.Equal(t, 3, repaired.Buckets)
+
+		report, err = Verify(filepath.Join(dir, "repaired"), false, WithExpectedRoot(root))
+		require.NoError(t, err)
+		require.True(t, report.OK(), report.String())
+
+		db, err = NewDB(dir, false, opts...)
+		require.NoError(t, err)
+
+		requirePairs(t, db, "a", keys)
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestShards_MigrateOnline(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithShards(4), WithPaging(128), WithMemoryBudget(1))
+	require.NoError(t, err)
+
+	keys := setPairs(t, db, "a", 100)
+
+	require.NoError(t, db.(Migrator).Migrate(true))
+	requireNoFiles(t, dir, kvFileName+"*")
+
+	// the shards are read and written in the new format
+	keys = append(keys, setPairs(t, db, "b", 100)...)
+	requirePairs(t, db, "a", keys[:100])
+
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dir, true, WithPaging(128))
+	require.NoError(t, err)
+	defer db.Close()
+
+	requirePairs(t, db, "a", keys[:100])
+	requirePairs(t, db, "b", keys[100:])
+}
+
+func TestShards_Damaged(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false, WithShards(4))
+	require.NoError(t, err)
+
+	setBuckets(t, db, "a", "b", "c", "d", "e")
+
+	m := db.(*purbDB).shards
+	require.NoError(t, db.Close())
+
+	// the checksum of the manifest does not match anymore
+	path := filepath.Join(dir, kvFileName)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, filePerm))
+
+	report, err := Verify(dir, false)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.ErrorIs(t, report.Problems[0].Err, ErrCorrupted)
+
+	// the latest shards are recovered without the manifest
+	repaired, err := Repair(dir, filepath.Join(dir, "repaired"))
+	require.NoError(t, err)
+	require.Equal(t, 5, repaired.Buckets)
+	require.Len(t, repaired.Problems, 1)
+	require.ErrorContains(t, repaired.Problems[0].Err, "using the latest shards found")
+
+	// a missing shard is a problem of the database
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, filePerm))
+
+	shard := m.shardOf("a")
+	require.NoError(t, os.Remove(filepath.Join(dir, shardName(kvFileName, shard, m.shards[shard]))))
+
+	report, err = Verify(dir, false)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.ErrorIs(t, report.Problems[0].Err, ErrCorrupted)
+	require.ErrorContains(t, report.Problems[0].Err, shardName(kvFileName, shard, m.shards[shard]))
+
+	repaired, err = Repair(dir, filepath.Join(dir, "other"))
+	require.NoError(t, err)
+	require.Less(t, repaired.Buckets, 5)
+	require.Len(t, repaired.Problems, 1)
+}
+
+func TestManifest_Encode(t *testing.T) {
+	m, err := newManifest(3)
+	require.NoError(t, err)
+
+	m = m.next([]int{0, 1, 2}).next([]int{1})
+
+	for _, flags := range []uint16{0, flagChecksums} {
+		data := encodeManifest(m, flags).Bytes()
+		require.True(t, isManifest(data))
+
+		hdr, body, err := parseHeader(data)
+		require.NoError(t, err)
+
+		decoded, err := decodeManifest(body, hdr.flags)
+		require.NoError(t, err)
+		require.Equal(t, m, decoded)
+		require.Equal(t, []shardRef{{shard: 1, generation: 1}}, decoded.stale)
+
+		_, err = decodeManifest(body[:len(body)-1], hdr.flags)
+		require.ErrorIs(t, err, ErrCorrupted)
+	}
+
+	// a shard cannot be newer than the manifest
+	m.shards[0] = m.generation + 1
+
+	_, body, err := parseHeader(encodeManifest(m, 0).Bytes())
+	require.NoError(t, err)
+
+	_, err = decodeManifest(body, 0)
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	// the buckets of a database are never read from a manifest
+	_, err = decodeBuckets(encodeManifest(m, 0).Bytes())
+	require.ErrorIs(t, err, errManifest)
+}
+
+func TestManifest_ShardOf(t *testing.T) {
+	m, err := newManifest(4)
+	require.NoError(t, err)
+
+	var shards []int
+	for i := 0; i < 64; i++ {
+		shards = append(shards, m.shardOf(string(rune('a'+i))))
+	}
+
+	slices.Sort(shards)
+	require.Equal(t, []int{0, 1, 2, 3}, slices.Compact(shards))
+
+	// the assignment depends on the key
+	other, err := newManifest(4)
+	require.NoError(t, err)
+
+	differ := false
+	for i := 0; i < 64 && !differ; i++ {
+		name := string(rune('a' + i))
+		differ = m.shardOf(name) != other.shardOf(name)
+	}
+
+	require.True(t, differ)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func requireNoFiles(t *testing.T, dir, pattern string) {
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+// setBuckets sets the key "key" to the name of each bucket in one update.
+func setBuckets(t *testing.T, db DB, names ...string) {
+	err := db.Update(func(txn WritableTx) error {
+		for _, name := range names {
+			b, err := txn.GetBucketOrCreate([]byte(name))
+			require.NoError(t, err)
+
+			err = b.Set([]byte("key"), []byte(name))
+			require.NoError(t, err)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package purbkv
+
+// syncDir is not supported on this platform, where a directory cannot be
+// opened to be synced, and it does nothing.
+func syncDir(fsys FileSystem, dir string) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package purbkv
+
+import (
+	"os"
+)
+
+// syncDir syncs the directory so that the files created or renamed in it are
+// durable.
+func syncDir(fsys FileSystem, dir string) error {
+	file, err := fsys.OpenFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -9,31 +9,48 @@ import (
 
 // dpTx implements kv.ReadableTx and kv.WritableTx
 type dpTx struct {
-	db       *bucketDb
+	db *bucketDb
+	// cache reads the buckets that are not in the state of a lazily loaded
+	// database
+	cache *shardCache
+	// paged is true when the buckets are split in pages of the given size
+	paged    bool
+	pageSize int
+	// buckets are the buckets of a paged database used by the transaction
+	buckets map[string]*pagedBucket
+	// overlays are the buckets used by the transaction otherwise
+	overlays map[string]*txBucket
 	new      bucketDb
-	onCommit func()
+	onCommit []func()
+	// err is the failure to read a bucket, which fails the transaction
+	err error
 }
 
 // GetBucket implements kv.ReadableTx. It returns the bucket with the given name
 // or nil if it does not exist.
 func (tx *dpTx) GetBucket(name []byte) Bucket {
-	_, found := tx.new.Db[string(name)]
+	if tx.paged {
+		b := tx.getPaged(string(name))
+		if b == nil {
+			return nil
+		}
+
+		return b
+	}
+
+	b, found := tx.overlays[string(name)]
 	if found {
-		return tx.new.Db[string(name)]
+		return b
 	}
 
-	tx.db.RLock()
-	defer tx.db.RUnlock()
+	// the database is already locked by View or Update
 	oldBucket, found := tx.db.Db[string(name)]
-	if found {
-		tx.new.Db[string(name)] = &dpBucket{
-			make(kv),
-			kOrder{},
-		}
-		maps.Copy(tx.new.Db[string(name)].Kv, oldBucket.Kv)
-		tx.new.Db[string(name)].updateIndex()
+	if !found && tx.cache != nil {
+		oldBucket, found = tx.load(string(name))
+	}
 
-		return tx.new.Db[string(name)]
+	if found {
+		return tx.addOverlay(string(name), oldBucket)
 	}
 
 	return nil
@@ -50,22 +67,111 @@ func (tx *dpTx) GetBucketOrCreate(name []byte) (Bucket, error) {
 		return nil, xerrors.New("create bucket failed: bucket name required")
 	}
 
+	if tx.paged {
+		b := tx.getPaged(string(name))
+		if tx.err != nil {
+			return nil, tx.err
+		}
+
+		if b != nil {
+			return b, nil
+		}
+
+		return tx.createPaged(string(name)), nil
+	}
+
 	bucket := tx.GetBucket(name)
 
+	// the bucket may exist in a shard that cannot be read
+	if tx.err != nil {
+		return nil, tx.err
+	}
+
 	if bucket != nil {
 		return bucket, nil
 	}
 
-	tx.new.Db[string(name)] = &dpBucket{
-		make(kv),
-		kOrder{},
+	return tx.addOverlay(string(name), nil), nil
+}
+
+func (tx *dpTx) addOverlay(name string, base *dpBucket) *txBucket {
+	if tx.overlays == nil {
+		tx.overlays = make(map[string]*txBucket)
+	}
+
+	b := newTxBucket(base)
+	tx.overlays[name] = b
+
+	return b
+}
+
+// merge applies the changes of the transaction to the buckets. The saved
+// buckets are modified in place, so the caller must hold the lock of the
+// buckets.
+func (tx *dpTx) merge(db map[string]*dpBucket) {
+	maps.Copy(db, tx.new.Db)
+
+	for name, overlay := range tx.overlays {
+		if overlay.dirty() {
+			db[name] = overlay.apply()
+		}
+	}
+}
+
+// stage puts the changes of the transaction on top of the buckets without
+// modifying them, so that the saved buckets can still be read while the
+// changes are written. The staged buckets must be settled before they are
+// read otherwise.
+func (tx *dpTx) stage(db map[string]*dpBucket) {
+	maps.Copy(db, tx.new.Db)
+
+	for name, overlay := range tx.overlays {
+		if overlay.dirty() {
+			db[name] = overlay.staged()
+		}
+	}
+}
+
+// changed returns the names of the buckets modified by the transaction. The
+// pages of a paged database are only copied when they are modified.
+func (tx *dpTx) changed() []string {
+	names := maps.Keys(tx.new.Db)
+
+	for name, overlay := range tx.overlays {
+		if overlay.dirty() {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// load reads the saved bucket of a lazily loaded database. A failure is kept to
+// fail the transaction as the bucket would otherwise look missing.
+func (tx *dpTx) load(name string) (*dpBucket, bool) {
+	if tx.err != nil {
+		return nil, false
 	}
 
-	return tx.new.Db[string(name)], nil
+	bucket, err := tx.cache.get(name)
+	if err != nil {
+		tx.fail(xerrors.Errorf("failed to load bucket %q: %w", name, err))
+		return nil, false
+	}
+
+	return bucket, bucket != nil
+}
+
+// fail keeps the first error of the transaction.
+func (tx *dpTx) fail(err error) {
+	if tx.err == nil {
+		tx.err = err
+	}
 }
 
 // OnCommit implements store.Transaction. It registers a callback that is called
-// after the transaction is successful.
+// after the transaction is successful. Callbacks are called in the order they
+// are registered.
 func (tx *dpTx) OnCommit(fn func()) {
-	tx.onCommit = fn
+	tx.onCommit = append(tx.onCommit, fn)
 }
@@ -0,0 +1,384 @@
+package purbkv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/xerrors"
+)
+
+// Problem is an issue found while verifying a database.
+type Problem struct {
+	// Bucket is the name of the bucket concerned, or empty if the problem is
+	// about the whole file.
+	Bucket string
+	// Err describes the problem. It wraps ErrEmpty, ErrTruncated or
+	// ErrCorrupted.
+	Err error
+}
+
+// String returns a human-readable description of the problem.
+func (p Problem) String() string {
+	if p.Bucket == "" {
+		return p.Err.Error()
+	}
+
+	return fmt.Sprintf("bucket %q: %v", p.Bucket, p.Err)
+}
+
+// Report is the result of the verification of a database file.
+type Report struct {
+	// File is the path of the file verified.
+	File string
+	// Purb tells if the file is a PURB.
+	Purb bool
+	// Version is the version of the format, 0 being the legacy gob encoding.
+	Version uint16
+	// Checksums tells if the buckets are protected by checksums.
+	Checksums bool
+	// Buckets is the number of buckets that could be read.
+	Buckets int
+	// Pairs is the number of pairs that could be read.
+	Pairs int
+	// Root is the Merkle root of the content that could be read.
+	Root []byte
+	// Problems is the list of issues found, empty if the file is sound.
+	Problems []Problem
+}
+
+// OK returns true if no problem was found.
+func (r Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// String returns a human-readable summary of the report.
+func (r Report) String() string {
+	out := new(strings.Builder)
+
+	fmt.Fprintf(out, "file: %s\n", r.File)
+	fmt.Fprintf(out, "purb: %t\n", r.Purb)
+	fmt.Fprintf(out, "version: %d\n", r.Version)
+	fmt.Fprintf(out, "checksums: %t\n", r.Checksums)
+	fmt.Fprintf(out, "buckets: %d\n", r.Buckets)
+	fmt.Fprintf(out, "pairs: %d\n", r.Pairs)
+	fmt.Fprintf(out, "root: %s\n", hex.EncodeToString(r.Root))
+
+	if r.OK() {
+		fmt.Fprint(out, "status: ok")
+		return out.String()
+	}
+
+	fmt.Fprintf(out, "status: %d problem(s)", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(out, "\n- %s", p)
+	}
+
+	return out.String()
+}
+
+// Verify checks the database file in the given format in the directory at the
+// given path without opening it. It validates the format, the checksums, and
+// the order of the buckets and their keys, and it computes the Merkle root of
+// the content. The files are read from the store and the keys from the file
+// system that the options configure, like when the database is opened.
+//
+// A sharded database is checked shard by shard as listed by its manifest, and
+// a paged one page by page, so that only the hashes of the pairs are kept once
+// a shard or a page is checked. The root of a paged database is the root of its
+// buckets rather than of its pages. The problems found are listed in the
+// report, and an error is only returned when the verification cannot be run,
+// for instance when the file or the keys are missing.
+func Verify(path string, purbIsOn bool, opts ...Option) (Report, error) {
+	tmpl := newDbTemplate(opts)
+	store := openStore(tmpl, path)
+	name := dbFileName(purbIsOn)
+
+	report := Report{
+		File: filepath.Join(path, name),
+		Purb: purbIsOn,
+	}
+
+	data, err := store.Get(name)
+	if err != nil {
+		return report, xerrors.Errorf("failed to read DB file: %v", err)
+	}
+
+	var blob *Blob
+
+	if purbIsOn && len(data) > 0 {
+		_, err = tmpl.fsys.Stat(filepath.Join(path, keysFileName))
+		if errors.Is(err, fs.ErrNotExist) {
+			return report, xerrors.Errorf("missing key file in %s", path)
+		}
+
+		blob, err = NewBlob(path, tmpl.blobOptions()...)
+		if err != nil {
+			return report, xerrors.Errorf("failed to create blob: %v", err)
+		}
+
+		defer blob.Wipe()
+
+		data, err = blob.Decode(data)
+		if err != nil {
+			report.addProblem("", xerrors.Errorf("%w: failed to decode PURB: %v", ErrCorrupted, err))
+			return report, nil
+		}
+
+		defer wipe(data)
+	}
+
+	// read returns the content of a shard or a page, which is decoded like the
+	// database file
+	read := func(name string) ([]byte, error) {
+		data, err := store.Get(name)
+		if err != nil || blob == nil || len(data) == 0 {
+			return data, err
+		}
+
+		data, err = blob.Decode(data)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to decode PURB: %v", err)
+		}
+
+		return data, nil
+	}
+
+	summaries := report.check(data, read)
+
+	names := maps.Keys(summaries)
+	slices.Sort(names)
+
+	hashes := make([][]byte, len(names))
+	for i, name := range names {
+		hashes[i] = leafHash([]byte(name), summaries[name].root)
+		report.Pairs += summaries[name].pairs
+	}
+
+	report.Buckets = len(names)
+	report.Root = merkleRoot(hashes)
+
+	if tmpl.expectedRoot != nil && !bytes.Equal(tmpl.expectedRoot, report.Root) {
+		report.addProblem("", xerrors.Errorf("%w: root %x does not match the expected %x",
+			ErrCorrupted, report.Root, tmpl.expectedRoot))
+	}
+
+	return report, nil
+}
+
+// bucketSummary is what the verification keeps of a bucket once it is checked.
+type bucketSummary struct {
+	root  []byte
+	pairs int
+}
+
+func newBucketSummary(bucket *dpBucket) bucketSummary {
+	return bucketSummary{
+		root:  bucket.merkleRoot(),
+		pairs: len(bucket.Kv),
+	}
+}
+
+// summarize returns the summaries of the buckets.
+func summarize(db map[string]*dpBucket) map[string]bucketSummary {
+	summaries := make(map[string]bucketSummary, len(db))
+
+	for name, bucket := range db {
+		summaries[name] = newBucketSummary(bucket)
+	}
+
+	return summaries
+}
+
+// check decodes the database file and records any problem in the report. It
+// returns the summaries of the buckets that could be read. The shards listed
+// by a manifest are read with the function.
+func (r *Report) check(data []byte, read func(name string) ([]byte, error)) map[string]bucketSummary {
+	if !isManifest(data) {
+		return summarize(r.decode(data))
+	}
+
+	hdr, body, _ := parseHeader(data)
+	r.Version = hdr.version
+	r.Checksums = hdr.flags&flagChecksums != 0
+
+	return r.checkShards(body, hdr.flags, read)
+}
+
+// decode decodes a file that holds buckets and records any problem in the
+// report. It returns the buckets that could be read.
+func (r *Report) decode(data []byte) map[string]*dpBucket {
+	hdr, body, err := parseHeader(data)
+	r.Version = hdr.version
+	r.Checksums = hdr.flags&flagChecksums != 0
+
+	if err != nil {
+		r.addProblem("", err)
+		return nil
+	}
+
+	if hdr.flags&flagManifest != 0 {
+		r.addProblem("", xerrors.Errorf("%w: %v", ErrCorrupted, errManifest))
+		return nil
+	}
+
+	if hdr.version == 0 {
+		db, err := decodeLegacy(body)
+		if err != nil {
+			r.addProblem("", err)
+		}
+
+		return db
+	}
+
+	br, err := newBodyReader(body, hdr.flags)
+	if err != nil {
+		r.addProblem("", xerrors.Errorf("%w: %v", ErrCorrupted, err))
+		return nil
+	}
+
+	db := make(map[string]*dpBucket)
+	prev := ""
+
+	for {
+		name, bucket, keys, err := br.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if errors.Is(err, errChecksum) {
+			r.addProblem(name, xerrors.Errorf("%w: %v", ErrCorrupted, err))
+		} else if err != nil {
+			r.addProblem("", xerrors.Errorf("%w: %v", ErrCorrupted, err))
+			return db
+		}
+
+		if len(db) > 0 && name <= prev {
+			r.addProblem(name, xerrors.Errorf("%w: bucket is out of order or duplicated", ErrCorrupted))
+		}
+
+		if bucket.idx.len() != len(keys) {
+			r.addProblem(name, xerrors.Errorf("%w: %d duplicated key(s)",
+				ErrCorrupted, len(keys)-bucket.idx.len()))
+		} else if !slices.Equal(keys, bucket.idx.keys()) {
+			r.addProblem(name, xerrors.Errorf("%w: keys are out of order", ErrCorrupted))
+		}
+
+		db[name] = bucket
+		prev = name
+	}
+
+	if r.Checksums && br.remaining() > 0 {
+		r.addProblem("", xerrors.Errorf("%w: %d unexpected bytes after the buckets",
+			ErrCorrupted, br.remaining()))
+	}
+
+	return db
+}
+
+// checkShards decodes the manifest and checks every shard it lists, one at a
+// time. It returns the summaries of the buckets of the shards, whose pages are
+// checked one at a time as well when the database is paged.
+func (r *Report) checkShards(body []byte, flags uint16, read func(name string) ([]byte, error)) map[string]bucketSummary {
+	m, err := decodeManifest(body, flags)
+	if err != nil {
+		r.addProblem("", err)
+		return nil
+	}
+
+	summaries := make(map[string]bucketSummary)
+
+	for i, gen := range m.shards {
+		// the shard was never written
+		if gen == 0 {
+			continue
+		}
+
+		name := shardName(filepath.Base(r.File), i, gen)
+
+		data, err := read(name)
+		if err != nil {
+			r.addProblem("", xerrors.Errorf("%w: shard %s: %v", ErrCorrupted, name, err))
+			continue
+		}
+
+		shard := Report{}
+		buckets := shard.decode(data)
+		wipe(data)
+
+		for _, p := range shard.Problems {
+			if p.Bucket == "" {
+				p.Err = xerrors.Errorf("shard %s: %w", name, p.Err)
+			}
+
+			r.Problems = append(r.Problems, p)
+		}
+
+		for bucket, content := range buckets {
+			if m.shardOf(bucket) != i {
+				r.addProblem(bucket, xerrors.Errorf("%w: bucket is in the wrong shard %s", ErrCorrupted, name))
+			}
+
+			if m.paged {
+				summaries[bucket] = r.checkTree(bucket, content, read)
+			} else {
+				summaries[bucket] = newBucketSummary(content)
+			}
+		}
+	}
+
+	return summaries
+}
+
+// checkTree checks the pages of the tree of the bucket one at a time, and
+// returns the summary of the pairs of its leaves in the order of the tree.
+func (r *Report) checkTree(bucket string, root *dpBucket, read func(name string) ([]byte, error)) bucketSummary {
+	var hashes [][]byte
+
+	walkPages(bucket, root, func(bucket string, ref pageRef) *dpBucket {
+		return r.checkPage(bucket, pageName(filepath.Base(r.File), ref), read)
+	}, r.addProblem, func(leaf *dpBucket) {
+		leaf.idx.ascend("", func(k string) bool {
+			hashes = append(hashes, leafHash([]byte(k), leaf.Kv[k]))
+			return true
+		})
+	})
+
+	return bucketSummary{root: merkleRoot(hashes), pairs: len(hashes)}
+}
+
+// checkPage checks the file of a page of the bucket, and returns the content of
+// the page or nil when it cannot be read.
+func (r *Report) checkPage(bucket, name string, read func(name string) ([]byte, error)) *dpBucket {
+	data, err := read(name)
+	if err != nil {
+		r.addProblem(bucket, xerrors.Errorf("%w: page %s: %v", ErrCorrupted, name, err))
+		return nil
+	}
+
+	page := Report{}
+	buckets := page.decode(data)
+	wipe(data)
+
+	for _, p := range page.Problems {
+		r.addProblem(bucket, xerrors.Errorf("page %s: %w", name, p.Err))
+	}
+
+	if len(buckets) != 1 || buckets[""] == nil {
+		r.addProblem(bucket, xerrors.Errorf("%w: page %s holds %d bucket(s)", ErrCorrupted, name, len(buckets)))
+		return nil
+	}
+
+	return buckets[""]
+}
+
+func (r *Report) addProblem(bucket string, err error) {
+	r.Problems = append(r.Problems, Problem{Bucket: bucket, Err: err})
+}
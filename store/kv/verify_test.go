@@ -0,0 +1,201 @@
+package purbkv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify_Sound(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, false)
+	require.NoError(t, err)
+
+	fillProverDB(t, db)
+	root := db.(Prover).Root()
+	require.NoError(t, db.Close())
+
+	report, err := Verify(dir, false)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.String())
+	require.Equal(t, filepath.Join(dir, kvFileName), report.File)
+	require.False(t, report.Purb)
+	require.Equal(t, formatVersion, report.Version)
+	require.True(t, report.Checksums)
+	require.Equal(t, 3, report.Buckets)
+	require.Equal(t, 4, report.Pairs)
+	require.Equal(t, root, report.Root)
+	require.Contains(t, report.String(), "status: ok")
+
+	report, err = Verify(dir, false, WithExpectedRoot(root))
+	require.NoError(t, err)
+	require.True(t, report.OK())
+
+	report, err = Verify(dir, false, WithExpectedRoot(emptyRoot()))
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.ErrorIs(t, report.Problems[0].Err, ErrCorrupted)
+	require.ErrorContains(t, report.Problems[0].Err, "does not match the expected")
+}
+
+func TestVerify_Purb(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), purbDbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(dir, true)
+	require.NoError(t, err)
+
+	fillProverDB(t, db)
+	root := db.(Prover).Root()
+	require.NoError(t, db.Close())
+
+	report, err := Verify(dir, true, WithExpectedRoot(root))
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.String())
+	require.True(t, report.Purb)
+	require.False(t, report.Checksums)
+	require.Equal(t, 4, report.Pairs)
+
+	data := readFile(t, dir)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, purbFileName), data, filePerm))
+
+	report, err = Verify(dir, true)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.ErrorIs(t, report.Problems[0].Err, ErrCorrupted)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, keysFileName)))
+
+	_, err = Verify(dir, true)
+	require.ErrorContains(t, err, "missing key file")
+}
+
+func TestVerify_Store(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newCountingStore()
+
+	db, err := NewDB(dir, true, WithBlobStore(store), WithShards(4), WithPaging(128))
+	require.NoError(t, err)
+
+	setPairs(t, db, "a", 100)
+	setPairs(t, db, "b", 10)
+
+	root := db.(Prover).Root()
+	require.NoError(t, db.Close())
+
+	// the files are read from the store, and the keys from the directory
+	_, err = Verify(dir, true)
+	require.ErrorContains(t, err, "failed to read DB file")
+
+	store.reset()
+
+	report, err := Verify(dir, true, WithBlobStore(store), WithExpectedRoot(root))
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.String())
+	require.Equal(t, 2, report.Buckets)
+	require.Equal(t, 110, report.Pairs)
+
+	// every page is read once
+	var pages []string
+	for _, name := range store.reads() {
+		_, ok := parsePageName(purbFileName, name)
+		if ok {
+			require.NotContains(t, pages, name)
+			pages = append(pages, name)
+		}
+	}
+
+	require.Greater(t, len(pages), 4)
+	data, err := store.Get(pages[len(pages)-1])
+	require.NoError(t, err)
+
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, store.Put(pages[len(pages)-1], data))
+
+	report, err = Verify(dir, true, WithBlobStore(store), WithExpectedRoot(root))
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 2)
+	require.ErrorIs(t, report.Problems[0].Err, ErrCorrupted)
+	require.ErrorContains(t, report.Problems[0].Err, pages[len(pages)-1])
+	require.ErrorContains(t, report.Problems[1].Err, "does not match the expected")
+	require.Less(t, report.Pairs, 110)
+}
+
+func TestVerify_DamagedBucket(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db := map[string]*dpBucket{
+		"A": makeBucket("ping", "pong"),
+		"B": makeBucket("1", "a"),
+	}
+
+	data := encodeBuckets(db, flagChecksums).Bytes()
+	// the value of bucket A is at the end of its section
+	data[headerLength+1+9] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), data, filePerm))
+
+	report, err := Verify(dir, false)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.Equal(t, "A", report.Problems[0].Bucket)
+	require.ErrorIs(t, report.Problems[0].Err, ErrCorrupted)
+	require.Equal(t, 2, report.Buckets)
+	require.Contains(t, report.String(), "status: 1 problem(s)")
+}
+
+func TestVerify_Order(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// version 1 with the buckets B and A, and the keys of B not sorted
+	data := []byte("PKVD\x00\x01\x00\x00\x02" +
+		"\x01B\x02\x012\x01b\x011\x01a" +
+		"\x01A\x02\x01x\x01y\x01x\x01z")
+
+	_, err = decodeBuckets(data)
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), data, filePerm))
+
+	report, err := Verify(dir, false)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), report.Version)
+	require.Len(t, report.Problems, 3)
+	require.Equal(t, "B", report.Problems[0].Bucket)
+	require.ErrorContains(t, report.Problems[0].Err, "keys are out of order")
+	require.Equal(t, "A", report.Problems[1].Bucket)
+	require.ErrorContains(t, report.Problems[1].Err, "bucket is out of order")
+	require.ErrorContains(t, report.Problems[2].Err, "1 duplicated key(s)")
+}
+
+func TestVerify_Truncated(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), dbTestDir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = Verify(dir, false)
+	require.ErrorContains(t, err, "failed to read DB file")
+
+	data := encodeBuckets(map[string]*dpBucket{"A": makeBucket("ping", "pong")}, flagChecksums).Bytes()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kvFileName), data[:len(data)-1], filePerm))
+
+	report, err := Verify(dir, false)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.Empty(t, report.Problems[0].Bucket)
+	require.ErrorIs(t, report.Problems[0].Err, ErrTruncated)
+	require.Equal(t, 0, report.Buckets)
+}